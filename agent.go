@@ -0,0 +1,183 @@
+package snmplib
+
+import (
+	"fmt"
+	"log"
+	"net"
+)
+
+// Agent answers SNMP v2c requests using its handlers, turning the library into a lightweight agent.
+//
+// Handlers return exceptions (NoSuchObject, NoSuchInstance, EndOfMibView) as values for the objects they
+// don't have. An error makes the whole request fail: a *PDUError sets the error-status it holds, any other
+// error is reported as genErr. A nil handler answers noSuchObject for GET, endOfMibView for GETNEXT and
+// notWritable for SET.
+type Agent struct {
+	Community  string // Only requests for this community are answered, empty answers all of them.
+	PacketSize int    // Largest request read, 0 uses the default.
+
+	HandleGet     func(oid Oid) (interface{}, error)
+	HandleGetNext func(oid Oid) (Oid, interface{}, error)
+	HandleSet     func(oid Oid, value interface{}) error
+}
+
+// Serve reads requests from conn and answers them, until reading fails, e.g. because conn was closed.
+func (a *Agent) Serve(conn net.PacketConn) error {
+	packetSize := a.PacketSize
+	if packetSize <= 0 {
+		packetSize = bufSize
+	}
+	packet := make([]byte, packetSize)
+	for {
+		numRead, addr, err := conn.ReadFrom(packet)
+		if err != nil {
+			return err
+		}
+
+		resp, err := a.handle(packet[:numRead])
+		if err != nil {
+			log.Printf("Error: Dropping request from %v: %v", addr, err)
+			continue
+		}
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			log.Printf("Error: Couldn't answer %v: %v", addr, err)
+		}
+	}
+}
+
+// handle decodes a request and returns the encoded response.
+func (a *Agent) handle(request []byte) ([]byte, error) {
+	msg, err := DecodeMessage(request)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Version != SNMPv2c {
+		return nil, fmt.Errorf("unsupported version %v", msg.Version)
+	}
+	if a.Community != "" && msg.Community != a.Community {
+		return nil, fmt.Errorf("wrong community %q", msg.Community)
+	}
+	req := msg.PDU
+
+	var varbinds []VarBind
+	switch msg.PDUType {
+	case AsnGetRequest:
+		varbinds, err = a.get(req.VarBinds)
+	case AsnGetNextRequest:
+		varbinds, err = a.getNext(req.VarBinds)
+	case AsnGetBulkRequest:
+		// Error-status and error-index hold non-repeaters and max-repetitions.
+		varbinds, err = a.getBulk(req.VarBinds, req.ErrorStatus, req.ErrorIndex)
+	case AsnSetRequest:
+		varbinds, err = a.set(req.VarBinds)
+	default:
+		return nil, fmt.Errorf("unsupported PDU type 0x%02x", uint8(msg.PDUType))
+	}
+
+	errorStatus, errorIndex := 0, 0
+	if err != nil {
+		// Failed requests are answered with the varbinds of the request.
+		varbinds = req.VarBinds
+		errorStatus = 5 // genErr
+		pduErr, ok := err.(*PDUError)
+		if ok {
+			errorStatus = pduErr.ErrorStatus
+			errorIndex = pduErr.ErrorIndex
+		}
+	}
+
+	respVarbinds := []interface{}{Sequence}
+	for _, varbind := range varbinds {
+		respVarbinds = append(respVarbinds, []interface{}{Sequence, varbind.Oid, varbind.Value})
+	}
+	return EncodeSequence([]interface{}{Sequence, int(msg.Version), msg.Community,
+		[]interface{}{AsnGetResponse, req.RequestID, errorStatus, errorIndex, respVarbinds}})
+}
+
+// pduError makes err a PDUError for the varbind at idx, keeping its error-status if it has one.
+func pduError(err error, idx int) error {
+	if pduErr, ok := err.(*PDUError); ok {
+		return &PDUError{ErrorStatus: pduErr.ErrorStatus, ErrorIndex: idx + 1}
+	}
+	return &PDUError{ErrorStatus: 5, ErrorIndex: idx + 1} // genErr
+}
+
+func (a *Agent) get(request []VarBind) ([]VarBind, error) {
+	result := make([]VarBind, len(request))
+	for idx, varbind := range request {
+		result[idx] = VarBind{Oid: varbind.Oid, Value: NoSuchObject}
+		if a.HandleGet == nil {
+			continue
+		}
+		val, err := a.HandleGet(varbind.Oid)
+		if err != nil {
+			return nil, pduError(err, idx)
+		}
+		result[idx].Value = val
+	}
+	return result, nil
+}
+
+func (a *Agent) getNext(request []VarBind) ([]VarBind, error) {
+	result := make([]VarBind, len(request))
+	for idx, varbind := range request {
+		result[idx] = VarBind{Oid: varbind.Oid, Value: EndOfMibView}
+		if a.HandleGetNext == nil {
+			continue
+		}
+		oid, val, err := a.HandleGetNext(varbind.Oid)
+		if err != nil {
+			return nil, pduError(err, idx)
+		}
+		if val != EndOfMibView {
+			result[idx] = VarBind{Oid: oid, Value: val}
+		}
+	}
+	return result, nil
+}
+
+func (a *Agent) getBulk(request []VarBind, nonRepeaters, maxRepetitions int) ([]VarBind, error) {
+	if nonRepeaters < 0 {
+		nonRepeaters = 0
+	}
+	if nonRepeaters > len(request) {
+		nonRepeaters = len(request)
+	}
+	result, err := a.getNext(request[:nonRepeaters])
+	if err != nil {
+		return nil, err
+	}
+
+	repeaters := request[nonRepeaters:]
+	for rep := 0; rep < maxRepetitions && len(repeaters) > 0; rep++ {
+		next, err := a.getNext(repeaters)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, next...)
+		repeaters = next
+
+		ended := true
+		for _, varbind := range next {
+			if varbind.Value != EndOfMibView {
+				ended = false
+			}
+		}
+		if ended {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (a *Agent) set(request []VarBind) ([]VarBind, error) {
+	for idx, varbind := range request {
+		if a.HandleSet == nil {
+			return nil, &PDUError{ErrorStatus: 17, ErrorIndex: idx + 1} // notWritable
+		}
+		if err := a.HandleSet(varbind.Oid, varbind.Value); err != nil {
+			return nil, pduError(err, idx)
+		}
+	}
+	return request, nil
+}
@@ -0,0 +1,179 @@
+package snmplib
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAgentLoopback(t *testing.T) {
+	mib := map[string]interface{}{
+		".1.3.6.1.2.1.1.1.0": "test agent",
+		".1.3.6.1.2.1.1.3.0": time.Duration(1234) * 10 * time.Millisecond,
+	}
+	order := []Oid{MustParseOid("1.3.6.1.2.1.1.1.0"), MustParseOid("1.3.6.1.2.1.1.3.0")}
+	sets := make(chan VarBind, 2)
+	agent := &Agent{
+		Community: "public",
+		HandleGet: func(oid Oid) (interface{}, error) {
+			if val, ok := mib[oid.String()]; ok {
+				return val, nil
+			}
+			return NoSuchObject, nil
+		},
+		HandleGetNext: func(oid Oid) (Oid, interface{}, error) {
+			for _, next := range order {
+				if next.Compare(oid) > 0 {
+					return next, mib[next.String()], nil
+				}
+			}
+			return oid, EndOfMibView, nil
+		},
+		HandleSet: func(oid Oid, value interface{}) error {
+			if _, ok := mib[oid.String()]; !ok {
+				return &PDUError{ErrorStatus: 11} // noCreation
+			}
+			sets <- VarBind{Oid: oid, Value: value}
+			return nil
+		},
+	}
+
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer server.Close()
+	go agent.Serve(server)
+
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to agent: %v", err)
+	}
+	client := NewSNMPOnConn(server.LocalAddr().String(), "public", SNMPv2c, time.Second, 1, conn)
+	defer client.Close()
+
+	val, err := client.Get(order[0])
+	if err != nil || val != "test agent" {
+		t.Errorf("Get returned %v, %v", val, err)
+	}
+	val, err = client.Get(MustParseOid("1.3.6.1.2.1.1.2.0"))
+	if err != nil || val != NoSuchObject {
+		t.Errorf("Get of a missing object returned %v, %v", val, err)
+	}
+
+	oid, val, err := client.GetNext(MustParseOid("1.3.6.1.2.1.1.1.0"))
+	if err != nil || !oid.Equal(order[1]) || val != mib[order[1].String()] {
+		t.Errorf("GetNext returned %v, %v, %v", oid, val, err)
+	}
+
+	walked, err := client.SnmpWalk(MustParseOid("1.3.6.1.2.1.1"))
+	if err != nil || len(walked) != 2 {
+		t.Errorf("SnmpWalk returned %v, %v", walked, err)
+	}
+
+	if err := client.Set(order[0], "renamed"); err != nil {
+		t.Errorf("Error setting %v: %v", order[0], err)
+	}
+	err = client.Set(MustParseOid("1.3.6.1.2.1.1.9.0"), "renamed")
+	if pduErr, ok := err.(*PDUError); !ok || pduErr.ErrorStatus != 11 || pduErr.ErrorIndex != 1 {
+		t.Errorf("Set of a missing object returned %v, expected noCreation at index 1", err)
+	}
+	if set := <-sets; !set.Oid.Equal(order[0]) || set.Value != "renamed" {
+		t.Errorf("HandleSet got %v", set)
+	}
+}
+
+// newMibClient starts an agent serving the varbinds, which must be sorted by oid, and returns a v2c
+// client for it. Both stop at the end of the test.
+func newMibClient(t testing.TB, mib []VarBind) *SNMP {
+	agent := &Agent{
+		HandleGet: func(oid Oid) (interface{}, error) {
+			for _, varbind := range mib {
+				if varbind.Oid.Equal(oid) {
+					return varbind.Value, nil
+				}
+			}
+			return NoSuchObject, nil
+		},
+		HandleGetNext: func(oid Oid) (Oid, interface{}, error) {
+			for _, varbind := range mib {
+				if varbind.Oid.Compare(oid) > 0 {
+					return varbind.Oid, varbind.Value, nil
+				}
+			}
+			return oid, EndOfMibView, nil
+		},
+	}
+	return newAgentClient(t, agent)
+}
+
+// newAgentClient serves agent on a loopback port, and returns a v2c client of it.
+func newAgentClient(t testing.TB, agent *Agent) *SNMP {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	go agent.Serve(server)
+
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to agent: %v", err)
+	}
+	client := NewSNMPOnConn(server.LocalAddr().String(), "public", SNMPv2c, time.Second, 1, conn)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+func TestSetGuarded(t *testing.T) {
+	serialOid := MustParseOid("1.3.6.1.6.3.1.1.6.1.0")
+	sysContact := MustParseOid("1.3.6.1.2.1.1.4.0")
+	var mu sync.Mutex
+	serial, races := 7, 1
+	var contacts []interface{}
+	agent := &Agent{
+		HandleGet: func(oid Oid) (interface{}, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			value := serial
+			if races > 0 {
+				// Another manager sets between our GET and SET.
+				races--
+				serial++
+			}
+			return value, nil
+		},
+		HandleSet: func(oid Oid, value interface{}) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if oid.Equal(serialOid) {
+				if value != serial {
+					return &PDUError{ErrorStatus: 12} // inconsistentValue
+				}
+				serial++
+				return nil
+			}
+			contacts = append(contacts, value)
+			return nil
+		},
+	}
+	client := newAgentClient(t, agent)
+
+	if err := client.SetGuarded(sysContact, "noc@example.com", serialOid); err != nil {
+		t.Fatalf("Error in SetGuarded: %v", err)
+	}
+	mu.Lock()
+	if len(contacts) != 1 || contacts[0] != "noc@example.com" || serial != 9 {
+		t.Errorf("Set %v with serial %d, expected the contact set once and the serial incremented twice", contacts, serial)
+	}
+	// Losing the race twice gives up.
+	races = 2
+	mu.Unlock()
+	err := client.SetGuarded(sysContact, "other@example.com", serialOid)
+	if pduErr, ok := err.(*PDUError); !ok || pduErr.ErrorStatus != 12 || pduErr.ErrorIndex != 1 {
+		t.Errorf("SetGuarded losing the race twice returned %v, expected inconsistentValue on the serial", err)
+	}
+}
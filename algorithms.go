@@ -0,0 +1,54 @@
+package snmplib
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"fmt"
+	"hash"
+	"sort"
+)
+
+// authHashes are the SNMP V3 authentication algorithms, with the hash of their key localization and HMAC.
+var authHashes = map[string]func() hash.Hash{
+	SnmpMD5:  md5.New,
+	SnmpSHA1: sha1.New,
+}
+
+// privKeyLengths are the SNMP V3 privacy algorithms, with the length of their localized key, pre-IV
+// included for DES and 3DES.
+var privKeyLengths = map[string]int{
+	SnmpAES:  16,
+	SnmpDES:  16,
+	SnmpDES3: 32,
+}
+
+// SupportedAuthAlgorithms returns the names of the authentication algorithms NewSNMPv3 and the trap users
+// accept, sorted.
+func SupportedAuthAlgorithms() []string {
+	algs := make([]string, 0, len(authHashes))
+	for alg := range authHashes {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	return algs
+}
+
+// SupportedPrivAlgorithms returns the names of the privacy algorithms NewSNMPv3 and the trap users
+// accept, sorted.
+func SupportedPrivAlgorithms() []string {
+	algs := make([]string, 0, len(privKeyLengths))
+	for alg := range privKeyLengths {
+		algs = append(algs, alg)
+	}
+	sort.Strings(algs)
+	return algs
+}
+
+// newAuthHash returns a new hash of the authentication algorithm alg.
+func newAuthHash(alg string) (hash.Hash, error) {
+	newHash, ok := authHashes[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported auth algorithm %s", alg)
+	}
+	return newHash(), nil
+}
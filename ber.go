@@ -23,7 +23,11 @@ parse BER.
 import (
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -79,6 +83,132 @@ const (
 	AsnReport         BERType = 0xa8
 )
 
+// berTypeNames are the names of the types of the values and PDUs of SNMP messages, as ASN.1 and RFC 3416
+// name them.
+var berTypeNames = map[BERType]string{
+	AsnBoolean:  "BOOLEAN",
+	AsnInteger:  "INTEGER",
+	AsnBitStr:   "BIT STRING",
+	AsnOctetStr: "OCTET STRING",
+	AsnNull:     "NULL",
+	AsnObjectID: "OBJECT IDENTIFIER",
+	Sequence:    "SEQUENCE",
+
+	Ipaddress: "IpAddress",
+	Counter32: "Counter32",
+	Gauge32:   "Gauge32",
+	Timeticks: "TimeTicks",
+	Opaque:    "Opaque",
+	Counter64: "Counter64",
+
+	BERType(NoSuchObject):   "noSuchObject",
+	BERType(NoSuchInstance): "noSuchInstance",
+	BERType(EndOfMibView):   "endOfMibView",
+
+	AsnGetRequest:     "GetRequest",
+	AsnGetNextRequest: "GetNextRequest",
+	AsnGetResponse:    "GetResponse",
+	AsnSetRequest:     "SetRequest",
+	AsnTrap:           "Trap",
+	AsnGetBulkRequest: "GetBulkRequest",
+	AsnInform:         "InformRequest",
+	AsnTrap2:          "SNMPv2Trap",
+	AsnReport:         "Report",
+}
+
+// String returns the name of the type, as in "OCTET STRING" or "GetBulkRequest". Context tags are named
+// after the exceptions, which are the only ones found among values.
+func (t BERType) String() string {
+	if name, ok := berTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("BERType(0x%02x)", uint8(t))
+}
+
+// Exception is the value of a varbind the agent has no value for, as defined by RFC 3416.
+type Exception BERType
+
+// The exceptions an SNMP v2c or v3 agent can return instead of a value.
+const (
+	NoSuchObject   Exception = Exception(AsnContext | 0x00)
+	NoSuchInstance Exception = Exception(AsnContext | 0x01)
+	EndOfMibView   Exception = Exception(AsnContext | 0x02)
+)
+
+// String returns the name of the exception, as in "endOfMibView".
+func (e Exception) String() string {
+	switch e {
+	case NoSuchObject:
+		return "noSuchObject"
+	case NoSuchInstance:
+		return "noSuchInstance"
+	case EndOfMibView:
+		return "endOfMibView"
+	}
+	return fmt.Sprintf("Exception(0x%02x)", uint8(e))
+}
+
+// UnknownType holds a value of an application type the decoder doesn't know, e.g. a vendor-proprietary one.
+// Bytes is the whole raw TLV, tag and length included, so it can be logged or encoded back as is.
+type UnknownType struct {
+	Tag   BERType
+	Bytes []byte
+}
+
+// String returns the tag and the raw TLV in hex.
+func (u UnknownType) String() string {
+	return fmt.Sprintf("UnknownType(0x%02x): %x", uint8(u.Tag), u.Bytes)
+}
+
+// Typed values pick the SNMP type EncodeSequence encodes a value with, where the Go type is ambiguous. A plain
+// int is encoded as an INTEGER and a string as an OCTET STRING. Agents reject a Set whose value doesn't have
+// the type of the object, e.g. an INTEGER written to a Gauge32 object, hence the wrappers.
+type (
+	// Unsigned32 is encoded as a Gauge32, which has the same tag.
+	Unsigned32 uint32
+	// TimeTicks is encoded as TimeTicks, in hundredths of seconds. A time.Duration is as well.
+	TimeTicks uint32
+	// IpAddress is encoded as an IpAddress, it must be an IPv4 address.
+	IpAddress net.IP
+	// Bits is encoded as an OCTET STRING, as BITS objects are, see DecodeBits.
+	Bits []byte
+)
+
+// DecodeBits decodes the value of a BITS object, e.g. the ports of a VLAN in Q-BRIDGE-MIB. BITS aren't a type
+// of their own on the wire, agents send them as OCTET STRINGs, which decode as strings: the caller has to
+// know which objects are BITS.
+func DecodeBits(value interface{}) (Bits, error) {
+	switch value := value.(type) {
+	case string:
+		return Bits(value), nil
+	case Bits:
+		return value, nil
+	case []byte:
+		return Bits(value), nil
+	}
+	return nil, fmt.Errorf("%T isn't an OCTET STRING, can't be BITS", value)
+}
+
+// Set tells whether bit n is set. Bit 0 is the most significant bit of the first octet, bits past the
+// octets are unset, as RFC 2578 defines.
+func (b Bits) Set(n int) bool {
+	if n < 0 || n/8 >= len(b) {
+		return false
+	}
+	return b[n/8]&(0x80>>uint(n%8)) != 0
+}
+
+// Positions returns the numbers of the set bits, in increasing order.
+func (b Bits) Positions() []int {
+	var positions []int
+	for n := 0; n < 8*len(b); n++ {
+		if b.Set(n) {
+			positions = append(positions, n)
+		}
+	}
+	return positions
+}
+
 // SNMPVersion indicates which SNMP version is in use.
 type SNMPVersion uint8
 
@@ -89,6 +219,33 @@ const (
 	SNMPv3  SNMPVersion = 3
 )
 
+// String returns the usual name of the version, as in "v2c".
+func (v SNMPVersion) String() string {
+	switch v {
+	case SNMPv1:
+		return "v1"
+	case SNMPv2c:
+		return "v2c"
+	case SNMPv3:
+		return "v3"
+	}
+	return fmt.Sprintf("SNMPVersion(%d)", uint8(v))
+}
+
+// ParseSNMPVersion parses a version as found in configuration files. It accepts "1", "v1", "snmpv1",
+// "2c", "v2c", "snmpv2c", "2", "v2", "3", "v3" and "snmpv3", in any case.
+func ParseSNMPVersion(version string) (SNMPVersion, error) {
+	switch strings.TrimPrefix(strings.ToLower(version), "snmp") {
+	case "1", "v1":
+		return SNMPv1, nil
+	case "2c", "v2c", "2", "v2":
+		return SNMPv2c, nil
+	case "3", "v3":
+		return SNMPv3, nil
+	}
+	return 0, fmt.Errorf("unknown SNMP version %q", version)
+}
+
 // EncodeLength encodes an integer value as a BER compliant length value.
 func EncodeLength(length int) []byte {
 	// The first bit is used to indicate whether this is the final byte
@@ -122,6 +279,9 @@ func EncodeLength(length int) []byte {
 func DecodeLength(toparse []byte) (int, int, error) {
 	// If the first bit is zero, the rest of the first byte indicates the length. Values up to 127 are encoded this way (unless you're using indefinite length, but we don't support that)
 
+	if len(toparse) == 0 {
+		return 0, 0, fmt.Errorf("missing length")
+	}
 	if toparse[0] == 0x80 {
 		return 0, 0, fmt.Errorf("we don't support indefinite length encoding")
 	}
@@ -135,18 +295,110 @@ func DecodeLength(toparse []byte) (int, int, error) {
 		return 0, 0, fmt.Errorf("invalid length")
 	}
 
-	// Decode the specified number of bytes as a BER Integer encoded
-	// value.
-	val, err := DecodeInteger(toparse[1 : numOctets+1])
+	// Decode the specified number of bytes as an unsigned integer.
+	val, err := DecodeUnsigned(toparse[1 : numOctets+1])
 	if err != nil {
 		return 0, 0, err
 	}
+	if val < 0 {
+		return 0, 0, fmt.Errorf("invalid length")
+	}
 
 	return val, 1 + numOctets, nil
 }
 
-// DecodeCounter64 decodes a counter64.
+// DecodeTLVLength returns the total length of the TLV at the start of toparse, type and length
+// bytes included, so callers can strip whatever follows it.
+func DecodeTLVLength(toparse []byte) (int, error) {
+	if len(toparse) < 2 {
+		return 0, fmt.Errorf("TLV cannot be shorter than 2 bytes")
+	}
+	length, lenLen, err := DecodeLength(toparse[1:])
+	if err != nil {
+		return 0, err
+	}
+	if length > len(toparse)-1-lenLen {
+		return 0, fmt.Errorf("TLV does not contain the amount of bytes reported in its length")
+	}
+	return 1 + lenLen + length, nil
+}
+
+// splitTLVs splits the content of a constructed value into its TLVs, type and length included.
+func splitTLVs(toparse []byte) ([][]byte, error) {
+	var result [][]byte
+	for idx := 0; idx < len(toparse); {
+		tlvLen, err := DecodeTLVLength(toparse[idx:])
+		if err != nil {
+			return nil, fmt.Errorf("TLV @ idx %v: %v", idx, err)
+		}
+		result = append(result, toparse[idx:idx+tlvLen])
+		idx += tlvLen
+	}
+	return result, nil
+}
+
+// tlvContent returns the content of a TLV, without its type and length.
+func tlvContent(tlv []byte) ([]byte, error) {
+	tlvLen, err := DecodeTLVLength(tlv)
+	if err != nil {
+		return nil, err
+	}
+	_, lenLen, _ := DecodeLength(tlv[1:])
+	return tlv[1+lenLen : tlvLen], nil
+}
+
+// DecodeVarBindTypes returns the BER types of the varbind values of a v1 or v2c message, which
+// DecodeSequence doesn't keep: e.g. Gauge32 and Counter32 values are decoded as plain ints.
+func DecodeVarBindTypes(packet []byte) ([]BERType, error) {
+	// Message, then PDU, then varbind list, each the nth TLV of its parent.
+	tlv := packet
+	for _, nth := range []int{2, 3} {
+		content, err := tlvContent(tlv)
+		if err != nil {
+			return nil, err
+		}
+		tlvs, err := splitTLVs(content)
+		if err != nil {
+			return nil, err
+		}
+		if len(tlvs) <= nth {
+			return nil, fmt.Errorf("expected more than %d elements, got %d", nth, len(tlvs))
+		}
+		tlv = tlvs[nth]
+	}
+
+	content, err := tlvContent(tlv)
+	if err != nil {
+		return nil, err
+	}
+	varbinds, err := splitTLVs(content)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]BERType, len(varbinds))
+	for idx, varbind := range varbinds {
+		content, err := tlvContent(varbind)
+		if err != nil {
+			return nil, err
+		}
+		fields, err := splitTLVs(content)
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("invalid varbind %d", idx)
+		}
+		result[idx] = BERType(fields[1][0])
+	}
+	return result, nil
+}
+
+// DecodeCounter64 decodes a counter64. Values with their first bit set take 9 bytes, starting with a 0x00
+// so they don't read as negative.
 func DecodeCounter64(toparse []byte) (uint64, error) {
+	if len(toparse) == 9 && toparse[0] == 0 {
+		toparse = toparse[1:]
+	}
 	if len(toparse) > 8 {
 		return 0, fmt.Errorf("don't support more than 64 bits")
 	}
@@ -158,8 +410,25 @@ func DecodeCounter64(toparse []byte) (uint64, error) {
 	return val, nil
 }
 
-// DecodeInteger decodes an integer. Will error out if it's longer than 64 bits.
+// DecodeInteger decodes a two's complement INTEGER, negative when its first bit is set. Will error out if
+// it's longer than 64 bits.
 func DecodeInteger(toparse []byte) (int, error) {
+	if len(toparse) > 8 {
+		return 0, fmt.Errorf("don't support more than 64 bits")
+	}
+	val := 0
+	if len(toparse) > 0 && toparse[0]&0x80 != 0 {
+		val = -1
+	}
+	for _, b := range toparse {
+		val = val<<8 | int(b)
+	}
+	return val, nil
+}
+
+// DecodeUnsigned decodes an unsigned integer, as found in Counter32, Gauge32 and TimeTicks values, whose
+// first bit isn't a sign bit. Will error out if it's longer than 64 bits.
+func DecodeUnsigned(toparse []byte) (int, error) {
 	if len(toparse) > 8 {
 		return 0, fmt.Errorf("don't support more than 64 bits")
 	}
@@ -178,29 +447,155 @@ func DecodeIPAddress(toparse []byte) (string, error) {
 	return fmt.Sprintf("%d.%d.%d.%d", toparse[0], toparse[1], toparse[2], toparse[3]), nil
 }
 
-// EncodeInteger encodes an integer to BER format.
+// EncodeInteger encodes an integer to BER format, in two's complement. The encoding is the shortest one, as
+// BER requires and strict agents check: a leading 0x00 or 0xff byte is only kept when the next byte's first
+// bit doesn't carry the sign.
 func EncodeInteger(toEncode int) []byte {
-	if toEncode == 0 {
-		return []byte{0}
-	}
-	result := make([]byte, 8)
-	pos := 7
+	result := make([]byte, 9)
+	pos := 8
 	i := toEncode
-	for i > 0 {
-		result[pos] = byte(i % 256)
+	for {
+		result[pos] = byte(i)
 		i = i >> 8
+		// Stop once the rest is only the sign, carried by the first bit of the last byte.
+		if (i == 0 && result[pos] < 0x80) || (i == -1 && result[pos] >= 0x80) {
+			break
+		}
+		pos--
+	}
+	return result[pos:]
+}
+
+// EncodeCounter64 encodes a counter64 in the fewest bytes, with a leading 0x00 when its first bit is set.
+func EncodeCounter64(toEncode uint64) []byte {
+	result := make([]byte, 9)
+	pos := 8
+	for {
+		result[pos] = byte(toEncode)
+		toEncode >>= 8
+		if toEncode == 0 {
+			break
+		}
 		pos--
 	}
-	if result[pos+1] >= 0x80 {
-		result[pos] = 0x00
+	if result[pos] >= 0x80 {
 		pos--
 	}
-	return result[pos+1 : 8]
+	return result[pos:]
+}
+
+// DecodeConstructedOctetString decodes the value of a constructed (segmented) octet string, a series of
+// octet strings which may be constructed themselves, by concatenating the fragments.
+func DecodeConstructedOctetString(toparse []byte) (string, error) {
+	return decodeConstructedOctetString(toparse, defaultMaxDecodeDepth)
+}
+
+// decodeConstructedOctetString is DecodeConstructedOctetString, for strings nested in at most maxDepth
+// levels of constructed strings, this one included.
+func decodeConstructedOctetString(toparse []byte, maxDepth int) (string, error) {
+	if maxDepth < 1 {
+		return "", errors.New("nesting too deep in constructed octet string")
+	}
+	var result []byte
+	for idx := 0; idx < len(toparse); {
+		tlvLen, err := DecodeTLVLength(toparse[idx:])
+		if err != nil {
+			return "", fmt.Errorf("constructed octet string fragment @ idx %v: %v", idx, err)
+		}
+		_, lenLen, _ := DecodeLength(toparse[idx+1:])
+		value := toparse[idx+1+lenLen : idx+tlvLen]
+		switch BERType(toparse[idx]) {
+		case AsnOctetStr:
+			result = append(result, value...)
+		case AsnConstructor | AsnOctetStr:
+			fragment, err := decodeConstructedOctetString(value, maxDepth-1)
+			if err != nil {
+				return "", err
+			}
+			result = append(result, fragment...)
+		default:
+			return "", fmt.Errorf("constructed octet string contains type %v @ idx %v", toparse[idx], idx)
+		}
+		idx += tlvLen
+	}
+	return string(result), nil
+}
+
+// DecodeLimits bounds what DecodeSequenceWithLimits accepts, so a broken or malicious peer can't make it
+// allocate more than expected, or recurse without end. Zero values use the defaults, maxMsgSize for the
+// lengths and 32 for the depth.
+type DecodeLimits struct {
+	MaxLength      int // Longest sequence, i.e. whole message.
+	MaxValueLength int // Longest single value, e.g. an octet string.
+	MaxDepth       int // Most levels of nested sequences and constructed octet strings, the message being 1.
+}
+
+// defaultMaxDecodeDepth is the nesting DecodeLimits allows by default. SNMP messages need 6 levels, v3
+// ones with a decoded scoped PDU 7.
+const defaultMaxDecodeDepth = 32
+
+// withDefaults fills in the default limits.
+func (l DecodeLimits) withDefaults() DecodeLimits {
+	if l.MaxLength <= 0 {
+		l.MaxLength = maxMsgSize
+	}
+	if l.MaxValueLength <= 0 {
+		l.MaxValueLength = maxMsgSize
+	}
+	if l.MaxDepth <= 0 {
+		l.MaxDepth = defaultMaxDecodeDepth
+	}
+	return l
 }
 
 // DecodeSequence decodes BER binary data into into *[]interface{}.
 func DecodeSequence(toparse []byte) ([]interface{}, error) {
+	return DecodeSequenceWithLimits(toparse, DecodeLimits{})
+}
+
+// DecodeSequenceWithLimits is DecodeSequence, rejecting sequences and values longer than limits allow
+// before decoding them.
+func DecodeSequenceWithLimits(toparse []byte, limits DecodeLimits) ([]interface{}, error) {
+	return decodeSequence(toparse, limits.withDefaults(), false, 1)
+}
+
+// sequencePool holds the slices of released sequences, for DecodeSequencePooled.
+var sequencePool = sync.Pool{
+	New: func() interface{} {
+		seq := make([]interface{}, 0, 8)
+		return &seq
+	},
+}
+
+// DecodeSequencePooled is DecodeSequenceWithLimits, taking the slices of the result and of the
+// sequences in it from a pool rather than growing new ones, to spare the GC when decoding many packets,
+// e.g. traps. Once done with the result, pass it to ReleaseSequence. Values copied out of it, strings,
+// oids and numbers, stay valid after that, but the sequences don't.
+func DecodeSequencePooled(toparse []byte, limits DecodeLimits) ([]interface{}, error) {
+	return decodeSequence(toparse, limits.withDefaults(), true, 1)
+}
+
+// ReleaseSequence returns the slices of a DecodeSequencePooled result to the pool.
+func ReleaseSequence(seq []interface{}) {
+	for idx, val := range seq {
+		if nested, ok := val.([]interface{}); ok {
+			ReleaseSequence(nested)
+		}
+		seq[idx] = nil
+	}
+	seq = seq[:0]
+	sequencePool.Put(&seq)
+}
+
+// decodeSequence decodes a sequence nested at depth, taking its slice from sequencePool if pooled.
+func decodeSequence(toparse []byte, limits DecodeLimits, pooled bool, depth int) ([]interface{}, error) {
+	if depth > limits.MaxDepth {
+		return nil, fmt.Errorf("nesting too deep, more than %d levels", limits.MaxDepth)
+	}
 	var result []interface{}
+	if pooled {
+		result = *sequencePool.Get().(*[]interface{})
+	}
 
 	if len(toparse) < 2 {
 		return nil, fmt.Errorf("sequence cannot be shorter than 2 bytes")
@@ -216,13 +611,17 @@ func DecodeSequence(toparse []byte) ([]interface{}, error) {
 		return nil, errors.New("failed to parse sequence length" + strconv.Itoa(seqLenLen))
 	}
 
+	if seqLength > limits.MaxLength {
+		return nil, fmt.Errorf("sequence length %v exceeds the limit of %v", seqLength, limits.MaxLength)
+	}
+
 	if seqLength == 0 {
 		return result, nil
 	}
 
 	lidx := 0
 	idx := 1 + seqLenLen
-	if 1+seqLenLen+seqLength > len(toparse) {
+	if seqLength > len(toparse)-1-seqLenLen {
 		return nil, errors.New("sequence does not contain the amount of bytes reported in its length")
 	}
 	toparse = toparse[:(1 + seqLenLen + seqLength)]
@@ -234,6 +633,12 @@ func DecodeSequence(toparse []byte) ([]interface{}, error) {
 		if err != nil {
 			return nil, fmt.Errorf("length parse error @ idx %v", idx)
 		}
+		if berLength > limits.MaxValueLength && BERType(berType)&AsnConstructor == 0 {
+			return nil, fmt.Errorf("value length %v exceeds the limit of %v @ idx %v", berLength, limits.MaxValueLength, idx)
+		}
+		if berLength > len(toparse)-idx-1-berLenLen {
+			return nil, fmt.Errorf("length %v exceeds the sequence @ idx %v", berLength, idx)
+		}
 		berValue := toparse[idx+1+berLenLen : idx+1+berLenLen+berLength]
 		berAll := toparse[idx : idx+1+berLenLen+berLength]
 
@@ -251,6 +656,12 @@ func DecodeSequence(toparse []byte) ([]interface{}, error) {
 			result = append(result, decodedValue)
 		case AsnOctetStr:
 			result = append(result, string(berValue))
+		case AsnConstructor | AsnOctetStr:
+			val, err := decodeConstructedOctetString(berValue, limits.MaxDepth-depth)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, val)
 		case AsnNull:
 			result = append(result, nil)
 		case AsnObjectID:
@@ -260,7 +671,7 @@ func DecodeSequence(toparse []byte) ([]interface{}, error) {
 			}
 			result = append(result, *oid)
 		case Gauge32, Counter32:
-			val, err := DecodeInteger(berValue)
+			val, err := DecodeUnsigned(berValue)
 			if err != nil {
 				return nil, err
 			}
@@ -273,31 +684,40 @@ func DecodeSequence(toparse []byte) ([]interface{}, error) {
 			result = append(result, val)
 
 		case Timeticks:
-			val, err := DecodeInteger(berValue)
+			val, err := DecodeUnsigned(berValue)
 			if err != nil {
 				return nil, err
 			}
-			result = append(result, time.Duration(val)*10*time.Millisecond)
+			// TimeTicks are 32 bits, which an int may not hold without its sign.
+			result = append(result, time.Duration(uint32(val))*10*time.Millisecond)
 		case Ipaddress:
 			val, err := DecodeIPAddress(berValue)
 			if err != nil {
 				return nil, err
 			}
 			result = append(result, val)
+		case BERType(NoSuchObject), BERType(NoSuchInstance), BERType(EndOfMibView):
+			result = append(result, Exception(berType))
 		case Sequence:
-			pdu, err := DecodeSequence(berAll)
+			pdu, err := decodeSequence(berAll, limits, pooled, depth+1)
 			if err != nil {
 				return nil, err
 			}
 			result = append(result, pdu)
-		case AsnGetNextRequest, AsnGetRequest, AsnGetResponse, AsnReport, AsnTrap2, AsnTrap:
-			pdu, err := DecodeSequence(berAll)
+		case AsnGetNextRequest, AsnGetRequest, AsnGetResponse, AsnSetRequest, AsnGetBulkRequest, AsnReport, AsnTrap2, AsnTrap, AsnInform:
+			pdu, err := decodeSequence(berAll, limits, pooled, depth+1)
 			if err != nil {
 				return nil, err
 			}
 			result = append(result, pdu)
 		default:
-			return nil, fmt.Errorf("did not understand type %v", berType)
+			if BERType(berType)&(AsnPrivate|AsnConstructor) != AsnApplication {
+				return nil, fmt.Errorf("did not understand type %v", berType)
+			}
+			// Keep unknown application types raw rather than losing the whole PDU.
+			raw := make([]byte, len(berAll))
+			copy(raw, berAll)
+			result = append(result, UnknownType{Tag: BERType(berType), Bytes: raw})
 		}
 
 		lidx = idx
@@ -327,12 +747,9 @@ func EncodeSequence(toEncode []interface{}) ([]byte, error) {
 			toEncap = append(toEncap, 0)
 		case int:
 			enc := EncodeInteger(val)
-			// TODO encode length ?
 			toEncap = append(toEncap, byte(AsnInteger))
-			toEncap = append(toEncap, byte(len(enc)))
-			for _, b := range enc {
-				toEncap = append(toEncap, b)
-			}
+			toEncap = append(toEncap, EncodeLength(len(enc))...)
+			toEncap = append(toEncap, enc...)
 		case string:
 			enc := []byte(val)
 			toEncap = append(toEncap, byte(AsnOctetStr))
@@ -342,6 +759,46 @@ func EncodeSequence(toEncode []interface{}) ([]byte, error) {
 			for _, b := range enc {
 				toEncap = append(toEncap, b)
 			}
+		case Exception:
+			toEncap = append(toEncap, byte(val), 0)
+		case UnknownType:
+			toEncap = append(toEncap, val.Bytes...)
+		case uint64:
+			enc := EncodeCounter64(val)
+			toEncap = append(toEncap, byte(Counter64))
+			toEncap = append(toEncap, EncodeLength(len(enc))...)
+			toEncap = append(toEncap, enc...)
+		case Unsigned32:
+			enc := EncodeCounter64(uint64(val))
+			toEncap = append(toEncap, byte(Gauge32))
+			toEncap = append(toEncap, EncodeLength(len(enc))...)
+			toEncap = append(toEncap, enc...)
+		case TimeTicks:
+			enc := EncodeCounter64(uint64(val))
+			toEncap = append(toEncap, byte(Timeticks))
+			toEncap = append(toEncap, EncodeLength(len(enc))...)
+			toEncap = append(toEncap, enc...)
+		case Bits:
+			toEncap = append(toEncap, byte(AsnOctetStr))
+			toEncap = append(toEncap, EncodeLength(len(val))...)
+			toEncap = append(toEncap, val...)
+		case IpAddress:
+			enc := net.IP(val).To4()
+			if enc == nil {
+				return nil, fmt.Errorf("IpAddress %v of %d bytes isn't an IPv4 address", net.IP(val), len(val))
+			}
+			toEncap = append(toEncap, byte(Ipaddress))
+			toEncap = append(toEncap, EncodeLength(len(enc))...)
+			toEncap = append(toEncap, enc...)
+		case time.Duration:
+			ticks := val / (10 * time.Millisecond)
+			if ticks < 0 || ticks > math.MaxUint32 {
+				return nil, fmt.Errorf("duration %v is out of the range of TimeTicks, 0 to %d hundredths of a second", val, uint32(math.MaxUint32))
+			}
+			enc := EncodeCounter64(uint64(ticks))
+			toEncap = append(toEncap, byte(Timeticks))
+			toEncap = append(toEncap, EncodeLength(len(enc))...)
+			toEncap = append(toEncap, enc...)
 		case Oid:
 			enc, err := val.Encode()
 			if err != nil {
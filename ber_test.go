@@ -2,8 +2,12 @@ package snmplib
 
 import (
 	"encoding/hex"
+	"math"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 type LengthTest struct {
@@ -41,6 +45,11 @@ func TestDecodeEncodeInteger(t *testing.T) {
 		3:          []byte{0x03},
 		523:        []byte{0x02, 0x0b},
 		1191105458: []byte{0x46, 0xfe, 0xd3, 0xb2},
+		0:          []byte{0x00},
+		-1:         []byte{0xff},
+		-128:       []byte{0x80},
+		-129:       []byte{0xff, 0x7f},
+		-300:       []byte{0xfe, 0xd4},
 	}
 
 	for testValue, testEncode := range tests {
@@ -111,3 +120,373 @@ func TestSequenceDecoding(t *testing.T) {
 		}
 	}
 }
+
+func TestConstructedOctetStringDecoding(t *testing.T) {
+	// "public" split in three fragments, the last one constructed itself.
+	encodedBytes, err := hex.DecodeString("3010240e040370756204026c692403040163")
+	if err != nil {
+		t.Fatalf("Error when decoding hex: %v", err)
+	}
+	result, err := DecodeSequence(encodedBytes)
+	if err != nil {
+		t.Fatalf("Error while decoding %v => %v", hex.EncodeToString(encodedBytes), err)
+	}
+	expected := []interface{}{Sequence, "public"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Not decoded as expected. Encoded : %v\nExpected: %v\nResult  : %v", hex.EncodeToString(encodedBytes), expected, result)
+	}
+}
+
+func TestParseSNMPVersion(t *testing.T) {
+	tests := map[string]SNMPVersion{
+		"1":       SNMPv1,
+		"v1":      SNMPv1,
+		"2c":      SNMPv2c,
+		"V2C":     SNMPv2c,
+		"snmpv2c": SNMPv2c,
+		"3":       SNMPv3,
+		"SNMPv3":  SNMPv3,
+	}
+
+	for toParse, expected := range tests {
+		version, err := ParseSNMPVersion(toParse)
+		if err != nil || version != expected {
+			t.Errorf("ParseSNMPVersion '%s' got (%v, %v), expected %v", toParse, version, err, expected)
+		}
+		if reparsed, err := ParseSNMPVersion(version.String()); err != nil || reparsed != version {
+			t.Errorf("ParseSNMPVersion '%s' got (%v, %v), expected %v", version.String(), reparsed, err, version)
+		}
+	}
+
+	if _, err := ParseSNMPVersion("v4"); err == nil {
+		t.Errorf("ParseSNMPVersion accepted 'v4'")
+	}
+}
+
+func TestBERTypeString(t *testing.T) {
+	for berType, expected := range map[BERType]string{
+		Integer:               "INTEGER",
+		Octetstring:           "OCTET STRING",
+		Null:                  "NULL",
+		UOid:                  "OBJECT IDENTIFIER",
+		Sequence:              "SEQUENCE",
+		Counter32:             "Counter32",
+		Gauge32:               "Gauge32",
+		Timeticks:             "TimeTicks",
+		Counter64:             "Counter64",
+		Ipaddress:             "IpAddress",
+		Opaque:                "Opaque",
+		BERType(EndOfMibView): "endOfMibView",
+		AsnGetRequest:         "GetRequest",
+		AsnGetNextRequest:     "GetNextRequest",
+		AsnGetResponse:        "GetResponse",
+		AsnSetRequest:         "SetRequest",
+		AsnTrap:               "Trap",
+		AsnGetBulkRequest:     "GetBulkRequest",
+		AsnInform:             "InformRequest",
+		AsnTrap2:              "SNMPv2Trap",
+		AsnReport:             "Report",
+		AsnApplication | 0x0f: "BERType(0x4f)",
+	} {
+		if name := berType.String(); name != expected {
+			t.Errorf("BERType 0x%02x is named %q, expected %q", uint8(berType), name, expected)
+		}
+	}
+}
+
+func TestExceptionDecoding(t *testing.T) {
+	// A varbind for .1.3.6.1 holding endOfMibView.
+	encodedBytes, err := hex.DecodeString("3009300706032b06018200")
+	if err != nil {
+		t.Fatalf("Error when decoding hex: %v", err)
+	}
+	result, err := DecodeSequence(encodedBytes)
+	if err != nil {
+		t.Fatalf("Error while decoding %v => %v", hex.EncodeToString(encodedBytes), err)
+	}
+	expected := []interface{}{Sequence, []interface{}{Sequence, Oid{1, 3, 6, 1}, EndOfMibView}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Not decoded as expected. Encoded : %v\nExpected: %v\nResult  : %v", hex.EncodeToString(encodedBytes), expected, result)
+	}
+}
+
+func TestDecodeLimits(t *testing.T) {
+	// An octet string claiming to be 2GB long.
+	encodedBytes, err := hex.DecodeString("3008048480000000ffff")
+	if err != nil {
+		t.Fatalf("Error when decoding hex: %v", err)
+	}
+	if _, err := DecodeSequence(encodedBytes); err == nil {
+		t.Errorf("Decoded a value claiming a huge length")
+	}
+
+	// A 10 bytes octet string, over a 8 bytes limit.
+	encodedBytes, err = hex.DecodeString("300c040a30313233343536373839")
+	if err != nil {
+		t.Fatalf("Error when decoding hex: %v", err)
+	}
+	if _, err := DecodeSequence(encodedBytes); err != nil {
+		t.Errorf("Error while decoding %v => %v", hex.EncodeToString(encodedBytes), err)
+	}
+	if _, err := DecodeSequenceWithLimits(encodedBytes, DecodeLimits{MaxValueLength: 8}); err == nil {
+		t.Errorf("Decoded a value over MaxValueLength")
+	}
+	if _, err := DecodeSequenceWithLimits(encodedBytes, DecodeLimits{MaxLength: 8}); err == nil {
+		t.Errorf("Decoded a sequence over MaxLength")
+	}
+}
+
+// nest wraps value in levels TLVs of type berType.
+func nest(berType BERType, levels int, value []byte) []byte {
+	for ; levels > 0; levels-- {
+		value = append(append([]byte{byte(berType)}, EncodeLength(len(value))...), value...)
+	}
+	return value
+}
+
+func TestDecodeDepth(t *testing.T) {
+	// Thousands of nested sequences fail cleanly.
+	null := []byte{byte(AsnNull), 0}
+	if _, err := DecodeSequence(nest(Sequence, 5000, null)); err == nil || !strings.Contains(err.Error(), "nesting too deep") {
+		t.Errorf("Decoding 5000 nested sequences returned %v, expected nesting too deep", err)
+	}
+	if _, err := DecodeSequence(nest(Sequence, defaultMaxDecodeDepth, null)); err != nil {
+		t.Errorf("Error decoding %d nested sequences: %v", defaultMaxDecodeDepth, err)
+	}
+	if _, err := DecodeSequence(nest(Sequence, defaultMaxDecodeDepth+1, null)); err == nil {
+		t.Errorf("Decoded %d nested sequences", defaultMaxDecodeDepth+1)
+	}
+	if _, err := DecodeSequenceWithLimits(nest(Sequence, 4, null), DecodeLimits{MaxDepth: 3}); err == nil {
+		t.Errorf("Decoded 4 nested sequences over a MaxDepth of 3")
+	}
+
+	// As do constructed octet strings, in a sequence or not.
+	octetStr := nest(AsnConstructor|AsnOctetStr, 5000, []byte{byte(AsnOctetStr), 1, 'a'})
+	if _, err := DecodeSequence(nest(Sequence, 1, octetStr)); err == nil {
+		t.Errorf("Decoded 5000 nested constructed octet strings")
+	}
+	_, lenLen, _ := DecodeLength(octetStr[1:])
+	if _, err := DecodeConstructedOctetString(octetStr[1+lenLen:]); err == nil {
+		t.Errorf("DecodeConstructedOctetString decoded 5000 nested constructed octet strings")
+	}
+	decoded, err := DecodeSequence(nest(Sequence, 1, nest(AsnConstructor|AsnOctetStr, 3, []byte{byte(AsnOctetStr), 1, 'a'})))
+	if err != nil || decoded[1] != "a" {
+		t.Errorf("Decoded 3 nested constructed octet strings as %v, %v", decoded, err)
+	}
+}
+
+func TestUnknownTypeDecoding(t *testing.T) {
+	// An integer followed by an application type 0x4f nobody defined.
+	encodedBytes, err := hex.DecodeString("300702012a4f02abcd")
+	if err != nil {
+		t.Fatalf("Error when decoding hex: %v", err)
+	}
+	result, err := DecodeSequence(encodedBytes)
+	if err != nil {
+		t.Fatalf("Error while decoding %v => %v", hex.EncodeToString(encodedBytes), err)
+	}
+	expected := []interface{}{Sequence, 42, UnknownType{Tag: 0x4f, Bytes: []byte{0x4f, 0x02, 0xab, 0xcd}}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Not decoded as expected. Encoded : %v\nExpected: %v\nResult  : %v", hex.EncodeToString(encodedBytes), expected, result)
+	}
+
+	// It's encoded back as it was.
+	reencoded, err := EncodeSequence(result)
+	if err != nil || !reflect.DeepEqual(reencoded, encodedBytes) {
+		t.Errorf("Encoded back as %v, %v", hex.EncodeToString(reencoded), err)
+	}
+}
+
+func TestTypedValueEncoding(t *testing.T) {
+	for _, test := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{100, "3003020164"},
+		{Unsigned32(100), "3003420164"},
+		{Unsigned32(4294967295), "3007420500ffffffff"},
+		{TimeTicks(500), "3004430201f4"},
+		{IpAddress(net.ParseIP("192.168.1.10")), "30064004c0a8010a"},
+		{"abc", "30050403616263"},
+		{Bits{0xa0, 0x01}, "30040402a001"},
+		{TimeTicks(4294967295), "3007430500ffffffff"},
+		{time.Duration(4294967295) * 10 * time.Millisecond, "3007430500ffffffff"},
+		{uint64(18446744073709551615), "300b460900ffffffffffffffff"},
+	} {
+		encoded, err := EncodeSequence([]interface{}{Sequence, test.value})
+		if err != nil || hex.EncodeToString(encoded) != test.expected {
+			t.Errorf("%T(%v) encoded as %v, %v, expected %v", test.value, test.value, hex.EncodeToString(encoded), err, test.expected)
+		}
+	}
+
+	if _, err := EncodeSequence([]interface{}{Sequence, IpAddress(net.ParseIP("2001:db8::1"))}); err == nil {
+		t.Errorf("Encoded an IPv6 IpAddress")
+	}
+
+	// Just out of range, the Go types of the other wrappers can't be.
+	for _, value := range []interface{}{
+		time.Duration(4294967296) * 10 * time.Millisecond,
+		-10 * time.Millisecond,
+		IpAddress{192, 168, 1, 10, 1},
+		IpAddress{192, 168, 1},
+	} {
+		if encoded, err := EncodeSequence([]interface{}{Sequence, value}); err == nil {
+			t.Errorf("%T(%v) out of range encoded as %x", value, value, encoded)
+		}
+	}
+}
+
+func TestSignedIntegerSequence(t *testing.T) {
+	// INTEGER -300, then Gauge32 and TimeTicks values with their first bit set, which aren't signed.
+	encodedBytes, err := hex.DecodeString("30110202fed4420500ffffffff430480000000")
+	if err != nil {
+		t.Fatalf("Error when decoding hex: %v", err)
+	}
+	result, err := DecodeSequence(encodedBytes)
+	if err != nil {
+		t.Fatalf("Error while decoding %v => %v", hex.EncodeToString(encodedBytes), err)
+	}
+	maxGauge := uint64(math.MaxUint32)
+	expected := []interface{}{Sequence, -300, int(maxGauge), time.Duration(0x80000000) * 10 * time.Millisecond}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Not decoded as expected. Encoded : %v\nExpected: %v\nResult  : %v", hex.EncodeToString(encodedBytes), expected, result)
+	}
+
+	for _, value := range []int{-1, -128, -300} {
+		encoded, err := EncodeSequence([]interface{}{Sequence, value})
+		if err != nil {
+			t.Fatalf("Error encoding %d: %v", value, err)
+		}
+		decoded, err := DecodeSequence(encoded)
+		if err != nil || !reflect.DeepEqual(decoded, []interface{}{Sequence, value}) {
+			t.Errorf("%d round-tripped as %v, %v", value, decoded, err)
+		}
+	}
+}
+
+func TestMinimalIntegerEncoding(t *testing.T) {
+	tests := map[int]string{
+		127:    "7f",
+		128:    "0080",
+		255:    "00ff",
+		256:    "0100",
+		32767:  "7fff",
+		32768:  "008000",
+		-32768: "8000",
+		-32769: "ff7fff",
+	}
+	for value, expected := range tests {
+		if encoded := hex.EncodeToString(EncodeInteger(value)); encoded != expected {
+			t.Errorf("%d encoded as %v, expected %v", value, encoded, expected)
+		}
+	}
+
+	// The request-id and error fields of a PDU are INTEGERs as well.
+	encoded, err := EncodeSequence([]interface{}{AsnGetRequest, 128, 0, 255, []interface{}{Sequence}})
+	if err != nil {
+		t.Fatalf("Error encoding PDU: %v", err)
+	}
+	if expected := "a00d02020080020100020200ff3000"; hex.EncodeToString(encoded) != expected {
+		t.Errorf("PDU encoded as %v, expected %v", hex.EncodeToString(encoded), expected)
+	}
+}
+
+func TestCounter64Encoding(t *testing.T) {
+	tests := map[uint64]string{
+		0:                  "00",
+		255:                "00ff",
+		0x7fffffffffffffff: "7fffffffffffffff",
+		0x8000000000000000: "008000000000000000",
+		0xffffffffffffffff: "00ffffffffffffffff",
+		0x0000000100000000: "0100000000",
+	}
+	for value, expected := range tests {
+		encoded := EncodeCounter64(value)
+		if hex.EncodeToString(encoded) != expected {
+			t.Errorf("%d encoded as %x, expected %v", value, encoded, expected)
+		}
+		decoded, err := DecodeCounter64(encoded)
+		if err != nil || decoded != value {
+			t.Errorf("%x decoded as %d, %v, expected %d", encoded, decoded, err, value)
+		}
+	}
+}
+
+// v1LinkDownTrap is a linkDown of ifIndex 2 from net-snmp.
+const v1LinkDownTrap = "303e02010004067075626c6963a431060a2b06010401bf0803020a4004c0a8010102010202010043040001e2403011300f060a2b060102010202010102020102"
+
+func TestDecodeSequencePooled(t *testing.T) {
+	packet, _ := hex.DecodeString(v1LinkDownTrap)
+	expected, err := DecodeSequence(packet)
+	if err != nil {
+		t.Fatalf("Error decoding: %v", err)
+	}
+	// The second round reuses the slices released by the first.
+	for i := 0; i < 2; i++ {
+		result, err := DecodeSequencePooled(packet, DecodeLimits{})
+		if err != nil {
+			t.Fatalf("Error decoding pooled: %v", err)
+		}
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("Pooled decoding is %v, expected %v", result, expected)
+		}
+		ReleaseSequence(result)
+	}
+	if _, err := DecodeSequencePooled(packet, DecodeLimits{MaxLength: 16}); err == nil {
+		t.Errorf("Pooled decoding ignored the limits")
+	}
+}
+
+func BenchmarkDecodeSequence(b *testing.B) {
+	packet, _ := hex.DecodeString(v1LinkDownTrap)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodeSequence(packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeSequencePooled(b *testing.B) {
+	packet, _ := hex.DecodeString(v1LinkDownTrap)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		result, err := DecodeSequencePooled(packet, DecodeLimits{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		ReleaseSequence(result)
+	}
+}
+
+func TestDecodeBits(t *testing.T) {
+	// dot1qVlanCurrentEgressPorts of a VLAN on ports 1, 3 and 16 of a 24 ports switch: port n is bit n-1.
+	response := encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{MustParseOid("1.3.6.1.2.1.17.7.1.4.2.1.4.0.10"), "\xa0\x01\x00"})
+	packet, err := hex.DecodeString(response)
+	if err != nil {
+		t.Fatalf("Error decoding hex: %v", err)
+	}
+	msg, err := DecodeMessage(packet)
+	if err != nil {
+		t.Fatalf("Error decoding response: %v", err)
+	}
+	bits, err := DecodeBits(msg.PDU.VarBinds[0].Value)
+	if err != nil {
+		t.Fatalf("Error decoding BITS: %v", err)
+	}
+	var ports []int
+	for _, n := range bits.Positions() {
+		ports = append(ports, n+1)
+	}
+	if !reflect.DeepEqual(ports, []int{1, 3, 16}) {
+		t.Errorf("VLAN ports are %v, expected [1 3 16]", ports)
+	}
+	if !bits.Set(0) || bits.Set(1) || bits.Set(24) || bits.Set(-1) {
+		t.Errorf("Set is wrong for %x", []byte(bits))
+	}
+
+	if _, err := DecodeBits(42); err == nil {
+		t.Errorf("Decoded an INTEGER as BITS")
+	}
+}
@@ -0,0 +1,68 @@
+package snmplib
+
+// RepetitionGrowth makes GetTable converge on the best repetitions for the agent: after each full response,
+// the next GETBULK request asks for Factor times as many repetitions, but no more than the responses are
+// expected to fit in MaxMessageSize, and after a tooBig for Factor times fewer, within Min and Max.
+// GetTableAdaptive uses the default one.
+type RepetitionGrowth struct {
+	Min    int     // Fewest repetitions, 0 for 1.
+	Max    int     // Most repetitions, 0 for no bound but MaxMessageSize.
+	Factor float64 // Factor the repetitions grow and shrink by, 0 for 2.
+
+	// Repetitions are the repetitions the last table walk settled on, which the next one starts from. Zero
+	// starts from the repetitions GetTable is called with.
+	Repetitions int
+}
+
+// factor returns Factor, or its default.
+func (g *RepetitionGrowth) factor() float64 {
+	if g.Factor <= 1 {
+		return 2
+	}
+	return g.Factor
+}
+
+// min returns Min, or its default.
+func (g *RepetitionGrowth) min() int {
+	if g.Min < 1 {
+		return 1
+	}
+	return g.Min
+}
+
+// clamp bounds repetitions within Min and Max.
+func (g *RepetitionGrowth) clamp(repetitions int) int {
+	if g.Max > 0 && repetitions > g.Max {
+		repetitions = g.Max
+	}
+	if repetitions < g.min() {
+		repetitions = g.min()
+	}
+	return repetitions
+}
+
+// grow returns the repetitions following a request with maxRep repetitions, answered with varbinds whose
+// encoding takes size bytes, when the response can take budget bytes.
+func (g *RepetitionGrowth) grow(maxRep, size int, varbinds []VarBind, budget int) int {
+	// Fewer varbinds than asked for is the end of the table, or a response the agent already truncated.
+	if len(varbinds) < maxRep || size == 0 {
+		return maxRep
+	}
+	grown := int(float64(maxRep) * g.factor())
+	if grown == maxRep {
+		grown++
+	}
+	if fit := budget * len(varbinds) / size; grown > fit {
+		grown = fit
+	}
+	return g.clamp(grown)
+}
+
+// shrink returns the repetitions following a request with maxRep repetitions answered with tooBig.
+func (g *RepetitionGrowth) shrink(maxRep int) int {
+	shrunk := int(float64(maxRep) / g.factor())
+	if shrunk >= maxRep {
+		shrunk = maxRep - 1
+	}
+	return g.clamp(shrunk)
+}
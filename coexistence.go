@@ -0,0 +1,23 @@
+package snmplib
+
+/* SNMP v1/v2c and v3 coexistence.
+
+   References : RFC 3584
+*/
+
+import "strings"
+
+// CommunityToContext returns the SNMP V3 context name a v1/v2c community maps to, so V3 requests
+// (through SNMP.ContextName) reach the same data as requests with that community.
+//
+// RFC 3584 leaves the mapping to each agent's snmpCommunityTable, which can't be read without
+// already having access, so this follows the default configuration and the common community string
+// indexing convention instead: "community@context" maps to "context", any other community to the
+// default context "". Agents configured otherwise need their context name set directly.
+func CommunityToContext(community string) string {
+	idx := strings.LastIndex(community, "@")
+	if idx < 0 {
+		return ""
+	}
+	return community[idx+1:]
+}
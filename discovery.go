@@ -0,0 +1,85 @@
+package snmplib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// DiscoverResult is the answer of one agent to DiscoverAgents.
+type DiscoverResult struct {
+	Addr  net.Addr // Address the response came from.
+	Value interface{}
+}
+
+// DiscoverAgents finds the v2c agents of an IPv4 subnet: it sends a GET of oid, e.g. sysObjectID.0, to
+// the broadcast address of subnet and gathers the responses of all the agents answering until timeout.
+// Agents that don't know the community don't answer, so they aren't found.
+//
+// Unlike the requests of an SNMP object, it uses an unconnected socket, which receives from any address.
+// There's no SNMP object whose Rand it could use either, the request ID is drawn from crypto/rand.
+func DiscoverAgents(subnet net.IPNet, community string, oid Oid, timeout time.Duration) ([]DiscoverResult, error) {
+	broadcast, err := broadcastAddr(subnet)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("error listening for responses: %v", err)
+	}
+	defer conn.Close()
+	return discoverAgents(conn, &net.UDPAddr{IP: broadcast, Port: 161}, community, oid, timeout, cryptoSource{})
+}
+
+// broadcastAddr returns the broadcast address of an IPv4 subnet.
+func broadcastAddr(subnet net.IPNet) (net.IP, error) {
+	ip := subnet.IP.To4()
+	if ip == nil || len(subnet.Mask) != net.IPv4len {
+		return nil, fmt.Errorf("Invalid subnet %v, needs an IPv4 subnet", subnet.String())
+	}
+	broadcast := make(net.IP, net.IPv4len)
+	for idx := range ip {
+		broadcast[idx] = ip[idx] | ^subnet.Mask[idx]
+	}
+	return broadcast, nil
+}
+
+// discoverAgents sends the GET to dst on conn, with a request ID drawn from r, and gathers the responses
+// until timeout.
+func discoverAgents(conn net.PacketConn, dst net.Addr, community string, oid Oid, timeout time.Duration, r RandSource) ([]DiscoverResult, error) {
+	requestID := randomRequestID(r)
+	req, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), community,
+		[]interface{}{AsnGetRequest, requestID, 0, 0,
+			[]interface{}{Sequence,
+				[]interface{}{Sequence, oid, nil}}}})
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.WriteTo(req, dst); err != nil {
+		return nil, fmt.Errorf("error sending to %v: %v", dst, err)
+	}
+
+	var result []DiscoverResult
+	response := make([]byte, bufSize)
+	for {
+		numRead, addr, err := conn.ReadFrom(response)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return result, nil
+			}
+			return result, err
+		}
+		msg, err := DecodeMessage(response[:numRead])
+		if err != nil || !requestIDsMatch(requestID, msg.PDU.RequestID) || len(msg.PDU.VarBinds) == 0 {
+			log.Printf("Error: Dropping unexpected packet from %v: %v", addr, err)
+			continue
+		}
+		result = append(result, DiscoverResult{Addr: addr, Value: msg.PDU.VarBinds[0].Value})
+	}
+}
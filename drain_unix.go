@@ -0,0 +1,41 @@
+//go:build !windows
+
+package snmplib
+
+import (
+	"net"
+	"syscall"
+)
+
+// drainSocket discards the datagrams queued on conn without waiting for more, and returns how many there
+// were. Connections that aren't sockets, e.g. test stubs, have nothing to drain.
+func drainSocket(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	// The runtime keeps sockets non-blocking, reads fail with EAGAIN once the queue is empty. A datagram
+	// is consumed whole even when it doesn't fit the buffer.
+	var discarded int
+	var readErr error
+	buf := make([]byte, 1)
+	err = raw.Read(func(fd uintptr) bool {
+		for {
+			if _, err := syscall.Read(int(fd), buf); err != nil {
+				if err != syscall.EAGAIN && err != syscall.EWOULDBLOCK && err != syscall.ECONNREFUSED {
+					readErr = err
+				}
+				return true
+			}
+			discarded++
+		}
+	})
+	if err != nil {
+		return discarded, err
+	}
+	return discarded, readErr
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package snmplib
+
+import (
+	"net"
+)
+
+// drainSocket is a no-op on Windows, stale datagrams stay queued.
+func drainSocket(conn net.Conn) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,111 @@
+package snmplib
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Engine ID lengths allowed by RFC 3411's SnmpEngineID.
+const (
+	minEngineIDLen int = 5
+	maxEngineIDLen int = 32
+)
+
+// engineIDFormatOctets is the RFC 3411 format for administratively assigned octets.
+const engineIDFormatOctets byte = 5
+
+// GenerateEngineID generates an RFC 3411 engine ID for this library to act as an authoritative engine, e.g.
+// when originating v3 notifications. It holds the enterprise number with its top bit set, the octets format
+// and 8 random octets. enterpriseNumber is an IANA private enterprise number, which fits in 31 bits.
+//
+// The identifier is random, so store the result to keep the same engine ID across restarts: receivers
+// localize keys for a given engine ID.
+func GenerateEngineID(enterpriseNumber uint32) string {
+	engineID := make([]byte, 13)
+	binary.BigEndian.PutUint32(engineID, enterpriseNumber|0x80000000)
+	engineID[4] = engineIDFormatOctets
+	if _, err := rand.Read(engineID[5:]); err != nil {
+		panic(err)
+	}
+	return string(engineID)
+}
+
+// ValidateEngineID checks an engine ID has the 5 to 32 octets RFC 3411 requires.
+func ValidateEngineID(engineID string) error {
+	if len(engineID) < minEngineIDLen || len(engineID) > maxEngineIDLen {
+		return fmt.Errorf("Invalid engine ID, needs %d to %d octets, has %d", minEngineIDLen, maxEngineIDLen, len(engineID))
+	}
+	return nil
+}
+
+// ParseEngineID parses an engine ID written in hex the way operators configure them: octets separated by
+// colons or spaces, as in "80:00:1f:88:80", or contiguous, with an optional 0x prefix, as in "0x80001f8880".
+// It returns the raw octets.
+func ParseEngineID(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X") {
+		s = s[2:]
+	}
+
+	var octets []byte
+	if strings.ContainsAny(s, ": ") {
+		for _, field := range strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == ' ' }) {
+			if len(field) > 2 {
+				return "", fmt.Errorf("Invalid engine ID %q, octet %q is too long", s, field)
+			}
+			octet, err := hex.DecodeString(fmt.Sprintf("%02s", field))
+			if err != nil {
+				return "", fmt.Errorf("Invalid engine ID %q: %v", s, err)
+			}
+			octets = append(octets, octet...)
+		}
+	} else {
+		var err error
+		if octets, err = hex.DecodeString(s); err != nil {
+			return "", fmt.Errorf("Invalid engine ID %q: %v", s, err)
+		}
+	}
+
+	if err := ValidateEngineID(string(octets)); err != nil {
+		return "", err
+	}
+	return string(octets), nil
+}
+
+// FormatEngineID formats raw engine ID octets for display, as in "80:00:1f:88:80". ParseEngineID parses
+// it back.
+func FormatEngineID(engineID string) string {
+	octets := make([]string, len(engineID))
+	for idx := 0; idx < len(engineID); idx++ {
+		octets[idx] = fmt.Sprintf("%02x", engineID[idx])
+	}
+	return strings.Join(octets, ":")
+}
+
+// SetEngineID seeds the cached engine ID of an SNMPv3 object with one written in hex, see ParseEngineID,
+// and localizes the keys for it, so requests can go out without Discover. The engine boots and time are
+// unknown, the agent answers the first request with a notInTimeWindows report updating them and the
+// request is sent again, see ReportRetries.
+func (w *SNMP) SetEngineID(engineID string) error {
+	raw, err := ParseEngineID(engineID)
+	if err != nil {
+		return err
+	}
+	authKey, err := passwordToKey(w.authPwd, raw, w.authAlg)
+	if err != nil {
+		return fmt.Errorf("auth key: %v", err)
+	}
+	privKey, err := privPasswordToKey(w.privPwd, raw, w.authAlg, w.privAlg)
+	if err != nil {
+		return fmt.Errorf("priv key: %v", err)
+	}
+
+	defer w.lock()()
+	w.engineID = raw
+	w.authKey = authKey
+	w.privKey = privKey
+	return nil
+}
@@ -0,0 +1,172 @@
+package snmplib
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoResponse matches, with errors.Is, the errors returned when the agent didn't answer after all retries,
+// whatever the connection reported: timeouts, refused connections, ...
+var ErrNoResponse = errors.New("no response from agent")
+
+// NoResponseError is returned when all the attempts to send a request and read its response failed.
+type NoResponseError struct {
+	Target   string // Address of the agent.
+	Attempts int
+	Err      error // Last error, a *TimeoutError if the last attempt timed out.
+}
+
+func (e *NoResponseError) Error() string {
+	return fmt.Sprintf("no response from %s after %d attempts: %v", e.Target, e.Attempts, e.Err)
+}
+
+// Is makes errors.Is(err, ErrNoResponse) true.
+func (e *NoResponseError) Is(target error) bool {
+	return target == ErrNoResponse
+}
+
+// Unwrap returns the last error.
+func (e *NoResponseError) Unwrap() error {
+	return e.Err
+}
+
+// ErrTableTooLarge matches, with errors.Is, the error returned when a table or a walk has more entries than
+// SNMP.MaxTableEntries. The entries gathered until then are returned along with it.
+var ErrTableTooLarge = errors.New("table too large")
+
+// ErrResponseTruncated matches, with errors.Is, the error returned when a response didn't fit in the buffer
+// it was read in, see SNMP.ResponseBufferSize.
+var ErrResponseTruncated = errors.New("response truncated")
+
+// TimeoutError is wrapped in the NoResponseError returned when the last attempt timed out. It's worth
+// trying again later.
+type TimeoutError struct {
+	Err error // Last error returned by the connection.
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("no response from agent: %v", e.Err)
+}
+
+// Timeout is always true, so TimeoutError satisfies net.Error's Timeout.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Unwrap returns the connection error.
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Names of the error-status values of a response PDU, from RFC 3416.
+var errorStatusNames = []string{
+	"noError",
+	"tooBig",
+	"noSuchName",
+	"badValue",
+	"readOnly",
+	"genErr",
+	"noAccess",
+	"wrongType",
+	"wrongLength",
+	"wrongEncoding",
+	"wrongValue",
+	"noCreation",
+	"inconsistentValue",
+	"resourceUnavailable",
+	"commitFailed",
+	"undoFailed",
+	"authorizationError",
+	"notWritable",
+	"inconsistentName",
+}
+
+// PDUError is returned when the agent answered with a non zero error-status. Asking again won't help.
+type PDUError struct {
+	ErrorStatus int
+	ErrorIndex  int // 1-based index of the varbind that caused the error, 0 if none.
+}
+
+func (e *PDUError) Error() string {
+	name := "unknown"
+	if e.ErrorStatus >= 0 && e.ErrorStatus < len(errorStatusNames) {
+		name = errorStatusNames[e.ErrorStatus]
+	}
+	return fmt.Sprintf("agent returned error-status %s(%d) at index %d", name, e.ErrorStatus, e.ErrorIndex)
+}
+
+// DecodeError is returned when a response couldn't be decoded, usually an interoperability problem.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("could not decode response: %v", e.Err)
+}
+
+// Unwrap returns the decoding error.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// checkErrorStatus returns a PDUError if the response PDU reports an error.
+func checkErrorStatus(pdu []interface{}) error {
+	if len(pdu) < 4 {
+		return &DecodeError{fmt.Errorf("invalid response PDU length %d", len(pdu))}
+	}
+	errorStatus, _ := pdu[2].(int)
+	errorIndex, _ := pdu[3].(int)
+	if errorStatus != 0 {
+		return &PDUError{ErrorStatus: errorStatus, ErrorIndex: errorIndex}
+	}
+	return nil
+}
+
+// Names of the usmStats counters agents send in report PDUs, from RFC 3414.
+var usmStatsNames = map[string]string{
+	".1.3.6.1.6.3.15.1.1.1.0": "unsupportedSecLevels",
+	".1.3.6.1.6.3.15.1.1.2.0": "notInTimeWindows",
+	".1.3.6.1.6.3.15.1.1.3.0": "unknownUserNames",
+	".1.3.6.1.6.3.15.1.1.4.0": "unknownEngineIDs",
+	".1.3.6.1.6.3.15.1.1.5.0": "wrongDigests",
+	".1.3.6.1.6.3.15.1.1.6.0": "decryptionErrors",
+}
+
+// usmStatsNotInTimeWindows is the counter agents report requests outside their time window with.
+var usmStatsNotInTimeWindows = Oid{1, 3, 6, 1, 6, 3, 15, 1, 1, 2, 0}
+
+// usmStatsUnknownEngineIDs is the counter agents report requests for another engine ID with.
+var usmStatsUnknownEngineIDs = Oid{1, 3, 6, 1, 6, 3, 15, 1, 1, 4, 0}
+
+// ReportError is returned when an SNMP v3 agent answered with a report PDU instead of a response.
+type ReportError struct {
+	Oid   Oid // The counter the agent reported, usually one of the usmStats.
+	Value interface{}
+}
+
+func (e *ReportError) Error() string {
+	name, ok := usmStatsNames[e.Oid.String()]
+	if !ok {
+		name = e.Oid.String()
+	}
+	return fmt.Sprintf("agent sent report %s = %v", name, e.Value)
+}
+
+// checkReport returns a ReportError if the decoded scoped PDU is a report.
+func checkReport(scopedPDU []interface{}) error {
+	if len(scopedPDU) < 4 {
+		return nil
+	}
+	pdu, ok := scopedPDU[3].([]interface{})
+	if !ok || len(pdu) < 5 || pdu[0] != AsnReport {
+		return nil
+	}
+	report := &ReportError{}
+	if varbinds, ok := pdu[4].([]interface{}); ok && len(varbinds) > 1 {
+		if varbind, ok := varbinds[1].([]interface{}); ok && len(varbind) > 2 {
+			report.Oid, _ = varbind[1].(Oid)
+			report.Value = varbind[2]
+		}
+	}
+	return report
+}
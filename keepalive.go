@@ -0,0 +1,95 @@
+package snmplib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// sysUpTime is the object Ping and the v1/v2c keepalive ask for by default, most agents have it.
+var sysUpTime = Oid{1, 3, 6, 1, 2, 1, 1, 3, 0}
+
+// keepAlive is a running keepalive goroutine.
+type keepAlive struct {
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// stopAndWait stops the goroutine and waits for it to exit. It can be called several times.
+func (k *keepAlive) stopAndWait() {
+	k.once.Do(func() { close(k.stop) })
+	<-k.done
+}
+
+// StartKeepAlive starts a goroutine sending a request every KeepAlive, until Close is called. It keeps the
+// NAT mappings of long-lived pollers fresh and notices unreachable agents before the next real request.
+// The request gets ProbeOid, authenticated for SNMPv3 objects, which discover the agent again when it fails.
+// Failures are logged.
+//
+// The keepalive requests are serialized with the other requests on the object, so it must not be copied
+// while the keepalive runs.
+func (w *SNMP) StartKeepAlive() error {
+	if w.KeepAlive <= 0 {
+		return fmt.Errorf("invalid keepalive interval %v", w.KeepAlive)
+	}
+	if w.keepAlive != nil {
+		return errors.New("keepalive already started")
+	}
+	w.keepAlive = &keepAlive{stop: make(chan struct{}), done: make(chan struct{})}
+	go w.runKeepAlive(w.keepAlive, w.KeepAlive)
+	return nil
+}
+
+func (w *SNMP) runKeepAlive(k *keepAlive, interval time.Duration) {
+	defer close(k.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+		}
+
+		var err error
+		if w.Version == SNMPv3 {
+			if _, _, err = w.doGetV3(w.probeOid(), AsnGetRequest); err != nil {
+				// The agent may have been replaced, or have rebooted with another engine.
+				log.Printf("Error: keepalive to %s failed: %v. Discovering again", w.Target, err)
+				err = w.ForceDiscover()
+			}
+		} else {
+			_, err = w.Get(w.probeOid())
+		}
+		if err != nil {
+			log.Printf("Error: keepalive to %s failed: %v", w.Target, err)
+		}
+	}
+}
+
+// probeOid returns the object health checks get.
+func (w SNMP) probeOid() Oid {
+	if w.ProbeOid == nil {
+		return sysUpTime
+	}
+	return w.ProbeOid
+}
+
+// Ping gets ProbeOid, sysUpTime.0 by default, and returns the time the agent took to answer. Any answer
+// counts, even an exception because the agent doesn't have the object, but an error status doesn't.
+func (w *SNMP) Ping() (time.Duration, error) {
+	start := time.Now()
+	var err error
+	if w.Version == SNMPv3 {
+		_, err = w.GetV3(w.probeOid())
+	} else {
+		_, err = w.Get(w.probeOid())
+	}
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
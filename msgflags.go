@@ -0,0 +1,89 @@
+package snmplib
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MsgFlags is the msgFlags field of an SNMPv3 message, telling its security level and whether the
+// receiver may answer with a report, from RFC 3412.
+type MsgFlags byte
+
+// The bits of MsgFlags.
+const (
+	FlagAuth       MsgFlags = 0x01
+	FlagPriv       MsgFlags = 0x02
+	FlagReportable MsgFlags = 0x04
+)
+
+// Auth tells whether the message is authenticated.
+func (f MsgFlags) Auth() bool {
+	return f&FlagAuth != 0
+}
+
+// Priv tells whether the scoped PDU of the message is encrypted.
+func (f MsgFlags) Priv() bool {
+	return f&FlagPriv != 0
+}
+
+// Reportable tells whether the receiver may answer the message with a report.
+func (f MsgFlags) Reportable() bool {
+	return f&FlagReportable != 0
+}
+
+// String returns the security level, as net-snmp names it, followed by ",reportable" if the flag is set.
+func (f MsgFlags) String() string {
+	level := "noAuthNoPriv"
+	switch {
+	case f.Auth() && f.Priv():
+		level = "authPriv"
+	case f.Auth():
+		level = "authNoPriv"
+	case f.Priv():
+		level = "noAuthPriv"
+	}
+	if f.Reportable() {
+		level += ",reportable"
+	}
+	return level
+}
+
+// atLeast tells whether the security level of f is at least the one of required: every protection
+// required is there.
+func (f MsgFlags) atLeast(required MsgFlags) bool {
+	return (!required.Auth() || f.Auth()) && (!required.Priv() || f.Priv())
+}
+
+// encode returns the flags as the OCTET STRING put in messages.
+func (f MsgFlags) encode() string {
+	return string([]byte{byte(f)})
+}
+
+// ParseMsgFlags decodes the msgFlags OCTET STRING of a message. Privacy without authentication is
+// invalid, as are flags that aren't a single byte.
+func ParseMsgFlags(flags string) (MsgFlags, error) {
+	if len(flags) != 1 {
+		return 0, fmt.Errorf("msgFlags is %d bytes long, expected 1", len(flags))
+	}
+	f := MsgFlags(flags[0])
+	if f.Priv() && !f.Auth() {
+		return f, errors.New("msgFlags asks for privacy without authentication")
+	}
+	return f, nil
+}
+
+// msgFlagsOf returns the flags of a decoded SNMPv3 message.
+func msgFlagsOf(decoded []interface{}) (MsgFlags, error) {
+	if len(decoded) < 3 {
+		return 0, errors.New("invalid v3 message, no global data")
+	}
+	globalData, ok := decoded[2].([]interface{})
+	if !ok || len(globalData) < 5 {
+		return 0, fmt.Errorf("invalid v3 global data %v", decoded[2])
+	}
+	flags, ok := globalData[3].(string)
+	if !ok {
+		return 0, fmt.Errorf("invalid msgFlags %v", globalData[3])
+	}
+	return ParseMsgFlags(flags)
+}
@@ -9,11 +9,26 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"net"
 	"strconv"
 	"strings"
 )
 
+// maxOidLen is the most sub-identifiers an SNMP oid can have, and maxSubID the largest sub-identifier,
+// from RFC 2578.
+const (
+	maxOidLen = 128
+	maxSubID  = math.MaxUint32
+)
+
 // The SNMP object identifier type.
+//
+// Oid is a slice, so it can't be compared with == or used as a map key
+// directly. Use Equal to compare two oids and String() as a map key, the
+// canonical form is stable for a given oid.
+//
+// Sub-identifiers are unsigned 32 bits values. Where int is 32 bits long, those above math.MaxInt32
+// don't fit in an Oid, parsing or decoding them fails.
 type Oid []int
 
 // String returns the string representation for this oid object.
@@ -40,6 +55,8 @@ func MustParseOid(o string) Oid {
 }
 
 // ParseOid a text format oid into an Oid instance.
+//
+// The leading dot is optional, and a leading "iso", as some tools print oids, is read as 1.
 func ParseOid(oid string) (Oid, error) {
 	// Special case "." = [], "" = []
 	if oid == "." || oid == "" {
@@ -49,19 +66,45 @@ func ParseOid(oid string) (Oid, error) {
 		oid = oid[1:]
 	}
 	oidParts := strings.Split(oid, ".")
+	if len(oidParts) > maxOidLen {
+		return nil, fmt.Errorf("oid has %d sub-identifiers, more than the maximum of %d", len(oidParts), maxOidLen)
+	}
+	if oidParts[0] == "iso" {
+		oidParts[0] = "1"
+	}
 	res := make([]int, len(oidParts))
 	for idx, val := range oidParts {
-		parsedVal, err := strconv.Atoi(val)
+		if val == "" {
+			return nil, fmt.Errorf("oid %q has an empty sub-identifier @ idx %d", oid, idx)
+		}
+		// Sub-identifiers are unsigned 32 bits values.
+		parsedVal, err := strconv.ParseUint(val, 10, 32)
 		if err != nil {
-			return nil, err
+			if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange {
+				return nil, fmt.Errorf("oid %q sub-identifier %s @ idx %d is larger than %d", oid, val, idx, uint32(maxSubID))
+			}
+			return nil, fmt.Errorf("oid %q sub-identifier %q @ idx %d isn't a number", oid, val, idx)
 		}
-		res[idx] = parsedVal
+		if parsedVal > math.MaxInt {
+			return nil, fmt.Errorf("oid %q sub-identifier %s @ idx %d doesn't fit in an int", oid, val, idx)
+		}
+		res[idx] = int(parsedVal)
 	}
 	result := Oid(res)
 
 	return result, nil
 }
 
+// NormalizeOid returns the canonical form of a text format oid, as Oid.String gives it, e.g.
+// ".1.3.6.1" for "1.3.6.1" or "iso.3.6.1", so oids from different tools can be compared as strings.
+func NormalizeOid(oid string) (string, error) {
+	parsed, err := ParseOid(oid)
+	if err != nil {
+		return "", err
+	}
+	return parsed.String(), nil
+}
+
 // DecodeOid decodes a ASN.1 BER raw oid into an Oid instance.
 func DecodeOid(raw []byte) (*Oid, error) {
 	if len(raw) < 1 {
@@ -69,21 +112,33 @@ func DecodeOid(raw []byte) (*Oid, error) {
 	}
 
 	result := make([]int, 2)
-	val := 0
+	var val uint64
 	for idx, b := range raw {
 		if idx == 0 {
 			result[0] = int(math.Floor(float64(b) / 40))
 			result[1] = int(math.Mod(float64(b), 40))
 			continue
 		}
+		if val > maxSubID>>7 {
+			return nil, fmt.Errorf("oid sub-identifier @ idx %d is larger than %d", idx, uint32(maxSubID))
+		}
 		if b < 128 {
-			val = val*128 + int(b)
-			result = append(result, val)
+			val = val*128 + uint64(b)
+			if len(result) == maxOidLen {
+				return nil, fmt.Errorf("oid has more than the maximum of %d sub-identifiers", maxOidLen)
+			}
+			if val > math.MaxInt {
+				return nil, fmt.Errorf("oid sub-identifier %d @ idx %d doesn't fit in an int", val, idx)
+			}
+			result = append(result, int(val))
 			val = 0
 		} else {
-			val = val*128 + int(b%128)
+			val = val*128 + uint64(b%128)
 		}
 	}
+	if raw[len(raw)-1] >= 128 {
+		return nil, errors.New("oid ends in the middle of a sub-identifier")
+	}
 	r := Oid(result)
 	return &r, nil
 }
@@ -93,6 +148,9 @@ func (o Oid) Encode() ([]byte, error) {
 	if len(o) < 3 {
 		return nil, errors.New("oid needs to be at least 3 long")
 	}
+	if len(o) > maxOidLen {
+		return nil, fmt.Errorf("oid has %d sub-identifiers, more than the maximum of %d", len(o), maxOidLen)
+	}
 	var result []byte
 	if o[0] != 1 || o[1] != 3 {
 		return nil, errors.New("oid didn't start with .1.3")
@@ -103,6 +161,9 @@ func (o Oid) Encode() ([]byte, error) {
 	result = append(result, 0x2b)
 	for i := 2; i < len(o); i++ {
 		val := o[i]
+		if val < 0 || uint64(val) > maxSubID {
+			return nil, fmt.Errorf("oid sub-identifier %d @ idx %d isn't an unsigned 32 bits value", val, i)
+		}
 
 		toadd := make([]int, 0)
 		if val == 0 {
@@ -132,6 +193,39 @@ func (o Oid) Copy() Oid {
 	return Oid(dest)
 }
 
+// Equal determines if two oids have the same sub-identifiers.
+func (o Oid) Equal(other Oid) bool {
+	if len(o) != len(other) {
+		return false
+	}
+	for idx, val := range other {
+		if o[idx] != val {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare orders oids lexicographically, the way agents walk them. It returns -1 if o comes
+// before other, 1 if it comes after and 0 if they're equal.
+func (o Oid) Compare(other Oid) int {
+	for idx := 0; idx < len(o) && idx < len(other); idx++ {
+		if o[idx] < other[idx] {
+			return -1
+		}
+		if o[idx] > other[idx] {
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(other):
+		return -1
+	case len(o) > len(other):
+		return 1
+	}
+	return 0
+}
+
 /* Within determines if an oid has this oid instance as a prefix.
 
 E.g. MustParseOid("1.2.3").Within("1.2") => true. */
@@ -146,3 +240,46 @@ func (o Oid) Within(other Oid) bool {
 	}
 	return true
 }
+
+// Index returns the index of a table cell oid, the sub-identifiers after the column that follows
+// tableEntry. E.g. the index of ifDescr.3, .1.3.6.1.2.1.2.2.1.2.3, in ifEntry, .1.3.6.1.2.1.2.2.1, is [3].
+// It's false when the oid isn't a cell of the table.
+func (o Oid) Index(tableEntry Oid) ([]int, bool) {
+	if len(o) < len(tableEntry)+2 || !o.Within(tableEntry) {
+		return nil, false
+	}
+	return o[len(tableEntry)+1:], true
+}
+
+// IndexAsIP decodes an IPv4 address at the start of a table index, as in ipAddrTable. It returns the rest
+// of the index, for composite indexes, and false if the index doesn't start with an address.
+func IndexAsIP(index []int) (net.IP, []int, bool) {
+	if len(index) < net.IPv4len {
+		return nil, nil, false
+	}
+	ip := make(net.IP, net.IPv4len)
+	for idx := range ip {
+		if index[idx] < 0 || index[idx] > 255 {
+			return nil, nil, false
+		}
+		ip[idx] = byte(index[idx])
+	}
+	return ip, index[net.IPv4len:], true
+}
+
+// IndexAsString decodes a length-prefixed string at the start of a table index, as the index of a
+// variable length OCTET STRING column is encoded. It returns the rest of the index, for composite
+// indexes, and false if the index doesn't start with a string.
+func IndexAsString(index []int) (string, []int, bool) {
+	if len(index) < 1 || index[0] < 0 || len(index) < 1+index[0] {
+		return "", nil, false
+	}
+	result := make([]byte, index[0])
+	for idx := range result {
+		if index[1+idx] < 0 || index[1+idx] > 255 {
+			return "", nil, false
+		}
+		result[idx] = byte(index[1+idx])
+	}
+	return string(result), index[1+len(result):], true
+}
@@ -1,7 +1,12 @@
 package snmplib
 
 import (
+	"bytes"
 	"fmt"
+	"math"
+	"net"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -78,3 +83,168 @@ func TestWithin(t *testing.T) {
 		t.Errorf("Within is not working")
 	}
 }
+
+func TestEqual(t *testing.T) {
+	if !MustParseOid("1.3.6.1").Equal(MustParseOid(".1.3.6.1")) {
+		t.Errorf("Equal is not working for identical oids")
+	}
+	if MustParseOid("1.3.6.1").Equal(MustParseOid("1.3.6")) {
+		t.Errorf("Equal is not working for oids of different length")
+	}
+	if MustParseOid("1.3.6.1").Equal(MustParseOid("1.3.6.2")) {
+		t.Errorf("Equal is not working for different oids")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.3.6.1", "1.3.6.1", 0},
+		{"1.3.6.1", "1.3.6.2", -1},
+		{"1.3.6.2", "1.3.6.1", 1},
+		{"1.3.6", "1.3.6.1", -1},
+		{"1.3.6.1.1", "1.3.6.2", -1},
+	}
+
+	for _, test := range tests {
+		if result := MustParseOid(test.a).Compare(MustParseOid(test.b)); result != test.expected {
+			t.Errorf("Compare '%s' to '%s' got %d, expected %d", test.a, test.b, result, test.expected)
+		}
+	}
+}
+
+func TestOversizedOid(t *testing.T) {
+	long := "1.3" + strings.Repeat(".1", 198)
+	if _, err := ParseOid(long); err == nil {
+		t.Errorf("Parsed an oid with 200 sub-identifiers")
+	}
+	if _, err := ParseOid("1.3" + strings.Repeat(".1", 126)); err != nil {
+		t.Errorf("Error parsing an oid with 128 sub-identifiers: %v", err)
+	}
+
+	oid := make(Oid, 200)
+	copy(oid, Oid{1, 3})
+	if _, err := oid.Encode(); err == nil {
+		t.Errorf("Encoded an oid with 200 sub-identifiers")
+	}
+
+	// An OBJECT IDENTIFIER value with 200 sub-identifiers, as a broken agent could send.
+	raw := append([]byte{0x06, 0x81, 199, 0x2b}, bytes.Repeat([]byte{0x01}, 198)...)
+	if _, err := DecodeOid(raw[3:]); err == nil {
+		t.Errorf("Decoded an oid with 200 sub-identifiers")
+	}
+	packet := append([]byte{0x30, 0x81, byte(len(raw))}, raw...)
+	if _, err := DecodeSequence(packet); err == nil {
+		t.Errorf("Decoded a sequence holding an oid with 200 sub-identifiers")
+	}
+}
+
+func TestLargeSubIdentifiers(t *testing.T) {
+	tests := []struct {
+		subID   uint64
+		encoded []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x81, 0x00}},
+		{16384, []byte{0x81, 0x80, 0x00}},
+		{0xFFFFFFFF, []byte{0x8f, 0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, test := range tests {
+		if test.subID > math.MaxInt {
+			// It doesn't fit in the int of 32 bits platforms.
+			continue
+		}
+		oid := Oid{1, 3, 6, int(test.subID)}
+		expected := append([]byte{0x2b, 0x06}, test.encoded...)
+		encoded, err := oid.Encode()
+		if err != nil || !bytes.Equal(encoded, expected) {
+			t.Errorf("%v encoded as %x, %v, expected %x", oid, encoded, err, expected)
+			continue
+		}
+		decoded, err := DecodeOid(encoded)
+		if err != nil || !decoded.Equal(oid) {
+			t.Errorf("%x decoded as %v, %v, expected %v", encoded, decoded, err, oid)
+		}
+		if parsed, err := ParseOid(oid.String()); err != nil || !parsed.Equal(oid) {
+			t.Errorf("%v parsed as %v, %v", oid, parsed, err)
+		}
+	}
+
+	// Anything outside of 32 bits unsigned is rejected.
+	for _, s := range []string{"1.3.6.4294967296", "1.3.6.-1"} {
+		if oid, err := ParseOid(s); err == nil {
+			t.Errorf("Parsed %s as %v", s, oid)
+		}
+	}
+	if tooLarge := uint64(1) << 32; tooLarge <= math.MaxInt {
+		if encoded, err := (Oid{1, 3, 6, int(tooLarge)}).Encode(); err == nil {
+			t.Errorf("Encoded a 33 bits sub-identifier as %x", encoded)
+		}
+	}
+	for _, raw := range [][]byte{{0x2b, 0x06, 0x90, 0x80, 0x80, 0x80, 0x00}, {0x2b, 0x06, 0x81}} {
+		if oid, err := DecodeOid(raw); err == nil {
+			t.Errorf("Decoded %x as %v", raw, oid)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	ifEntry := MustParseOid("1.3.6.1.2.1.2.2.1")
+	index, ok := MustParseOid("1.3.6.1.2.1.2.2.1.2.3").Index(ifEntry)
+	if !ok || !reflect.DeepEqual(index, []int{3}) {
+		t.Errorf("Index of ifDescr.3 is %v, %v, expected [3]", index, ok)
+	}
+	for _, oid := range []string{"1.3.6.1.2.1.2.2.1.2", "1.3.6.1.2.1.2.1.0"} {
+		if index, ok := MustParseOid(oid).Index(ifEntry); ok {
+			t.Errorf("%s has index %v in ifEntry", oid, index)
+		}
+	}
+
+	// ipAdEntIfIndex.192.0.2.1 in ipAddrEntry.
+	index, ok = MustParseOid("1.3.6.1.2.1.4.20.1.2.192.0.2.1").Index(MustParseOid("1.3.6.1.2.1.4.20.1"))
+	if !ok {
+		t.Fatalf("No index in ipAdEntIfIndex.192.0.2.1")
+	}
+	ip, rest, ok := IndexAsIP(index)
+	if !ok || !ip.Equal(net.ParseIP("192.0.2.1")) || len(rest) != 0 {
+		t.Errorf("IP index is %v, rest %v, %v", ip, rest, ok)
+	}
+	if ip, _, ok := IndexAsIP([]int{192, 0, 256, 1}); ok {
+		t.Errorf("Decoded IP index %v out of a 256 sub-identifier", ip)
+	}
+
+	// A composite index, a string then an integer.
+	s, rest, ok := IndexAsString([]int{3, 'e', 't', 'h', 7})
+	if !ok || s != "eth" || !reflect.DeepEqual(rest, []int{7}) {
+		t.Errorf("String index is %q, rest %v, %v", s, rest, ok)
+	}
+	if s, _, ok := IndexAsString([]int{4, 'e', 't', 'h'}); ok {
+		t.Errorf("Decoded string index %q out of a truncated index", s)
+	}
+}
+
+func TestNormalizeOid(t *testing.T) {
+	for _, s := range []string{".1.3.6.1.2", "1.3.6.1.2", "iso.3.6.1.2"} {
+		if normalized, err := NormalizeOid(s); err != nil || normalized != ".1.3.6.1.2" {
+			t.Errorf("%q normalized as %q, %v, expected .1.3.6.1.2", s, normalized, err)
+		}
+	}
+
+	tests := map[string]string{
+		"1.3.6.1.":    "empty sub-identifier @ idx 4",
+		"1.3..6.1":    "empty sub-identifier @ idx 2",
+		"1.3.6.x.1":   `"x" @ idx 3 isn't a number`,
+		"1.3.6.1 ":    `"1 " @ idx 3 isn't a number`,
+		"mib-2.1":     `"mib-2" @ idx 0 isn't a number`,
+		"1.3.6.1e100": `"1e100" @ idx 3 isn't a number`,
+	}
+	for s, expected := range tests {
+		_, err := NormalizeOid(s)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q normalized with error %v, expected one containing %s", s, err, expected)
+		}
+	}
+}
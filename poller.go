@@ -0,0 +1,89 @@
+package snmplib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Poller gets the same objects of an agent every Interval, as monitoring collectors do.
+type Poller struct {
+	SNMP     *SNMP         // Agent to poll, v1 or v2c.
+	Oids     []Oid         // Objects to get, in a single request.
+	Interval time.Duration // Time between the starts of two polls.
+
+	mu      sync.Mutex
+	stop    chan struct{}
+	running sync.WaitGroup
+	ticks   <-chan time.Time // Ticks starting the polls, from a ticker of Interval if nil.
+}
+
+// NewPoller creates a Poller getting oids from the agent of w every interval.
+func NewPoller(w *SNMP, oids []Oid, interval time.Duration) *Poller {
+	return &Poller{SNMP: w, Oids: oids, Interval: interval}
+}
+
+// Start starts polling, calling callback with the values GetMultiple returns, or its error, after every poll.
+// A poll still running when the next one is due makes it skipped, so slow agents aren't flooded.
+// callback is called from another goroutine, one call at a time.
+func (p *Poller) Start(callback func(map[string]interface{}, error)) error {
+	if p.Interval <= 0 {
+		return fmt.Errorf("invalid poll interval %v", p.Interval)
+	}
+	if len(p.Oids) == 0 {
+		return errors.New("no oid to poll")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != nil {
+		return errors.New("poller already started")
+	}
+	p.stop = make(chan struct{})
+	p.running.Add(1)
+	go p.run(p.stop, callback)
+	return nil
+}
+
+func (p *Poller) run(stop chan struct{}, callback func(map[string]interface{}, error)) {
+	defer p.running.Done()
+	ticks := p.ticks
+	if ticks == nil {
+		ticker := time.NewTicker(p.Interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	busy := make(chan struct{}, 1)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticks:
+		}
+
+		select {
+		case busy <- struct{}{}:
+		default:
+			log.Printf("Skipping poll of %s, the previous one is still running", p.SNMP.Target)
+			continue
+		}
+		p.running.Add(1)
+		go func() {
+			defer p.running.Done()
+			defer func() { <-busy }()
+			callback(p.SNMP.GetMultiple(p.Oids))
+		}()
+	}
+}
+
+// Stop stops polling, and waits for the poll running, if any, to call its callback.
+func (p *Poller) Stop() {
+	p.mu.Lock()
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.mu.Unlock()
+	p.running.Wait()
+}
@@ -0,0 +1,63 @@
+package snmplib
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+)
+
+// RandSource is a source of random numbers, as the Source and *Rand of math/rand are. SNMP objects draw
+// their request IDs, SNMP v3 msgIDs and privacy salts from it.
+type RandSource interface {
+	Int63() int64
+}
+
+// cryptoSource is the RandSource of the objects that don't set one, reading crypto/rand. It's safe for
+// concurrent use.
+type cryptoSource struct{}
+
+// Int63 returns a non-negative random int64.
+func (cryptoSource) Int63() int64 {
+	var b [8]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("reading random bytes: %v", err))
+	}
+	return int64(binary.BigEndian.Uint64(b[:]) >> 1)
+}
+
+// randomRequestID returns a request ID drawn from r. It's 31 bits long, as math/rand's Int31, since some
+// agents mishandle negative request IDs.
+func randomRequestID(r RandSource) int {
+	return int(r.Int63() >> 32)
+}
+
+// lockedSource is a RandSource set by the user, whose calls are serialized as the sources of math/rand
+// aren't safe for concurrent use.
+type lockedSource struct {
+	source RandSource
+}
+
+// lockedSourcesMu serializes the calls to the sources set by the user. It's shared by all of them, since the
+// copies of an object share theirs.
+var lockedSourcesMu sync.Mutex
+
+// Int63 returns the next number of the source.
+func (s lockedSource) Int63() int64 {
+	lockedSourcesMu.Lock()
+	defer lockedSourcesMu.Unlock()
+	return s.source.Int63()
+}
+
+// random returns the RandSource of the object.
+func (w SNMP) random() RandSource {
+	if w.Rand != nil {
+		return lockedSource{w.Rand}
+	}
+	return cryptoSource{}
+}
+
+// requestID returns a random request ID, or msgID.
+func (w SNMP) requestID() int {
+	return randomRequestID(w.random())
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package snmplib
+
+import (
+	"syscall"
+)
+
+// setReuseAddr sets SO_REUSEADDR on a socket before it's bound.
+func setReuseAddr(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,67 @@
+package snmplib
+
+import (
+	"errors"
+	"time"
+)
+
+// SessionState is the SNMP V3 security state of an SNMP object towards its agent, as ExportSession
+// captures it. It lets pollers restarting often skip the discovery of every agent.
+type SessionState struct {
+	EngineID    string
+	EngineBoots int32
+	EngineTime  int32
+	CapturedAt  time.Time // When the agent's engine time was EngineTime, to estimate it later.
+
+	// The privacy salts, so that they aren't reused after a restore.
+	AESSalt int64
+	DESSalt uint32
+}
+
+// ExportSession captures the engine of the agent the object discovered, and its privacy salts. The state
+// holds no key or password: ImportSession localizes the keys again.
+func (w *SNMP) ExportSession() SessionState {
+	defer w.lock()()
+	capturedAt := w.engineTimeAt
+	if capturedAt.IsZero() {
+		capturedAt = time.Now()
+	}
+	return SessionState{
+		EngineID:    w.engineID,
+		EngineBoots: w.engineBoots,
+		EngineTime:  w.engineTime,
+		CapturedAt:  capturedAt,
+		AESSalt:     w.aesIV,
+		DESSalt:     w.desIV,
+	}
+}
+
+// ImportSession restores a state ExportSession captured, so that requests are sent right away without
+// discovering the agent first. The engine time is moved forward by the time elapsed since the capture.
+//
+// If the agent rejects the restored state, e.g. because it was replaced and has another engine ID, it's
+// discovered again, see ReportRetries.
+func (w *SNMP) ImportSession(state SessionState) error {
+	if w.Version != SNMPv3 {
+		return errors.New("sessions are only for SNMP V3")
+	}
+	if err := ValidateEngineID(state.EngineID); err != nil {
+		return err
+	}
+	elapsed := time.Since(state.CapturedAt)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	defer w.lock()()
+	w.engineID = state.EngineID
+	w.engineBoots = state.EngineBoots
+	w.engineTime = state.EngineTime + int32(elapsed/time.Second)
+	w.engineTimeAt = time.Now()
+	if err := w.localizeKeys(); err != nil {
+		return err
+	}
+	w.aesIV = state.AESSalt
+	w.desIV = state.DESSalt
+	return nil
+}
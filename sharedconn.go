@@ -0,0 +1,242 @@
+package snmplib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// SharedConn is an unconnected UDP socket shared by the SNMP objects of many targets, sparing the socket per
+// target large pollers would otherwise open. Each object gets a connection to its target from Dial, and
+// the responses are dispatched to the object waiting for them by their source address and request ID, the
+// msgID for SNMP v3. Responses nobody waits for are dropped.
+//
+//	shared := NewSharedConn(packetConn)
+//	conn, err := shared.Dial("192.0.2.1")
+//	wsnmp := NewSNMPOnConn("192.0.2.1", "public", SNMPv2c, time.Second, 2, conn)
+type SharedConn struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	pending map[sharedKey]*sharedTargetConn // Connections waiting for a response, by the request they sent.
+	done    chan struct{}                   // Closed once reading conn failed, e.g. because it was closed.
+	err     error                           // Why reading conn failed.
+}
+
+// sharedKey identifies the responses to a request.
+type sharedKey struct {
+	addr string
+	id   uint32 // Request ID, compared on 32 bits as requestIDsMatch does.
+}
+
+// NewSharedConn starts dispatching the responses read from conn, until it's closed.
+func NewSharedConn(conn net.PacketConn) *SharedConn {
+	s := &SharedConn{conn: conn, pending: make(map[sharedKey]*sharedTargetConn), done: make(chan struct{})}
+	go s.dispatch()
+	return s
+}
+
+// Dial returns a connection sending to target, an address with an optional port, 161 if there's none,
+// and reading the responses sent from it. Closing it leaves the shared socket open.
+func (s *SharedConn) Dial(target string) (net.Conn, error) {
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		target = net.JoinHostPort(target, "161")
+	}
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, fmt.Errorf(`error resolving target address ("udp", "%s") : %s`, target, err)
+	}
+	return &sharedTargetConn{shared: s, addr: addr, responses: make(chan sharedResponse, 4), closed: make(chan struct{})}, nil
+}
+
+// Close closes the shared socket, the connections Dial returned fail from then on.
+func (s *SharedConn) Close() error {
+	return s.conn.Close()
+}
+
+// dispatch reads the responses and hands them over to the connections waiting for them.
+func (s *SharedConn) dispatch() {
+	packet := make([]byte, 65535)
+	for {
+		numRead, addr, err := s.conn.ReadFrom(packet)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			close(s.done)
+			return
+		}
+
+		id, err := messageID(packet[:numRead])
+		if err != nil {
+			log.Printf("Error: Dropping unexpected packet from %v: %v", addr, err)
+			continue
+		}
+		s.mu.Lock()
+		target := s.pending[sharedKey{addr.String(), uint32(id)}]
+		s.mu.Unlock()
+		if target == nil {
+			log.Printf("Error: Dropping packet from %v, no request %d is waiting for it", addr, id)
+			continue
+		}
+		select {
+		case target.responses <- sharedResponse{uint32(id), append([]byte(nil), packet[:numRead]...)}:
+		default:
+			// Responses to the same request are already waiting, e.g. after retries.
+		}
+	}
+}
+
+// messageID returns the request ID of an SNMP v1 or v2c message, or the msgID of an SNMP v3 message, which
+// responses echo.
+func messageID(packet []byte) (int, error) {
+	decoded, err := DecodeSequence(packet)
+	if err != nil {
+		return 0, err
+	}
+	if len(decoded) < 4 {
+		return 0, fmt.Errorf("invalid message length %d", len(decoded))
+	}
+	header := decoded[3]
+	if decoded[1] == int(SNMPv3) {
+		header = decoded[2]
+	}
+	if fields, ok := header.([]interface{}); ok && len(fields) > 1 {
+		if id, ok := fields[1].(int); ok {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no request ID in %v", header)
+}
+
+// sharedResponse is a response dispatched to a sharedTargetConn.
+type sharedResponse struct {
+	id     uint32
+	packet []byte
+}
+
+// sharedTargetConn is a connection to a target over a SharedConn.
+type sharedTargetConn struct {
+	shared    *SharedConn
+	addr      *net.UDPAddr
+	responses chan sharedResponse // Responses to the last request written, and maybe late ones to the previous.
+
+	mu           sync.Mutex
+	key          *sharedKey // Request the connection waits for the responses of, nil before any.
+	readDeadline time.Time
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+// Write sends a request to the target, and makes the connection wait for its responses rather than those
+// of the previous one.
+func (c *sharedTargetConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	id, err := messageID(b)
+	if err != nil {
+		return 0, fmt.Errorf("can't match the responses to the request: %v", err)
+	}
+	key := sharedKey{c.addr.String(), uint32(id)}
+	c.mu.Lock()
+	c.shared.mu.Lock()
+	c.unregister()
+	c.shared.pending[key] = c
+	c.shared.mu.Unlock()
+	c.key = &key
+	c.mu.Unlock()
+	return c.shared.conn.WriteTo(b, c.addr)
+}
+
+// unregister stops waiting for the responses of the last request. Both locks must be held.
+func (c *sharedTargetConn) unregister() {
+	if c.key != nil && c.shared.pending[*c.key] == c {
+		delete(c.shared.pending, *c.key)
+	}
+}
+
+// Read reads the response to the last request written. Like a UDP socket, the part of the response that
+// doesn't fit in b is lost.
+func (c *sharedTargetConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	key := c.key
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	for {
+		select {
+		case response := <-c.responses:
+			if key == nil || response.id != key.id {
+				// Late response to the previous request, dispatched as the next one was sent.
+				continue
+			}
+			return copy(b, response.packet), nil
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-c.closed:
+			return 0, net.ErrClosed
+		case <-c.shared.done:
+			c.shared.mu.Lock()
+			defer c.shared.mu.Unlock()
+			return 0, c.shared.err
+		}
+	}
+}
+
+// Close stops waiting for responses. The shared socket stays open.
+func (c *sharedTargetConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.shared.mu.Lock()
+		c.unregister()
+		c.shared.mu.Unlock()
+		c.mu.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+// LocalAddr returns the address of the shared socket.
+func (c *sharedTargetConn) LocalAddr() net.Addr {
+	return c.shared.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the target.
+func (c *sharedTargetConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline sets the read deadline, writes don't block.
+func (c *sharedTargetConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of the reads.
+func (c *sharedTargetConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline does nothing, the deadline would apply to the writes of all the targets.
+func (c *sharedTargetConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
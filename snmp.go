@@ -3,20 +3,19 @@ package snmplib
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/des"
-	"crypto/md5"
-	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net"
-	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -25,24 +24,29 @@ type V3user struct {
 	User    string
 	AuthAlg string //MD5 or SHA1
 	AuthPwd string
-	PrivAlg string //AES or DES
+	PrivAlg string //AES, DES or 3DES
 	PrivPwd string
 }
 
 // SNMP object type that lets you do SNMP requests.
 type SNMP struct {
-	Target    string        // Target device for these SNMP events.
-	Community string        // Community to use to contact the device.
-	Version   SNMPVersion   // SNMPVersion to encode in the packets.
-	timeout   time.Duration // Timeout to use for all SNMP packets.
-	retries   int           // Number of times to retry an operation.
-	conn      net.Conn      // Cache the UDP connection in the object.
+	Target    string          // Target device for these SNMP events.
+	Community string          // Community to use to contact the device.
+	Version   SNMPVersion     // SNMPVersion to encode in the packets.
+	timeout   time.Duration   // Timeout to use for all SNMP packets.
+	retries   int             // Number of times to retry an operation, see poll.
+	local     string          // Local address conn was dialed from, empty for the default.
+	port      int             // Port conn was dialed to, 0 for 161.
+	conn      net.Conn        // Cache the UDP connection in the object.
+	stats     *Stats          // Counters for the requests sent on conn.
+	mu        *sync.Mutex     // Serializes the requests on conn, shared by the copies of the object.
+	ctx       context.Context // Context of the requests, nil for none, see WithContext.
 
 	//SNMP V3 variables
 	user     string
 	authAlg  string //MD5 or SHA1
 	authPwd  string
-	privAlg  string //AES or DES
+	privAlg  string //AES, DES or 3DES
 	privPwd  string
 	engineID string
 
@@ -51,9 +55,75 @@ type SNMP struct {
 	privKey     string
 	engineBoots int32
 	engineTime  int32
-	desIV       uint32
-	aesIV       int64
-	TrapUsers   []V3user
+	// engineTimeAt is when the agent's engine time was engineTime, see ExportSession.
+	engineTimeAt time.Time
+	desIV        uint32
+	aesIV        int64
+	TrapUsers    []V3user
+
+	// FallbackCommunity, if set, is the community the SNMP V3 requests are sent as v2c with when the agent
+	// doesn't answer the discovery or the v3 request, e.g. because v3 isn't enabled on it, or the discovery
+	// was imported. The discovery is tried again for every request.
+	FallbackCommunity string
+
+	// DecodeLimits bounds the responses and traps this object decodes, the zero value uses the defaults.
+	DecodeLimits DecodeLimits
+
+	// ReportRetries is how many times a v3 request is sent again after the agent answered with a report,
+	// e.g. because our engine time was outside its time window.
+	ReportRetries int
+
+	// ContextName is the context of the SNMP V3 requests, empty for the default context.
+	// CommunityToContext gives the context a coexistence proxy maps a community to.
+	ContextName string
+
+	// IgnoreContextMismatch accepts SNMP V3 responses for another context than the request's, which are
+	// otherwise refused: an agent must answer in the context it was asked, a proxy may have misrouted them.
+	IgnoreContextMismatch bool
+
+	// MaxTableEntries is the most entries GetTable and the walks gather before giving up with
+	// ErrTableTooLarge, protecting against agents serving endless tables. Zero uses the default, a million.
+	MaxTableEntries int
+
+	// MaxMessageSize is the largest response RepetitionGrowth aims for, usually the agent's maximum message
+	// size. Zero uses the default, 1472 bytes.
+	MaxMessageSize int
+
+	// StartTime is the start of the uptime the traps sent by SendTrap report, see Uptime. Zero uses the
+	// creation of the object.
+	StartTime time.Time
+	created   time.Time
+
+	// DialTimeout bounds opening the connection of Clone, resolving the target name included. Zero uses the
+	// default, 5s, which the constructors use as well: dial the connection and use NewSNMPOnConn to bound
+	// the first one otherwise.
+	DialTimeout time.Duration
+
+	// ResponseBufferSize is the size of the buffer responses are read in. Longer responses fail with
+	// ErrResponseTruncated. Zero uses the default, 16384 bytes.
+	ResponseBufferSize int
+
+	// Rand, if set, is the source of the request IDs and privacy salts, e.g. a seeded math/rand source for
+	// reproducible tests. Its calls are serialized, so the object's copies and clones can share it even if
+	// it isn't safe for concurrent use. Nil uses crypto/rand.
+	Rand RandSource
+
+	// OnSend and OnRecv, if set, are called with a copy of every packet sent to and received from the
+	// agent, e.g. to record them. They're called from the goroutine doing the request.
+	OnSend func([]byte)
+	OnRecv func([]byte)
+
+	// ProbeOid is the object Ping and the v1/v2c keepalive get, nil for sysUpTime.0. Agents serving only a
+	// vendor subtree need one of their own objects.
+	ProbeOid Oid
+
+	// RepetitionGrowth, if set, lets GetTable grow and shrink the repetitions of its GETBULK requests. It's
+	// shared by the copies of the object, and keeps the repetitions the last table walk settled on.
+	RepetitionGrowth *RepetitionGrowth
+
+	// KeepAlive is the interval between the requests StartKeepAlive sends.
+	KeepAlive time.Duration
+	keepAlive *keepAlive
 }
 
 // SNMP constants.
@@ -62,18 +132,43 @@ const (
 	maxMsgSize int    = 65500
 	SnmpAES    string = "AES"
 	SnmpDES    string = "DES"
+	SnmpDES3   string = "3DES"
 	SnmpSHA1   string = "SHA1"
 	SnmpMD5    string = "MD5"
+
+	// minPasswordLen is the shortest passphrase RFC 3414 allows for key localization.
+	minPasswordLen int = 8
+
+	// defaultMaxRepetitions is the number of repetitions GetTable asks for in each GETBULK request.
+	defaultMaxRepetitions int = 50
+
+	// defaultMaxTableEntries is the most entries GetTable and the walks gather, unless MaxTableEntries says
+	// otherwise.
+	defaultMaxTableEntries int = 1000000
+
+	// adaptiveStartRepetitions is the number of repetitions of the first GETBULK request of GetTableAdaptive.
+	adaptiveStartRepetitions int = 10
+
+	// defaultMaxMessageSize is the size of the responses GetTableAdaptive aims for, unless MaxMessageSize says
+	// otherwise: the UDP payload of an Ethernet frame, so responses aren't fragmented.
+	defaultMaxMessageSize int = 1472
+
+	// maxCommunityLen is the longest community agents can store, as an SnmpAdminString.
+	maxCommunityLen int = 255
 )
 
-func passwordToKey(password string, engineID string, hashAlg string) string {
-	h := sha1.New()
-	if hashAlg == "MD5" {
-		h = md5.New()
+func passwordToKey(password string, engineID string, hashAlg string) (string, error) {
+	plen := len(password)
+	if plen == 0 {
+		return "", errors.New("cannot localize key from an empty password")
+	}
+
+	h, err := newAuthHash(hashAlg)
+	if err != nil {
+		return "", err
 	}
 
 	count := 0
-	plen := len(password)
 	repeat := 1048576 / plen
 	remain := 1048576 % plen
 	for count < repeat {
@@ -93,15 +188,82 @@ func passwordToKey(password string, engineID string, hashAlg string) string {
 	localKey := h.Sum(nil)
 	//fmt.Printf("localKey=% x\n", localKey)
 
-	return string(localKey)
+	return string(localKey), nil
+}
+
+// privPasswordToKey localizes the privacy key and cuts it to the size privAlg needs. 3DES needs
+// 32 bytes (24 bytes of key and 8 bytes of pre-IV), more than MD5 or SHA1 produce, so the key
+// is extended by localizing the previous key again as in draft-reeder-snmpv3-usm-3desede.
+//
+// The DES keys are used as localized, without fixing their parity bits: RFC 3414 doesn't ask for it, and
+// DES ignores them, so agents that do set them still encrypt the same way.
+func privPasswordToKey(password string, engineID string, hashAlg string, privAlg string) (string, error) {
+	key, err := passwordToKey(password, engineID, hashAlg)
+	if err != nil {
+		return "", err
+	}
+	keyLen, ok := privKeyLengths[privAlg]
+	if !ok {
+		return "", fmt.Errorf("unsupported priv algorithm %s", privAlg)
+	}
+	for last := key; len(key) < keyLen; key += last {
+		if last, err = passwordToKey(last, engineID, hashAlg); err != nil {
+			return "", err
+		}
+	}
+	return key[:keyLen], nil
+}
+
+// defaultDialTimeout bounds opening the connection to the target, resolving its name included, in the
+// constructors and when DialTimeout isn't set. It's separate from the request timeout, which is only meant
+// for the round trips.
+const defaultDialTimeout = 5 * time.Second
+
+// dial opens the UDP connection to port on target with dialer, 161 if port is 0. If local isn't empty,
+// packets are sent from that address, which can be an IP or an IP:port.
+func dial(dialer net.Dialer, local, target string, port int) (net.Conn, error) {
+	if local != "" {
+		if _, _, err := net.SplitHostPort(local); err != nil {
+			local = net.JoinHostPort(local, "0")
+		}
+		localAddr, err := net.ResolveUDPAddr("udp", local)
+		if err != nil {
+			return nil, fmt.Errorf(`error resolving local address ("udp", "%s") : %s`, local, err)
+		}
+		dialer.LocalAddr = localAddr
+	}
+
+	if port == 0 {
+		port = 161
+	}
+	targetPort := net.JoinHostPort(target, strconv.Itoa(port))
+	conn, err := dialer.Dial("udp", targetPort)
+	if err != nil {
+		return nil, fmt.Errorf(`error connecting to ("udp", "%s") : %s`, targetPort, err)
+	}
+	return conn, nil
 }
 
 // NewSNMP creates a new SNMP object. Opens a UDP connection to the device that will be used for the SNMP packets.
+//
+// retries is how many times a request is sent again when the agent doesn't answer: with 0 it's sent once.
+// A negative retries sends it again until the context set with WithContext is done, it's 0 without one.
 func NewSNMP(target, community string, version SNMPVersion, timeout time.Duration, retries int) (*SNMP, error) {
-	targetPort := fmt.Sprintf("%s:161", target)
-	conn, err := net.DialTimeout("udp", targetPort, timeout)
+	return NewSNMPFromAddr("", target, community, version, timeout, retries)
+}
+
+// NewSNMPFromAddr creates a new SNMP object like NewSNMP, but sends the SNMP packets from the local address.
+// Useful on multi-homed hosts when agents only accept packets from a given manager IP.
+func NewSNMPFromAddr(local, target, community string, version SNMPVersion, timeout time.Duration, retries int) (*SNMP, error) {
+	if version != SNMPv1 && version != SNMPv2c {
+		return nil, fmt.Errorf(`Invalid version %v, needs v1 or v2c, use NewSNMPv3 for v3`, version)
+	}
+	if err := ValidateCommunity(community, false); err != nil {
+		return nil, err
+	}
+	conn, err := dial(net.Dialer{Timeout: defaultDialTimeout}, local, target, 0)
 	if err != nil {
-		return nil, fmt.Errorf(`error connecting to ("udp", "%s") : %s`, targetPort, err)
+		return nil, err
 	}
 	return &SNMP{
 		Target:    target,
@@ -109,23 +271,46 @@ func NewSNMP(target, community string, version SNMPVersion, timeout time.Duratio
 		Version:   version,
 		timeout:   timeout,
 		retries:   retries,
+		local:     local,
 		conn:      conn,
+		stats:     &Stats{},
+		mu:        &sync.Mutex{},
+		created:   time.Now(),
 	}, nil
 }
 
+// ValidateCommunity checks a community is one agents will accept. The constructors are lenient and only
+// reject communities that always end up in packets agents drop: empty ones, ones containing NUL and ones
+// longer than 255 bytes. Some agents accept non-ASCII communities, strict also rejects anything that
+// isn't printable ASCII.
+func ValidateCommunity(community string, strict bool) error {
+	if len(community) == 0 {
+		return errors.New("Invalid community, can't be empty")
+	}
+	if len(community) > maxCommunityLen {
+		return fmt.Errorf("Invalid community, longer than %d bytes", maxCommunityLen)
+	}
+	for idx := 0; idx < len(community); idx++ {
+		c := community[idx]
+		if c == 0 {
+			return fmt.Errorf("Invalid community, contains NUL @ idx %d", idx)
+		}
+		if strict && (c < 0x20 || c > 0x7e) {
+			return fmt.Errorf("Invalid community, contains non printable ASCII 0x%02x @ idx %d", c, idx)
+		}
+	}
+	return nil
+}
+
 // NewSNMPv3 creates a new SNMP object for SNMPv3. Opens a UDP connection to the device that will be used for the SNMP packets.
 func NewSNMPv3(target, user, authAlg, authPwd, privAlg, privPwd string, timeout time.Duration, retries int) (*SNMP, error) {
-	if authAlg != SnmpMD5 && authAlg != SnmpSHA1 {
-		return nil, fmt.Errorf(`Invalid auth algorithm %s, needs SHA1 or MD5`, authAlg)
-	}
-	if privAlg != SnmpAES && privAlg != SnmpDES {
-		return nil, fmt.Errorf(`Invalid priv algorithm %s, needs AES or DES`, privAlg)
+	if err := validateV3Credentials(authAlg, authPwd, privAlg, privPwd); err != nil {
+		return nil, err
 	}
 
-	targetPort := fmt.Sprintf("%s:161", target)
-	conn, err := net.DialTimeout("udp", targetPort, timeout)
+	conn, err := dial(net.Dialer{Timeout: defaultDialTimeout}, "", target, 0)
 	if err != nil {
-		return nil, fmt.Errorf(`error connecting to ("udp", "%s") : %s`, targetPort, err)
+		return nil, err
 	}
 	return &SNMP{
 		Target:  target,
@@ -133,15 +318,38 @@ func NewSNMPv3(target, user, authAlg, authPwd, privAlg, privPwd string, timeout
 		timeout: timeout,
 		retries: retries,
 		conn:    conn,
+		stats:   &Stats{},
+		mu:      &sync.Mutex{},
+		created: time.Now(),
 		user:    user,
 		authAlg: authAlg,
 		authPwd: authPwd,
 		privAlg: privAlg,
 		privPwd: privPwd,
+
+		ReportRetries: 1,
 	}, nil
 }
 
+// validateV3Credentials checks the algorithms and passwords of an SNMP V3 user.
+func validateV3Credentials(authAlg, authPwd, privAlg, privPwd string) error {
+	if _, ok := authHashes[authAlg]; !ok {
+		return fmt.Errorf(`Invalid auth algorithm %s, needs one of %s`, authAlg, strings.Join(SupportedAuthAlgorithms(), ", "))
+	}
+	if _, ok := privKeyLengths[privAlg]; !ok {
+		return fmt.Errorf(`Invalid priv algorithm %s, needs one of %s`, privAlg, strings.Join(SupportedPrivAlgorithms(), ", "))
+	}
+	if len(authPwd) < minPasswordLen {
+		return fmt.Errorf(`Invalid auth password, needs at least %d characters`, minPasswordLen)
+	}
+	if len(privPwd) < minPasswordLen {
+		return fmt.Errorf(`Invalid priv password, needs at least %d characters`, minPasswordLen)
+	}
+	return nil
+}
+
 // NewSNMPOnConn creates a new SNMP object from an existing net.Conn. It does not check if the provided target is valid.
+// conn can be a TCP connection, as in RFC 3430: responses are then reassembled from the stream.
 func NewSNMPOnConn(target, community string, version SNMPVersion, timeout time.Duration, retries int, conn net.Conn) *SNMP {
 	return &SNMP{
 		Target:    target,
@@ -150,49 +358,310 @@ func NewSNMPOnConn(target, community string, version SNMPVersion, timeout time.D
 		timeout:   timeout,
 		retries:   retries,
 		conn:      conn,
+		stats:     &Stats{},
+		mu:        &sync.Mutex{},
+		created:   time.Now(),
+
+		ReportRetries: 1,
+	}
+}
+
+// Clone creates a new SNMP object to the same target with the same settings and credentials, on a new
+// connection of its own. The per-request state isn't copied, so an SNMPv3 clone has to Discover again
+// before sending requests.
+func (w *SNMP) Clone() (*SNMP, error) {
+	conn, err := dial(net.Dialer{Timeout: w.dialTimeout()}, w.local, w.Target, w.port)
+	if err != nil {
+		return nil, err
+	}
+	return &SNMP{
+		Target:    w.Target,
+		Community: w.Community,
+		Version:   w.Version,
+		timeout:   w.timeout,
+		retries:   w.retries,
+		local:     w.local,
+		port:      w.port,
+		conn:      conn,
+		stats:     &Stats{},
+		mu:        &sync.Mutex{},
+		user:      w.user,
+		authAlg:   w.authAlg,
+		authPwd:   w.authPwd,
+		privAlg:   w.privAlg,
+		privPwd:   w.privPwd,
+		TrapUsers: append([]V3user(nil), w.TrapUsers...),
+
+		DecodeLimits:  w.DecodeLimits,
+		ReportRetries: w.ReportRetries,
+		ContextName:   w.ContextName,
+		StartTime:     w.StartTime,
+		created:       w.created,
+		OnSend:        w.OnSend,
+		OnRecv:        w.OnRecv,
+
+		ResponseBufferSize:    w.ResponseBufferSize,
+		FallbackCommunity:     w.FallbackCommunity,
+		Rand:                  w.Rand,
+		IgnoreContextMismatch: w.IgnoreContextMismatch,
+		DialTimeout:           w.DialTimeout,
+	}, nil
+}
+
+// dialTimeout returns the DialTimeout of the object, or its default.
+func (w SNMP) dialTimeout() time.Duration {
+	if w.DialTimeout > 0 {
+		return w.DialTimeout
 	}
+	return defaultDialTimeout
 }
 
-// Generate a valid SNMP request ID.
-func getRandomRequestID() int {
-	return int(rand.Int31())
+// requestIDsMatch tells whether received echoes the request ID sent. Request IDs are 32 bits, but agents
+// encoding them as unsigned make the decoder sign-extend IDs with the high bit set, so only the low 32 bits
+// are compared.
+func requestIDsMatch(sent, received int) bool {
+	return uint32(sent) == uint32(received)
 }
 
-// poll sends a packet and wait for a response. Both operations can timeout, they're retried up to retries times.
-func poll(conn net.Conn, toSend []byte, respondBuffer []byte, retries int, timeout time.Duration) (int, error) {
+// poll sends a packet and wait for a response. Both operations can timeout, they're retried up to retries times:
+// 0 sends the packet once, 2 up to three times, and a negative retries sends it again until ctx is done. As
+// that would be forever for a ctx that can't be cancelled, negative retries are 0 for those.
+// Other errors, e.g. a connection refused by the target host or a closed connection, won't go away by
+// sending again, they end the attempts at once.
+// ctx is checked before each attempt, so a cancellation takes effect within timeout.
+// The attempts are counted in stats, which can be nil.
+// When all the attempts fail, the error is a *NoResponseError wrapping the last one, or the error of ctx.
+func poll(ctx context.Context, conn net.Conn, toSend []byte, respondBuffer []byte, retries int, timeout time.Duration,
+	stats *Stats, onSend, onRecv func([]byte)) (int, error) {
 	var err error
-	for i := 0; i < retries+1; i++ {
+	if retries < 0 && ctx.Done() == nil {
+		retries = 0
+	}
+	stats.countRequest()
+	sentID, idErr := messageID(toSend)
+	i := 0
+	for ; retries < 0 || i < retries+1; i++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+			break
+		}
+		if i > 0 {
+			stats.countRetry()
+		}
 		deadline := time.Now().Add(timeout)
 
 		if err = conn.SetWriteDeadline(deadline); err != nil {
-			log.Printf("Couldn't set write deadline. Retrying. Retry %d/%d\n", i, retries)
-			continue
+			log.Printf("Couldn't set write deadline: %v\n", err)
+			i++
+			break
 		}
 		if _, err = conn.Write(toSend); err != nil {
+			if !isTimeout(err) {
+				log.Printf("Couldn't write: %v\n", err)
+				i++
+				break
+			}
 			log.Printf("Couldn't write. Retrying. Retry %d/%d\n", i, retries)
 			continue
 		}
+		if onSend != nil {
+			onSend(append([]byte(nil), toSend...))
+		}
 
 		deadline = time.Now().Add(timeout)
 		if err = conn.SetReadDeadline(deadline); err != nil {
-			log.Printf("Couldn't set read deadline. Retrying. Retry %d/%d\n", i, retries)
-			continue
+			log.Printf("Couldn't set read deadline: %v\n", err)
+			i++
+			break
 		}
 
 		numRead := 0
-		if numRead, err = conn.Read(respondBuffer); err != nil {
+		if numRead, err = readResponse(conn, respondBuffer, sentID, idErr == nil); err != nil {
+			if !isTimeout(err) {
+				log.Printf("Couldn't read: %v\n", err)
+				i++
+				break
+			}
+			stats.countTimeout()
 			log.Printf("Couldn't read. Retrying. Retry %d/%d\n", i, retries)
 			continue
 		}
+		if onRecv != nil {
+			onRecv(append([]byte(nil), respondBuffer[:numRead]...))
+		}
+		if numRead == len(respondBuffer) && !isStream(conn) {
+			// The datagram was likely longer, and the rest was lost: sending again would be answered the same.
+			return 0, fmt.Errorf("%w, it filled the %d bytes buffer", ErrResponseTruncated, numRead)
+		}
 
 		return numRead, nil
 	}
-	return 0, err
+	if isTimeout(err) {
+		err = &TimeoutError{err}
+	}
+	target := "agent"
+	if addr := conn.RemoteAddr(); addr != nil {
+		target = addr.String()
+	}
+	return 0, &NoResponseError{Target: target, Attempts: i, Err: err}
+}
+
+// readResponse reads the response to the request sentID identifies. Late responses to previous requests,
+// whose ID doesn't match, are discarded and the reading goes on until the deadline of conn. Responses
+// without an ID are returned as they are, for the caller to report them; so are all of them when
+// checkID is false, i.e. the request has no ID to compare to.
+func readResponse(conn net.Conn, buf []byte, sentID int, checkID bool) (int, error) {
+	for {
+		numRead, err := readMessage(conn, buf)
+		if err != nil || !checkID {
+			return numRead, err
+		}
+		if id, err := messageID(buf[:numRead]); err == nil && !requestIDsMatch(sentID, id) {
+			log.Printf("Discarding response to request %d, expected %d\n", id, sentID)
+			continue
+		}
+		return numRead, nil
+	}
+}
+
+// isTimeout tells whether err is a timeout of the connection, which sending again may not run into.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
-// Get sends an SNMP get request requesting the value for an oid.
+// Drain discards the packets queued on the connection, e.g. late responses to requests that timed out.
+// Requests skip the responses to other requests, so this is only needed when reading the connection directly.
+// It's a no-op on Windows.
+func (w SNMP) Drain() error {
+	defer w.lock()()
+	_, err := drainSocket(w.conn)
+	return err
+}
+
+// isStream tells whether conn is a stream, e.g. TCP, rather than a datagram connection.
+func isStream(conn net.Conn) bool {
+	addr := conn.LocalAddr()
+	return addr != nil && strings.HasPrefix(addr.Network(), "tcp")
+}
+
+// readMessage reads a message from conn into buf. A datagram is a whole message, but on a stream one can
+// arrive in several reads, so it's read until the length its BER header gives, as RFC 3430 frames them.
+func readMessage(conn net.Conn, buf []byte) (int, error) {
+	if !isStream(conn) {
+		return conn.Read(buf)
+	}
+	// Read the type and the first length byte, then the rest of the length, then the value, never past
+	// the message so the next one stays in the stream.
+	numRead, need := 0, 2
+	for numRead < need {
+		if need > len(buf) {
+			return numRead, fmt.Errorf("message of %d bytes is larger than the %d bytes buffer", need, len(buf))
+		}
+		n, err := conn.Read(buf[numRead:need])
+		numRead += n
+		if err != nil {
+			return numRead, err
+		}
+		if numRead < need {
+			continue
+		}
+		switch {
+		case need == 2 && buf[1] < 0x80:
+			need = 2 + int(buf[1])
+		case need == 2:
+			lenLen := int(buf[1] & 0x7f)
+			if lenLen == 0 || lenLen > 3 {
+				return numRead, fmt.Errorf("invalid message length of %d bytes", lenLen)
+			}
+			need = 2 + lenLen
+		case buf[1] >= 0x80 && need == 2+int(buf[1]&0x7f):
+			length, err := DecodeUnsigned(buf[2:need])
+			if err != nil {
+				return numRead, err
+			}
+			need += length
+		}
+	}
+	return numRead, nil
+}
+
+// WithContext returns a copy of the object whose requests give up when ctx is done. The copy shares the
+// connection, so closing either closes both. With negative retries, ctx is the only limit to the retries.
+func (w SNMP) WithContext(ctx context.Context) *SNMP {
+	w.ctx = ctx
+	return &w
+}
+
+// context returns the context of the requests, set by WithContext.
+func (w SNMP) context() context.Context {
+	if w.ctx == nil {
+		return context.Background()
+	}
+	return w.ctx
+}
+
+// responseBufferSize returns ResponseBufferSize, or its default.
+func (w SNMP) responseBufferSize() int {
+	if w.ResponseBufferSize <= 0 {
+		return bufSize
+	}
+	return w.ResponseBufferSize
+}
+
+// newResponseBuffer returns a buffer to read a response in.
+func (w SNMP) newResponseBuffer() []byte {
+	return make([]byte, w.responseBufferSize())
+}
+
+// lock locks the requests on the connection, so they don't mix with the keepalive ones, and returns the
+// function unlocking them. Objects built without a mutex aren't locked.
+func (w SNMP) lock() func() {
+	if w.mu == nil {
+		return func() {}
+	}
+	w.mu.Lock()
+	return w.mu.Unlock
+}
+
+// decodeResponse decodes a response packet, counting the failures in the stats.
+func (w SNMP) decodeResponse(response []byte) ([]interface{}, error) {
+	decoded, err := DecodeSequenceWithLimits(response, w.DecodeLimits)
+	if err == nil {
+		err = checkTrailingBytes(response)
+	}
+	if err != nil {
+		w.stats.countDecodeError()
+		return nil, &DecodeError{err}
+	}
+	return decoded, nil
+}
+
+// checkTrailingBytes checks the bytes following the message in a response, which must be decodable. Some
+// agents pad their responses with zeros, which are ignored, anything else is garbage.
+func checkTrailingBytes(response []byte) error {
+	length, lenLen, err := DecodeLength(response[1:])
+	if err != nil {
+		return err
+	}
+	for idx := 1 + lenLen + length; idx < len(response); idx++ {
+		if response[idx] != 0 {
+			return fmt.Errorf("%d bytes of trailing garbage after the message", len(response)-1-lenLen-length)
+		}
+	}
+	return nil
+}
+
+// Stats returns a snapshot of the counters for the requests sent so far.
+func (w SNMP) Stats() StatsSnapshot {
+	return w.stats.Snapshot()
+}
+
+// Get sends an SNMP get request requesting the value for an oid. If the agent answers without any varbind,
+// the value is nil.
 func (w SNMP) Get(oid Oid) (interface{}, error) {
-	requestID := getRandomRequestID()
+	defer w.lock()()
+	requestID := w.requestID()
 	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
 		[]interface{}{AsnGetRequest, requestID, 0, 0,
 			[]interface{}{Sequence,
@@ -201,28 +670,30 @@ func (w SNMP) Get(oid Oid) (interface{}, error) {
 		return nil, err
 	}
 
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, 500*time.Millisecond)
+	response := w.newResponseBuffer()
+	numRead, err := poll(w.context(), w.conn, req, response, w.retries, 500*time.Millisecond, w.stats, w.OnSend, w.OnRecv)
 	if err != nil {
 		return nil, err
 	}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
+	msg, err := w.decodeMessage(response[:numRead])
 	if err != nil {
 		return nil, err
 	}
-
-	// Fetch the varbinds out of the packet.
-	respPacket := decodedResponse[3].([]interface{})
-	varbinds := respPacket[4].([]interface{})
-	result := varbinds[1].([]interface{})[2]
-
-	return result, nil
+	if err := msg.PDU.errorStatus(); err != nil {
+		return nil, err
+	}
+	if len(msg.PDU.VarBinds) == 0 {
+		// No varbind at all, there's no value to return.
+		return nil, nil
+	}
+	return msg.PDU.VarBinds[0].Value, nil
 }
 
 // GetMultiple issues a single GET SNMP request requesting multiple values
 func (w SNMP) GetMultiple(oids []Oid) (map[string]interface{}, error) {
-	requestID := getRandomRequestID()
+	defer w.lock()()
+	requestID := w.requestID()
 
 	varbinds := []interface{}{Sequence}
 	for _, oid := range oids {
@@ -235,78 +706,499 @@ func (w SNMP) GetMultiple(oids []Oid) (map[string]interface{}, error) {
 		return nil, err
 	}
 
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, 500*time.Millisecond)
+	response := w.newResponseBuffer()
+	numRead, err := poll(w.context(), w.conn, req, response, w.retries, 500*time.Millisecond, w.stats, w.OnSend, w.OnRecv)
 	if err != nil {
 		return nil, err
 	}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
+	msg, err := w.decodeMessage(response[:numRead])
 	if err != nil {
 		return nil, err
 	}
-
-	// Find the varbinds
-	respPacket := decodedResponse[3].([]interface{})
-	respVarbinds := respPacket[4].([]interface{})
+	if err := msg.PDU.errorStatus(); err != nil {
+		return nil, err
+	}
 
 	result := make(map[string]interface{})
-	for _, v := range respVarbinds[1:] { // First element is just a sequence
-		oid := v.([]interface{})[1].(Oid).String()
-		value := v.([]interface{})[2]
-		result[oid] = value
+	for _, varbind := range msg.PDU.VarBinds {
+		result[varbind.Oid.String()] = varbind.Value
+	}
+
+	return result, nil
+}
+
+// GetMultipleOrdered is GetMultiple, but returns the varbinds in the order of oids, so they can be zipped
+// with them. Agents answer in the request order, but the varbinds are matched by oid anyway, in case one
+// reorders them. An oid the agent left out of its response has a nil value.
+func (w SNMP) GetMultipleOrdered(oids []Oid) ([]VarBind, error) {
+	resp, err := w.GetRaw(oids)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ErrorStatus != 0 {
+		return nil, &PDUError{ErrorStatus: resp.ErrorStatus, ErrorIndex: resp.ErrorIndex}
 	}
 
+	result := make([]VarBind, len(oids))
+	for idx, oid := range oids {
+		result[idx] = VarBind{Oid: oid}
+		if idx < len(resp.VarBinds) && resp.VarBinds[idx].Oid.Equal(oid) {
+			result[idx] = resp.VarBinds[idx]
+			continue
+		}
+		for _, varbind := range resp.VarBinds {
+			if varbind.Oid.Equal(oid) {
+				result[idx] = varbind
+				break
+			}
+		}
+	}
 	return result, nil
 }
 
+// VarBind is a single oid and value pair of a PDU.
+type VarBind struct {
+	Oid   Oid
+	Value interface{}
+}
+
+// String formats the varbind the way net-snmp's snmpwalk -On does, as in
+// ".1.3.6.1.2.1.1.5.0 = STRING: \"router\"".
+//
+// Counter32 and Gauge32 values are decoded as plain ints, so they're shown as INTEGER.
+func (v VarBind) String() string {
+	var value string
+	switch val := v.Value.(type) {
+	case nil:
+		value = "NULL"
+	case int:
+		value = fmt.Sprintf("INTEGER: %d", val)
+	case uint64:
+		value = fmt.Sprintf("Counter64: %d", val)
+	case Oid:
+		value = fmt.Sprintf("OID: %v", val)
+	case time.Duration:
+		ticks := int64(val / (10 * time.Millisecond))
+		days := ticks / 8640000
+		dayStr := ""
+		switch {
+		case days == 1:
+			dayStr = "1 day, "
+		case days > 1:
+			dayStr = fmt.Sprintf("%d days, ", days)
+		}
+		value = fmt.Sprintf("Timeticks: (%d) %s%d:%02d:%02d.%02d", ticks, dayStr,
+			ticks/360000%24, ticks/6000%60, ticks/100%60, ticks%100)
+	case string:
+		printable := true
+		for _, c := range []byte(val) {
+			if (c < 0x20 || c > 0x7e) && c != '\n' && c != '\r' && c != '\t' {
+				printable = false
+				break
+			}
+		}
+		if printable {
+			value = fmt.Sprintf("STRING: \"%s\"", val)
+		} else {
+			value = "Hex-STRING: "
+			for _, c := range []byte(val) {
+				value += fmt.Sprintf("%02X ", c)
+			}
+		}
+	case Exception:
+		switch val {
+		case NoSuchObject:
+			return fmt.Sprintf("%v = No Such Object available on this agent at this OID", v.Oid)
+		case NoSuchInstance:
+			return fmt.Sprintf("%v = No Such Instance currently exists at this OID", v.Oid)
+		case EndOfMibView:
+			return fmt.Sprintf("%v = No more variables left in this MIB View (It is past the end of the MIB tree)", v.Oid)
+		}
+		value = val.String()
+	default:
+		value = fmt.Sprintf("%v", val)
+	}
+	return fmt.Sprintf("%v = %s", v.Oid, value)
+}
+
+// Response is a decoded response PDU.
+type Response struct {
+	RequestID   int
+	ErrorStatus int
+	ErrorIndex  int
+	VarBinds    []VarBind
+}
+
+// decodeResponsePDU turns a decoded PDU into a Response, checking the types as it goes.
+func decodeResponsePDU(pdu []interface{}) (*Response, error) {
+	if len(pdu) < 5 {
+		return nil, fmt.Errorf("invalid response PDU length %d", len(pdu))
+	}
+	requestID, ok1 := pdu[1].(int)
+	errorStatus, ok2 := pdu[2].(int)
+	errorIndex, ok3 := pdu[3].(int)
+	varbinds, ok4 := pdu[4].([]interface{})
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return nil, fmt.Errorf("invalid response PDU %v", pdu)
+	}
+
+	resp := &Response{RequestID: requestID, ErrorStatus: errorStatus, ErrorIndex: errorIndex}
+	for _, v := range varbinds[1:] { // First element is just a sequence
+		varbind, ok := v.([]interface{})
+		if !ok || len(varbind) < 3 {
+			return nil, fmt.Errorf("invalid varbind %v", v)
+		}
+		oid, ok := varbind[1].(Oid)
+		if !ok {
+			return nil, fmt.Errorf("invalid varbind oid %v", varbind[1])
+		}
+		resp.VarBinds = append(resp.VarBinds, VarBind{Oid: oid, Value: varbind[2]})
+	}
+	return resp, nil
+}
+
+// GetRaw issues a single GET SNMP request for oids and returns the whole response PDU, error status and
+// all varbinds included. Use it when the typed helpers like Get or GetMultiple hide what you need.
+func (w SNMP) GetRaw(oids []Oid) (*Response, error) {
+	msg, _, err := w.get(oids)
+	if err != nil {
+		return nil, err
+	}
+	return &msg.PDU, nil
+}
+
+// SendRaw sends request as is, retrying as the other requests do, and returns the raw response, e.g. to
+// reproduce an interoperability issue with a hand-crafted PDU. The caller is responsible for request being
+// a valid BER encoded message, and for decoding the response, e.g. with DecodeMessage.
+func (w SNMP) SendRaw(request []byte) ([]byte, error) {
+	defer w.lock()()
+	response := w.newResponseBuffer()
+	numRead, err := poll(w.context(), w.conn, request, response, w.retries, 500*time.Millisecond, w.stats, w.OnSend, w.OnRecv)
+	if err != nil {
+		return nil, err
+	}
+	return response[:numRead], nil
+}
+
+// TypedValue is a value with the BER type the agent sent it with.
+type TypedValue struct {
+	Type  BERType
+	Value interface{}
+}
+
+// GetTyped is Get, but also returns the BER type of the value, e.g. to tell a Gauge32 from an INTEGER. If
+// the agent answers without any varbind, the type is Null.
+func (w SNMP) GetTyped(oid Oid) (BERType, interface{}, error) {
+	msg, raw, err := w.get([]Oid{oid})
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := msg.PDU.errorStatus(); err != nil {
+		return 0, nil, err
+	}
+	if len(msg.PDU.VarBinds) == 0 {
+		return Null, nil, nil
+	}
+	types, err := DecodeVarBindTypes(raw)
+	if err != nil || len(types) != len(msg.PDU.VarBinds) {
+		return 0, nil, &DecodeError{fmt.Errorf("varbind types %v: %v", types, err)}
+	}
+	return types[0], msg.PDU.VarBinds[0].Value, nil
+}
+
+// get issues a single GET SNMP request for oids, and returns the response both decoded and raw.
+func (w SNMP) get(oids []Oid) (*Message, []byte, error) {
+	defer w.lock()()
+	requestID := w.requestID()
+
+	varbinds := []interface{}{Sequence}
+	for _, oid := range oids {
+		varbinds = append(varbinds, []interface{}{Sequence, oid, nil})
+	}
+	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
+		[]interface{}{AsnGetRequest, requestID, 0, 0, varbinds}})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	response := w.newResponseBuffer()
+	numRead, err := poll(w.context(), w.conn, req, response, w.retries, 500*time.Millisecond, w.stats, w.OnSend, w.OnRecv)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := w.decodeMessage(response[:numRead])
+	if err != nil {
+		return nil, nil, err
+	}
+	return msg, response[:numRead], nil
+}
+
+// Set issues a SET SNMP request writing value to oid. Wrap the value in a typed value, e.g. Unsigned32 or
+// TimeTicks, when the object isn't an INTEGER or an OCTET STRING. The agent refusing the write is
+// returned as a *PDUError.
+func (w SNMP) Set(oid Oid, value interface{}) error {
+	return w.SetMultiple([]VarBind{{oid, value}})
+}
+
+// SetMultiple issues a single SET SNMP request writing all the varbinds, which the agent applies all
+// together or not at all. Each value is encoded with its own type, like in Set, so e.g. an OCTET STRING
+// and an INTEGER can be written at once.
+func (w SNMP) SetMultiple(varbinds []VarBind) error {
+	defer w.lock()()
+	requestID := w.requestID()
+	varbindList := []interface{}{Sequence}
+	for _, varbind := range varbinds {
+		varbindList = append(varbindList, []interface{}{Sequence, varbind.Oid, varbind.Value})
+	}
+	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
+		[]interface{}{AsnSetRequest, requestID, 0, 0, varbindList}})
+	if err != nil {
+		return err
+	}
+
+	response := w.newResponseBuffer()
+	numRead, err := poll(w.context(), w.conn, req, response, w.retries, 500*time.Millisecond, w.stats, w.OnSend, w.OnRecv)
+	if err != nil {
+		return err
+	}
+
+	msg, err := w.decodeMessage(response[:numRead])
+	if err != nil {
+		return err
+	}
+	return msg.PDU.errorStatus()
+}
+
+// SetGuarded sets setOid to setVal, guarded by serialOid, a TestAndIncr object such as snmpSetSerialNo.0,
+// so that the write is rejected if another manager wrote in between. It gets the serial, then sets it back
+// to the value read along with setOid in a single request: the agent only accepts the serial if it didn't
+// change, and increments it. If it changed, the serial is read and the request sent once more.
+func (w SNMP) SetGuarded(setOid Oid, setVal interface{}, serialOid Oid) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var serial interface{}
+		if serial, err = w.Get(serialOid); err != nil {
+			return err
+		}
+		if _, ok := serial.(int); !ok {
+			return fmt.Errorf("serial %v is %v, expected an INTEGER", serialOid, serial)
+		}
+		err = w.SetMultiple([]VarBind{{serialOid, serial}, {setOid, setVal}})
+		// inconsistentValue on the serial, another manager incremented it.
+		if pduErr, ok := err.(*PDUError); !ok || pduErr.ErrorStatus != 12 || pduErr.ErrorIndex != 1 {
+			return err
+		}
+		log.Printf("Serial %v changed while setting %v. Retrying\n", serialOid, setOid)
+	}
+	return err
+}
+
+// Message is a decoded v1 or v2c message.
+type Message struct {
+	Version   SNMPVersion
+	Community string
+	PDUType   BERType // AsnGetResponse, AsnGetRequest, AsnTrap2, ...
+	PDU       Response
+}
+
+// messageFromSequence turns a decoded v1 or v2c message into a Message, checking the types as it goes.
+func messageFromSequence(decoded []interface{}) (*Message, error) {
+	if len(decoded) < 4 {
+		return nil, fmt.Errorf("invalid message length %d", len(decoded))
+	}
+	version, ok1 := decoded[1].(int)
+	community, ok2 := decoded[2].(string)
+	pdu, ok3 := decoded[3].([]interface{})
+	if !ok1 || !ok2 || !ok3 {
+		return nil, fmt.Errorf("invalid message %v", decoded)
+	}
+	resp, err := decodeResponsePDU(pdu)
+	if err != nil {
+		return nil, err
+	}
+	pduType, _ := pdu[0].(BERType)
+	return &Message{Version: SNMPVersion(version), Community: community, PDUType: pduType, PDU: *resp}, nil
+}
+
+// DecodeMessage decodes a v1 or v2c SNMP packet into a Message, without sending anything. Like DecodePacket,
+// it doesn't work for v1 traps.
+func DecodeMessage(data []byte) (*Message, error) {
+	decoded, err := DecodeSequence(data)
+	if err != nil {
+		return nil, &DecodeError{err}
+	}
+	msg, err := messageFromSequence(decoded)
+	if err != nil {
+		return nil, &DecodeError{err}
+	}
+	return msg, nil
+}
+
+// decodeMessage decodes a v1 or v2c response packet, counting the failures in the stats.
+func (w SNMP) decodeMessage(response []byte) (*Message, error) {
+	decoded, err := w.decodeResponse(response)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := messageFromSequence(decoded)
+	if err != nil {
+		w.stats.countDecodeError()
+		return nil, &DecodeError{err}
+	}
+	return msg, nil
+}
+
+// errorStatus returns a PDUError if the response reports an error.
+func (r *Response) errorStatus() error {
+	if r.ErrorStatus != 0 {
+		return &PDUError{ErrorStatus: r.ErrorStatus, ErrorIndex: r.ErrorIndex}
+	}
+	return nil
+}
+
+// DecodePacket decodes a v1 or v2c SNMP packet, as captured from the network, without sending anything.
+// It works for any PDU laid out like a response (GetRequest, GetResponse, v2 traps, ...), not for v1 traps.
+// Useful to build test fixtures or analyze captures.
+func DecodePacket(data []byte) (*Response, error) {
+	msg, err := DecodeMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	return &msg.PDU, nil
+}
+
+// DecodeTrap decodes a v1 or v2c trap, as captured from the network, without sending anything. Decoding v3
+// traps needs the users' credentials, use ParseTrap on an SNMP object with TrapUsers for them.
+func DecodeTrap(data []byte) (Trap, error) {
+	return SNMP{}.ParseTrap(data)
+}
+
 // Discover : SNMP V3 requires a discover packet being sent before a request being sent,
 // so that agent's engineID and other parameters can be automatically detected.
+//
+// Discover is idempotent: once the engine is known and the keys localized, it returns without sending
+// anything, keeping the privacy salts going. Use ForceDiscover to probe the agent again.
 func (w *SNMP) Discover() error {
-	msgID := getRandomRequestID()
-	requestID := getRandomRequestID()
-	v3Header, _ := EncodeSequence([]interface{}{Sequence, "", 0, 0, "", "", ""})
-	flags := string([]byte{4})
-	USM := 0x03
-	req, err := EncodeSequence([]interface{}{
-		Sequence, int(w.Version),
-		[]interface{}{Sequence, msgID, maxMsgSize, flags, USM},
-		string(v3Header),
-		[]interface{}{Sequence, "", "",
-			[]interface{}{AsnGetRequest, requestID, 0, 0, []interface{}{Sequence}}}})
+	if w.discovered() {
+		return nil
+	}
+	return w.ForceDiscover()
+}
+
+// discovered tells whether the engine ID is known and the keys localized for it.
+func (w *SNMP) discovered() bool {
+	defer w.lock()()
+	return w.engineID != "" && w.authKey != "" && w.privKey != ""
+}
+
+// ForceDiscover sends the discovery probe even if the engine is known, e.g. after the agent was replaced.
+// It seeds the privacy salts and localizes the keys again.
+//
+// Per RFC 3414, the agent's report to this unauthenticated probe only has to carry its engine ID. Its
+// engine boots and time come with the report to an authenticated request outside the time window, so when
+// they're both zero a second probe, a GET of sysUpTime.0, is sent to synchronize them.
+func (w *SNMP) ForceDiscover() error {
+	unsynchronized, err := w.discover()
+	if err != nil || !unsynchronized {
+		return err
+	}
+	_, _, err = w.doGetV3Once(sysUpTime, AsnGetRequest)
+	if _, ok := err.(*ReportError); err != nil && !ok {
+		return fmt.Errorf("synchronizing engine time: %v", err)
+	}
+	return nil
+}
+
+// discover sends the discovery probe, and tells whether the engine boots and time are still unknown.
+func (w *SNMP) discover() (bool, error) {
+	defer w.lock()()
+	requestID := w.requestID()
+	// The probe is unauthenticated, with an empty engine ID and user.
+	probe := SNMP{Rand: w.Rand}
+	req, _, err := probe.buildV3Message(0, "", "",
+		[]interface{}{AsnGetRequest, requestID, 0, 0, []interface{}{Sequence}})
 	if err != nil {
-		fmt.Printf("Error encoding in discover:%v\n", err)
-		panic(err)
+		return false, err
 	}
 
-	response := make([]byte, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, 500*time.Millisecond)
+	response := w.newResponseBuffer()
+	numRead, err := poll(w.context(), w.conn, req, response, w.retries, 500*time.Millisecond, w.stats, w.OnSend, w.OnRecv)
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
+	decodedResponse, err := w.decodeResponse(response[:numRead])
+	if err != nil {
+		return false, err
+	}
+	params, err := w.securityParamsOf(decodedResponse)
 	if err != nil {
-		fmt.Printf("Error decoding discover:%v\n", err)
-		panic(err)
+		return false, err
 	}
 
-	v3HeaderStr := decodedResponse[3].(string)
-	v3HeaderDecoded, err := DecodeSequence([]byte(v3HeaderStr))
+	w.engineID = params.engineID
+	w.engineBoots = int32(params.engineBoots)
+	w.engineTime = int32(params.engineTime)
+	w.engineTimeAt = time.Now()
+	if err := w.localizeKeys(); err != nil {
+		return false, err
+	}
+	return w.engineBoots == 0 && w.engineTime == 0, nil
+}
+
+// usmSecurityParams are the security parameters of an SNMP V3 message, from RFC 3414.
+type usmSecurityParams struct {
+	engineID    string
+	engineBoots int
+	engineTime  int
+	user        string
+	authParam   string
+	privParam   string
+}
+
+// securityParamsOf decodes the security parameters of a decoded SNMP V3 message.
+func (w SNMP) securityParamsOf(decoded []interface{}) (usmSecurityParams, error) {
+	var params usmSecurityParams
+	if len(decoded) < 5 {
+		return params, &DecodeError{fmt.Errorf("invalid v3 message length %d", len(decoded))}
+	}
+	encoded, ok := decoded[3].(string)
+	if !ok {
+		return params, &DecodeError{fmt.Errorf("invalid v3 security parameters %v", decoded[3])}
+	}
+	fields, err := DecodeSequenceWithLimits([]byte(encoded), w.DecodeLimits)
 	if err != nil {
-		fmt.Printf("Error 2 decoding:%v\n", err)
-		return err
+		return params, &DecodeError{err}
+	}
+	if len(fields) < 7 {
+		return params, &DecodeError{fmt.Errorf("invalid v3 security parameters length %d", len(fields))}
 	}
+	var ok1, ok2, ok3, ok4, ok5, ok6 bool
+	params.engineID, ok1 = fields[1].(string)
+	params.engineBoots, ok2 = fields[2].(int)
+	params.engineTime, ok3 = fields[3].(int)
+	params.user, ok4 = fields[4].(string)
+	params.authParam, ok5 = fields[5].(string)
+	params.privParam, ok6 = fields[6].(string)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || !ok6 {
+		return params, &DecodeError{fmt.Errorf("invalid v3 security parameters %v", fields[1:])}
+	}
+	return params, nil
+}
 
-	w.engineID = v3HeaderDecoded[1].(string)
-	w.engineBoots = int32(v3HeaderDecoded[2].(int))
-	w.engineTime = int32(v3HeaderDecoded[3].(int))
-	w.aesIV = rand.Int63()
-	w.desIV = rand.Uint32()
-	//keys
-	w.authKey = passwordToKey(w.authPwd, w.engineID, w.authAlg)
-	privKey := passwordToKey(w.privPwd, w.engineID, w.authAlg)
-	w.privKey = string(([]byte(privKey))[0:16])
+// localizeKeys derives the keys of the user for engineID, the authoritative engine, and picks new salts.
+func (w *SNMP) localizeKeys() error {
+	var err error
+	w.aesIV = w.random().Int63()
+	w.desIV = uint32(w.random().Int63())
+	if w.authKey, err = passwordToKey(w.authPwd, w.engineID, w.authAlg); err != nil {
+		return fmt.Errorf("auth key: %v", err)
+	}
+	if w.privKey, err = privPasswordToKey(w.privPwd, w.engineID, w.authAlg, w.privAlg); err != nil {
+		return fmt.Errorf("priv key: %v", err)
+	}
 	return nil
 }
 
@@ -330,6 +1222,26 @@ func decryptDESCBC(dst, src, key, iv []byte) error {
 	return nil
 }
 
+func encrypt3DESCBC(dst, src, key, iv []byte) error {
+	desBlockEncrypter, err := des.NewTripleDESCipher([]byte(key))
+	if err != nil {
+		return err
+	}
+	desEncrypter := cipher.NewCBCEncrypter(desBlockEncrypter, iv)
+	desEncrypter.CryptBlocks(dst, src)
+	return nil
+}
+
+func decrypt3DESCBC(dst, src, key, iv []byte) error {
+	desBlockEncrypter, err := des.NewTripleDESCipher([]byte(key))
+	if err != nil {
+		return err
+	}
+	desDecrypter := cipher.NewCBCDecrypter(desBlockEncrypter, iv)
+	desDecrypter.CryptBlocks(dst, src)
+	return nil
+}
+
 func encryptAESCFB(dst, src, key, iv []byte) error {
 	aesBlockEncrypter, err := aes.NewCipher([]byte(key))
 	if err != nil {
@@ -343,7 +1255,7 @@ func encryptAESCFB(dst, src, key, iv []byte) error {
 func decryptAESCFB(dst, src, key, iv []byte) error {
 	aesBlockDecrypter, err := aes.NewCipher([]byte(key))
 	if err != nil {
-		return nil
+		return err
 	}
 	aesDecrypter := cipher.NewCFBDecrypter(aesBlockDecrypter, iv)
 	aesDecrypter.XORKeyStream(dst, src)
@@ -370,10 +1282,8 @@ func (w SNMP) auth(wholeMsg string) string {
 	opad := strings.Repeat("\x5C", 64)
 	k1 := strXor(eAuthKey, ipad)
 	k2 := strXor(eAuthKey, opad)
-	h := sha1.New()
-	if w.authAlg == "MD5" {
-		h = md5.New()
-	}
+	// The keys were localized with the same algorithm, so it's supported.
+	h, _ := newAuthHash(w.authAlg)
 	io.WriteString(h, k1+wholeMsg)
 	tmp1 := string(h.Sum(nil))
 	h.Reset()
@@ -382,21 +1292,31 @@ func (w SNMP) auth(wholeMsg string) string {
 	return msgAuthParam
 }
 
-func (w SNMP) encrypt(payload string) (string, string, error) {
+// buildAESIV builds the IV of AES privacy from the engine boots and time and the 8 bytes salt, per
+// RFC 3826. It's the same for every key size, AES-192 and AES-256 only differ from AES-128 by the
+// length of the localized key.
+func buildAESIV(engineBoots, engineTime int32, salt string) []byte {
+	iv := make([]byte, 8, 16)
+	binary.BigEndian.PutUint32(iv, uint32(engineBoots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(engineTime))
+	return append(iv, salt...)
+}
+
+// encrypt encrypts payload with the next privacy salt, and returns it with the privacy parameters. The
+// salts advance on w, whose lock the caller holds, so that they're never reused.
+func (w *SNMP) encrypt(payload string) (string, string, error) {
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, w.engineBoots)
 	if w.privAlg == SnmpAES {
-		buf2 := new(bytes.Buffer)
-		binary.Write(buf2, binary.BigEndian, w.engineTime)
 		buf3 := new(bytes.Buffer)
 		w.aesIV++
 		binary.Write(buf3, binary.BigEndian, w.aesIV)
 		privParam := string(buf3.Bytes())
-		iv := string(buf.Bytes()) + string(buf2.Bytes()) + privParam
+		iv := buildAESIV(w.engineBoots, w.engineTime, privParam)
 
 		// AES Encrypt
 		encrypted := make([]byte, len(payload))
-		err := encryptAESCFB(encrypted, []byte(payload), []byte(w.privKey), []byte(iv))
+		err := encryptAESCFB(encrypted, []byte(payload), []byte(w.privKey), iv)
 		if err != nil {
 			return "", "", err
 		}
@@ -405,6 +1325,12 @@ func (w SNMP) encrypt(payload string) (string, string, error) {
 
 	desKey := w.privKey[:8]
 	preIV := w.privKey[8:16]
+	encryptCBC := encryptDESCBC
+	if w.privAlg == SnmpDES3 {
+		desKey = w.privKey[:24]
+		preIV = w.privKey[24:32]
+		encryptCBC = encrypt3DESCBC
+	}
 	buf2 := new(bytes.Buffer)
 	w.desIV++
 	binary.Write(buf2, binary.BigEndian, w.desIV)
@@ -418,145 +1344,372 @@ func (w SNMP) encrypt(payload string) (string, string, error) {
 		payload = payload + strings.Repeat("\x00", 8-(plen%8))
 	}
 	encrypted := make([]byte, len(payload))
-	encryptDESCBC(encrypted, []byte(payload), []byte(desKey), []byte(iv))
+	encryptCBC(encrypted, []byte(payload), []byte(desKey), []byte(iv))
 	return string(encrypted), privParam, nil
 }
 
 func (w SNMP) decrypt(payload, privParam string) (string, error) {
+	// Both the AES and DES salts are 8 bytes long.
+	if len(privParam) != 8 {
+		return "", fmt.Errorf("privacy parameters are %d bytes long, expected 8", len(privParam))
+	}
 	buf := new(bytes.Buffer)
 	binary.Write(buf, binary.BigEndian, w.engineBoots)
 
 	if w.privAlg == SnmpAES {
-		buf2 := new(bytes.Buffer)
-		binary.Write(buf2, binary.BigEndian, w.engineTime)
-		iv := string(buf.Bytes()) + string(buf2.Bytes()) + privParam
+		iv := buildAESIV(w.engineBoots, w.engineTime, privParam)
 
 		// Decrypt
 		decrypted := make([]byte, len(payload))
-		err := decryptAESCFB(decrypted, []byte(payload), []byte(w.privKey), []byte(iv))
+		err := decryptAESCFB(decrypted, []byte(payload), []byte(w.privKey), iv)
 		if err != nil {
 			return "", err
 		}
-		return string(decrypted), nil
+		return trimScopedPDU(decrypted)
 	}
 
 	desKey := w.privKey[:8]
 	preIV := w.privKey[8:16]
+	decryptCBC := decryptDESCBC
+	if w.privAlg == SnmpDES3 {
+		desKey = w.privKey[:24]
+		preIV = w.privKey[24:32]
+		decryptCBC = decrypt3DESCBC
+	}
 	iv := strXor(preIV, privParam)
 
 	//DES Decrypt
 	plen := len(payload)
 	if (plen % 8) != 0 {
-		panic("DES encrypted payload is not multiple of 8 bytes\n")
+		return "", errors.New("DES encrypted payload is not multiple of 8 bytes")
 	}
 	decrypted := make([]byte, len(payload))
-	decryptDESCBC(decrypted, []byte(payload), []byte(desKey), []byte(iv))
-	return string(decrypted), nil
+	decryptCBC(decrypted, []byte(payload), []byte(desKey), []byte(iv))
+	result, err := trimScopedPDU(decrypted)
+	if err != nil {
+		// Decrypting with the wrong key doesn't fail, it only produces garbage.
+		return "", fmt.Errorf("%v, the privacy password or the %s key derivation doesn't match the agent's", err, w.privAlg)
+	}
+	return result, nil
+}
+
+// trimScopedPDU cuts a decrypted scoped PDU to the length its outer sequence reports, dropping
+// any padding or trailing bytes the agent encrypted along with it.
+func trimScopedPDU(decrypted []byte) (string, error) {
+	pduLen, err := DecodeTLVLength(decrypted)
+	if err != nil {
+		return "", fmt.Errorf("decrypted scoped PDU is invalid: %v", err)
+	}
+	return string(decrypted[:pduLen]), nil
 }
 
-// GetNextV3 issues a GETNEXT SNMPv3 request.
+// GetNextV3 issues a GETNEXT SNMPv3 request. At the end of the MIB the value is EndOfMibView, whether the
+// agent says so or answers without any varbind, and the oid is the one requested.
 func (w *SNMP) GetNextV3(oid Oid) (*Oid, interface{}, error) {
 	return w.doGetV3(oid, AsnGetNextRequest)
 }
 
-// GetV3 sends an SNMPv3 get request requesting the value for an oid.
+// GetV3 sends an SNMPv3 get request requesting the value for an oid. Discover is called first if it
+// wasn't already.
 func (w *SNMP) GetV3(oid Oid) (interface{}, error) {
 	_, val, err := w.doGetV3(oid, AsnGetRequest)
 	return val, err
 }
 
-// A function does both GetNext and Get for SNMP V3
-func (w *SNMP) doGetV3(oid Oid, request BERType) (*Oid, interface{}, error) {
-	msgID := getRandomRequestID()
-	requestID := getRandomRequestID()
-	req, err := EncodeSequence(
-		[]interface{}{Sequence, w.engineID, "",
-			[]interface{}{request, requestID, 0, 0,
-				[]interface{}{Sequence,
-					[]interface{}{Sequence, oid, nil}}}})
+// WalkV3 retrieves the subtree under root with SNMPv3 GETNEXT requests, for agents that don't support
+// GETBULK. It stops as soon as an oid leaves the subtree, or on endOfMibView. Reports about the time window
+// are handled by each GetNextV3, up to ReportRetries times. Walks outlasting the agent's time window
+// resume from the last oid received after such a report even without ReportRetries, the report having
+// brought the agent's engine time.
+func (w *SNMP) WalkV3(root Oid) ([]VarBind, error) {
+	var result []VarBind
+	lastOid := root.Copy()
+	resumed := false
+	for {
+		resultOid, val, err := w.GetNextV3(lastOid)
+		if report, ok := err.(*ReportError); ok && report.Oid.Equal(usmStatsNotInTimeWindows) && !resumed {
+			log.Printf("Received report %v walking %v. Resuming from %v\n", err, root, lastOid)
+			resumed = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		resumed = false
+		if val == EndOfMibView || !resultOid.Within(root) {
+			break
+		}
+		if resultOid.Compare(lastOid) <= 0 {
+			return nil, fmt.Errorf("agent returned non-increasing oid %v after %v", resultOid, lastOid)
+		}
+		if len(result) == w.maxTableEntries() {
+			return result, tableTooLarge(root, len(result))
+		}
+		result = append(result, VarBind{Oid: *resultOid, Value: val})
+		lastOid = *resultOid
+	}
+	return result, nil
+}
+
+// A function does both GetNext and Get for SNMP V3
+//
+// Agents answer with a report PDU when the request is outside their time window, updating our engine boots
+// and time as they do. The request is then sent again, up to ReportRetries times.
+// The first request does the discovery if Discover wasn't called.
+func (w *SNMP) doGetV3(oid Oid, request BERType) (*Oid, interface{}, error) {
+	if err := w.Discover(); err != nil {
+		if w.FallbackCommunity != "" && errors.Is(err, ErrNoResponse) {
+			log.Printf("Discovery of %s failed: %v. Falling back to v2c\n", w.Target, err)
+			return w.doGetV2c(oid, request)
+		}
+		return nil, nil, err
+	}
+	for attempt := 0; ; attempt++ {
+		resultOid, resultVal, err := w.doGetV3Once(oid, request)
+		if report, ok := err.(*ReportError); ok && attempt < w.ReportRetries {
+			log.Printf("Received report %v. Retrying. Retry %d/%d\n", err, attempt+1, w.ReportRetries)
+			if report.Oid.Equal(usmStatsUnknownEngineIDs) {
+				// The keys were localized for another engine, e.g. from a stale ImportSession.
+				if err := w.ForceDiscover(); err != nil {
+					return nil, nil, err
+				}
+			}
+			continue
+		}
+		if w.FallbackCommunity != "" && errors.Is(err, ErrNoResponse) {
+			log.Printf("SNMP V3 request to %s failed: %v. Falling back to v2c\n", w.Target, err)
+			return w.doGetV2c(oid, request)
+		}
+		return resultOid, resultVal, err
+	}
+}
+
+// doGetV2c sends the Get or GetNext request of doGetV3 as v2c with FallbackCommunity.
+func (w *SNMP) doGetV2c(oid Oid, request BERType) (*Oid, interface{}, error) {
+	v2c := *w
+	v2c.Version = SNMPv2c
+	v2c.Community = w.FallbackCommunity
+	if request == AsnGetNextRequest {
+		return v2c.GetNext(oid)
+	}
+	val, err := v2c.Get(oid)
+	return &oid, val, err
+}
+
+// reportableFlag returns FlagReportable for the PDUs of the confirmed class, which expect an answer, and 0 for
+// the others, e.g. traps and responses, which must never cause a report, per RFC 3412.
+func reportableFlag(pduType BERType) MsgFlags {
+	switch pduType {
+	case AsnGetRequest, AsnGetNextRequest, AsnGetBulkRequest, AsnSetRequest, AsnInform:
+		return FlagReportable
+	}
+	return 0
+}
+
+// v3SecurityLevel is the security level of the SNMP V3 requests and traps, which responses must match.
+const v3SecurityLevel = FlagAuth | FlagPriv
+
+// encodeV3Message encodes an authenticated and encrypted SNMP V3 message carrying pdu, in the context of
+// ContextName, see buildV3Message.
+func (w *SNMP) encodeV3Message(pdu []interface{}) ([]byte, error) {
+	packet, _, err := w.buildV3Message(v3SecurityLevel, w.engineID, w.ContextName, pdu)
+	return packet, err
+}
+
+// buildV3Message encodes an SNMP V3 message carrying pdu in the context contextName of contextEngineID, at
+// the security level of flags, with the user and keys of w. Only FlagAuth and FlagPriv are taken from
+// flags, the reportable flag is set according to the type of pdu. It returns the message and the offset of
+// its 12 bytes of authentication parameters, -1 if it isn't authenticated.
+//
+// The authoritative engine is the engineID, engineBoots and engineTime of w: the agent's, discovered, for
+// requests, and the local engine for traps. Discovery probes are built by an SNMP object without any.
+func (w *SNMP) buildV3Message(flags MsgFlags, contextEngineID, contextName string, pdu []interface{}) ([]byte, int, error) {
+	flags &= FlagAuth | FlagPriv
+	if flags.Priv() && !flags.Auth() {
+		return nil, -1, errors.New("privacy without authentication isn't a security level")
+	}
+	if flags.Auth() && w.authKey == "" || flags.Priv() && w.privKey == "" {
+		return nil, -1, fmt.Errorf("no localized keys for %v messages", flags)
+	}
+
+	scopedPDU, err := EncodeSequence([]interface{}{Sequence, contextEngineID, contextName, pdu})
 	if err != nil {
-		panic(err)
+		return nil, -1, err
+	}
+	var msgData interface{} = []interface{}{Sequence, contextEngineID, contextName, pdu}
+	msgDataSize := len(scopedPDU)
+	authParam, privParam := "", ""
+	if flags.Auth() {
+		authParam = strings.Repeat("\x00", 12)
+	}
+	if flags.Priv() {
+		var encrypted string
+		if encrypted, privParam, err = w.encrypt(string(scopedPDU)); err != nil {
+			return nil, -1, err
+		}
+		msgData = encrypted
+		msgDataSize = tlvSize(len(encrypted))
 	}
-
-	encrypted, privParam, _ := w.encrypt(string(req))
 
 	v3Header, err := EncodeSequence([]interface{}{Sequence, w.engineID,
-		int(w.engineBoots), int(w.engineTime), w.user, strings.Repeat("\x00", 12), privParam})
+		int(w.engineBoots), int(w.engineTime), w.user, authParam, privParam})
 	if err != nil {
-		panic(err)
+		return nil, -1, err
 	}
 
-	flags := string([]byte{7})
+	pduType, _ := pdu[0].(BERType)
 	USM := 0x03
 	packet, err := EncodeSequence([]interface{}{
-		Sequence, int(w.Version),
-		[]interface{}{Sequence, msgID, maxMsgSize, flags, USM},
+		Sequence, int(SNMPv3),
+		[]interface{}{Sequence, w.requestID(), maxMsgSize, (flags | reportableFlag(pduType)).encode(), USM},
 		string(v3Header),
-		encrypted})
+		msgData})
 	if err != nil {
-		panic(err)
+		return nil, -1, err
 	}
-	authParam := w.auth(string(packet))
-	finalPacket := strings.Replace(string(packet), strings.Repeat("\x00", 12), authParam, 1)
+	if !flags.Auth() {
+		return packet, -1, nil
+	}
+
+	// The authentication parameters come last in the security parameters, but for privParam, which are
+	// followed by the scoped PDU, the last field of the message.
+	offset := len(packet) - msgDataSize - tlvSize(len(privParam)) - 12
+	copy(packet[offset:], w.auth(string(packet)))
+	return packet, offset, nil
+}
+
+// tlvSize returns the size of the BER encoding of a value of length bytes, with its type and length.
+func tlvSize(length int) int {
+	return 1 + len(EncodeLength(length)) + length
+}
 
-	response := make([]byte, bufSize)
-	numRead, err := poll(w.conn, []byte(finalPacket), response, w.retries, 500*time.Millisecond)
+// doGetV3Once sends a single SNMP V3 Get or GetNext request.
+func (w *SNMP) doGetV3Once(oid Oid, request BERType) (*Oid, interface{}, error) {
+	defer w.lock()()
+	requestID := w.requestID()
+	finalPacket, err := w.encodeV3Message([]interface{}{request, requestID, 0, 0,
+		[]interface{}{Sequence,
+			[]interface{}{Sequence, oid, nil}}})
 	if err != nil {
 		return nil, nil, err
 	}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
+	response := w.newResponseBuffer()
+	numRead, err := poll(w.context(), w.conn, finalPacket, response, w.retries, 500*time.Millisecond, w.stats, w.OnSend, w.OnRecv)
 	if err != nil {
-		fmt.Printf("Error decoding getNext:%v\n", err)
 		return nil, nil, err
 	}
-	/*
-		for i, val := range decodedResponse{
-			fmt.Printf("Resp:%v:type=%v\n",i,reflect.TypeOf(val));
-		}
-	*/
 
-	v3HeaderStr := decodedResponse[3].(string)
-	v3HeaderDecoded, err := DecodeSequence([]byte(v3HeaderStr))
+	decodedResponse, err := w.decodeResponse(response[:numRead])
+	if err != nil {
+		return nil, nil, err
+	}
+	params, err := w.securityParamsOf(decodedResponse)
 	if err != nil {
-		fmt.Printf("Error 2 decoding:%v\n", err)
 		return nil, nil, err
 	}
 
-	w.engineID = v3HeaderDecoded[1].(string)
-	w.engineBoots = int32(v3HeaderDecoded[2].(int))
-	w.engineTime = int32(v3HeaderDecoded[3].(int))
+	w.engineID = params.engineID
+	w.engineBoots = int32(params.engineBoots)
+	w.engineTime = int32(params.engineTime)
+	w.engineTimeAt = time.Now()
 	// skip checking authParam for now
-	respAuthParam := v3HeaderDecoded[5].(string)
-	respPrivParam := v3HeaderDecoded[6].(string)
 
-	if len(respAuthParam) == 0 || len(respPrivParam) == 0 {
-		return nil, nil, fmt.Errorf("Error,response is not encrypted.")
+	respFlags, err := msgFlagsOf(decodedResponse)
+	if err != nil {
+		return nil, nil, err
+	}
+	if scopedPDU, ok := decodedResponse[4].([]interface{}); ok {
+		// Reports about time windows or unknown engines are sent without privacy.
+		if err := checkReport(scopedPDU); err != nil {
+			return nil, nil, err
+		}
+	}
+	if !respFlags.atLeast(v3SecurityLevel) {
+		return nil, nil, fmt.Errorf("response is %v, below the %v of the request", respFlags, v3SecurityLevel)
+	}
+	if len(params.authParam) == 0 || len(params.privParam) == 0 {
+		return nil, nil, fmt.Errorf("response is %v, but has no authentication or privacy parameters", respFlags)
 	}
 
-	encryptedResp := decodedResponse[4].(string)
-	plainResp, _ := w.decrypt(encryptedResp, respPrivParam)
+	encryptedResp, ok := decodedResponse[4].(string)
+	if !ok {
+		return nil, nil, &DecodeError{fmt.Errorf("invalid encrypted scoped PDU %v", decodedResponse[4])}
+	}
+	plainResp, err := w.decrypt(encryptedResp, params.privParam)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decrypting response for user %s with %s/%s, engine boots %d: %v",
+			w.user, w.authAlg, w.privAlg, w.engineBoots, err)
+	}
 
-	pduDecoded, err := DecodeSequence([]byte(plainResp))
+	pduDecoded, err := DecodeSequenceWithLimits([]byte(plainResp), w.DecodeLimits)
 	if err != nil {
-		fmt.Printf("Error 3 decoding:%v\n", err)
+		return nil, nil, &DecodeError{err}
+	}
+	if err := checkReport(pduDecoded); err != nil {
+		return nil, nil, err
+	}
+	if err := w.checkResponseContext(pduDecoded); err != nil {
 		return nil, nil, err
 	}
 
 	// Find the varbinds
-	respPacket := pduDecoded[3].([]interface{})
-	varbinds := respPacket[4].([]interface{})
-	result := varbinds[1].([]interface{})
-
-	resultOid := result[1].(Oid)
+	respPacket, ok := pduDecoded[3].([]interface{})
+	if !ok || len(respPacket) < 5 {
+		return nil, nil, &DecodeError{fmt.Errorf("invalid response PDU %v", pduDecoded[3])}
+	}
+	// The msgID was checked by poll, but the request ID of the PDU must match too.
+	if respID, ok := respPacket[1].(int); !ok || !requestIDsMatch(requestID, respID) {
+		return nil, nil, fmt.Errorf("response to request %v, expected %d", respPacket[1], requestID)
+	}
+	if err := checkErrorStatus(respPacket); err != nil {
+		return nil, nil, err
+	}
+	varbinds, ok := respPacket[4].([]interface{})
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid varbinds %v", respPacket[4])
+	}
+	if len(varbinds) < 2 {
+		// No varbind at all, which some agents send at the end of the MIB.
+		resultOid := oid.Copy()
+		return &resultOid, EndOfMibView, nil
+	}
+	result, ok := varbinds[1].([]interface{})
+	if !ok || len(result) < 3 {
+		return nil, nil, fmt.Errorf("invalid varbind %v", varbinds[1])
+	}
+	resultOid, ok := result[1].(Oid)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid varbind oid %v", result[1])
+	}
 	resultVal := result[2]
 
 	return &resultOid, resultVal, nil
 }
 
-// GetNext issues a GETNEXT SNMP request.
+// checkResponseContext returns an error if the decoded scoped PDU of a response isn't in the context of the
+// requests, unless IgnoreContextMismatch is set.
+func (w *SNMP) checkResponseContext(scopedPDU []interface{}) error {
+	if len(scopedPDU) < 4 {
+		return fmt.Errorf("invalid scoped PDU length %d", len(scopedPDU))
+	}
+	contextEngineID, ok1 := scopedPDU[1].(string)
+	contextName, ok2 := scopedPDU[2].(string)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("invalid response context %v, %v", scopedPDU[1], scopedPDU[2])
+	}
+	if w.IgnoreContextMismatch || contextEngineID == w.engineID && contextName == w.ContextName {
+		return nil
+	}
+	return fmt.Errorf("response is for context %q of engine %x, expected %q of engine %x",
+		contextName, contextEngineID, w.ContextName, w.engineID)
+}
+
+// GetNext issues a GETNEXT SNMP request. If the agent answers without any varbind, the value is EndOfMibView
+// and the oid is the one requested.
 func (w SNMP) GetNext(oid Oid) (*Oid, interface{}, error) {
-	requestID := getRandomRequestID()
+	defer w.lock()()
+	requestID := w.requestID()
 	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
 		[]interface{}{AsnGetNextRequest, requestID, 0, 0,
 			[]interface{}{Sequence,
@@ -565,90 +1718,471 @@ func (w SNMP) GetNext(oid Oid) (*Oid, interface{}, error) {
 		return nil, nil, err
 	}
 
-	response := make([]byte, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, 500*time.Millisecond)
+	response := w.newResponseBuffer()
+	numRead, err := poll(w.context(), w.conn, req, response, w.retries, 500*time.Millisecond, w.stats, w.OnSend, w.OnRecv)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
+	msg, err := w.decodeMessage(response[:numRead])
 	if err != nil {
 		return nil, nil, err
 	}
-
-	// Find the varbinds
-	respPacket := decodedResponse[3].([]interface{})
-	varbinds := respPacket[4].([]interface{})
-	result := varbinds[1].([]interface{})
-
-	resultOid := result[1].(Oid)
-	resultVal := result[2]
-
-	return &resultOid, resultVal, nil
+	if err := msg.PDU.errorStatus(); err != nil {
+		return nil, nil, err
+	}
+	if len(msg.PDU.VarBinds) == 0 {
+		// No varbind at all, which some agents send at the end of the MIB.
+		resultOid := oid.Copy()
+		return &resultOid, EndOfMibView, nil
+	}
+	result := msg.PDU.VarBinds[0]
+	return &result.Oid, result.Value, nil
 }
 
 // GetBulk is semantically the same as maxRepetitions getnext requests, but in a single GETBULK SNMP packet.
 // Caveat: many devices will silently drop GETBULK requests for more than some number of maxrepetitions, if
 // it doesn't work, try with a lower value and/or use GetTable.
+//
+// The endOfMibView varbinds the agent ends the MIB with aren't part of the result: they aren't values, and
+// their oid is the one of the previous varbind. A result with fewer than maxRepetitions oids means the
+// agent reached the end of the MIB.
 func (w SNMP) GetBulk(oid Oid, maxRepetitions int) (map[string]interface{}, error) {
-	requestID := getRandomRequestID()
-	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
-		[]interface{}{AsnGetBulkRequest, requestID, 0, maxRepetitions,
-			[]interface{}{Sequence,
-				[]interface{}{Sequence, oid, nil}}}})
+	varbinds, err := w.getBulkVarBinds(0, maxRepetitions, []Oid{oid})
 	if err != nil {
 		return nil, err
 	}
 
-	response := make([]byte, bufSize, bufSize)
-	numRead, err := poll(w.conn, req, response, w.retries, 500*time.Millisecond)
-	if err != nil {
-		return nil, err
+	result := make(map[string]interface{})
+	for _, v := range varbinds {
+		if v.Value == EndOfMibView {
+			break
+		}
+		result[v.Oid.String()] = v.Value
+	}
+
+	return result, nil
+}
+
+// getBulkVarBinds sends a single GETBULK request for oids, the first nonRepeaters of them being scalars,
+// and returns the varbinds in the order the agent sent them.
+func (w SNMP) getBulkVarBinds(nonRepeaters, maxRepetitions int, oids []Oid) ([]VarBind, error) {
+	varbinds, _, err := w.getBulk(nonRepeaters, maxRepetitions, oids)
+	return varbinds, err
+}
+
+// checkBulkVersion returns an error unless the version of w has GETBULK: a v1 header on a GETBULK PDU is
+// an inconsistent message agents answer in unpredictable ways, and the v3 requests don't support it.
+func (w SNMP) checkBulkVersion() error {
+	switch w.Version {
+	case SNMPv2c:
+		return nil
+	case SNMPv1:
+		return errors.New("GETBULK needs SNMP v2c, not v1: use GetNext or SnmpWalk with v1 agents")
 	}
+	return fmt.Errorf("GETBULK needs SNMP v2c, not %v", w.Version)
+}
 
-	decodedResponse, err := DecodeSequence(response[:numRead])
+// getBulk issues a GETBULK request, and returns the varbinds and the BER types of their values.
+func (w SNMP) getBulk(nonRepeaters, maxRepetitions int, oids []Oid) ([]VarBind, []BERType, error) {
+	if err := w.checkBulkVersion(); err != nil {
+		return nil, nil, err
+	}
+	defer w.lock()()
+	requestID := w.requestID()
+	varbinds := []interface{}{Sequence}
+	for _, oid := range oids {
+		varbinds = append(varbinds, []interface{}{Sequence, oid, nil})
+	}
+	req, err := EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community,
+		[]interface{}{AsnGetBulkRequest, requestID, nonRepeaters, maxRepetitions, varbinds}})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	// Find the varbinds
-	respPacket := decodedResponse[3].([]interface{})
-	respVarbinds := respPacket[4].([]interface{})
+	response := w.newResponseBuffer()
+	numRead, err := poll(w.context(), w.conn, req, response, w.retries, 500*time.Millisecond, w.stats, w.OnSend, w.OnRecv)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	result := make(map[string]interface{})
-	for _, v := range respVarbinds[1:] { // First element is just a sequence
-		oid := v.([]interface{})[1].(Oid).String()
-		value := v.([]interface{})[2]
-		result[oid] = value
+	msg, err := w.decodeMessage(response[:numRead])
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := msg.PDU.errorStatus(); err != nil {
+		return nil, nil, err
 	}
+	types, err := DecodeVarBindTypes(response[:numRead])
+	if err != nil || len(types) != len(msg.PDU.VarBinds) {
+		return nil, nil, &DecodeError{fmt.Errorf("varbind types %v: %v", types, err)}
+	}
+	return msg.PDU.VarBinds, types, nil
+}
 
-	return result, nil
+// GetBulkWithin is GetBulk, but only returns the varbinds under oid. GetBulk returns everything the agent
+// sent, and the last repetitions usually walk past the end of the subtree.
+func (w SNMP) GetBulkWithin(oid Oid, maxRepetitions int) (map[string]interface{}, error) {
+	results, err := w.GetBulk(oid, maxRepetitions)
+	if err != nil {
+		return nil, err
+	}
+	for o := range results {
+		if !MustParseOid(o).Within(oid) {
+			delete(results, o)
+		}
+	}
+	return results, nil
 }
 
 // GetTable efficiently gets an entire table from an SNMP agent. Uses GETBULK requests to go fast.
+// Agents must return oids in increasing order, GetTable returns an error if one doesn't rather than
+// looping forever. Past MaxTableEntries entries, it returns them with ErrTableTooLarge. Set
+// RepetitionGrowth to let it find the best repetitions for the agent.
 func (w SNMP) GetTable(oid Oid) (map[string]interface{}, error) {
-	result := make(map[string]interface{})
+	return w.GetTableWithRepetitions(oid, defaultMaxRepetitions)
+}
+
+// GetTableWithRepetitions is GetTable, asking for maxRep repetitions per GETBULK request. Small devices may
+// need fewer than the default, fast routers go faster with more. If the agent answers tooBig, the requests
+// are retried with half as many repetitions.
+func (w SNMP) GetTableWithRepetitions(oid Oid, maxRep int) (map[string]interface{}, error) {
+	typed, err := w.getTable(oid, maxRep)
+	if typed == nil {
+		return nil, err
+	}
+	result := make(map[string]interface{}, len(typed))
+	for o, v := range typed {
+		result[o] = v.Value
+	}
+	return result, err
+}
+
+// GetTableTyped is GetTable, but also returns the BER type of every value.
+func (w SNMP) GetTableTyped(oid Oid) (map[string]TypedValue, error) {
+	return w.getTable(oid, defaultMaxRepetitions)
+}
+
+// GetTableAdaptive is GetTable with a RepetitionGrowth of its own, starting from a few repetitions: it asks
+// for more, at most twice as many each time, as long as the responses are expected to fit in MaxMessageSize.
+func (w SNMP) GetTableAdaptive(oid Oid) (map[string]interface{}, error) {
+	w.RepetitionGrowth = &RepetitionGrowth{}
+	return w.GetTableWithRepetitions(oid, adaptiveStartRepetitions)
+}
+
+// encodedVarBindsSize returns the size of the encoding of varbinds.
+func encodedVarBindsSize(varbinds []VarBind) (int, error) {
+	size := 0
+	for _, varbind := range varbinds {
+		encoded, err := EncodeSequence([]interface{}{Sequence, varbind.Oid, varbind.Value})
+		if err != nil {
+			return 0, err
+		}
+		size += len(encoded)
+	}
+	return size, nil
+}
+
+// varBindsBudget returns the room for varbinds in a response of MaxMessageSize. The message, PDU and
+// varbind list headers take the rest, with room to spare.
+func (w SNMP) varBindsBudget() int {
+	return w.maxMessageSize() - 48 - len(w.Community)
+}
+
+// maxMessageSize returns MaxMessageSize, or its default, within the size of the buffer responses are read in.
+func (w SNMP) maxMessageSize() int {
+	switch {
+	case w.MaxMessageSize <= 0:
+		return defaultMaxMessageSize
+	case w.MaxMessageSize > w.responseBufferSize():
+		return w.responseBufferSize()
+	}
+	return w.MaxMessageSize
+}
+
+func (w SNMP) getTable(oid Oid, maxRep int) (map[string]TypedValue, error) {
+	if err := w.checkBulkVersion(); err != nil {
+		return nil, err
+	}
+	growth := w.RepetitionGrowth
+	minRep := 1
+	if growth != nil {
+		unlock := w.lock()
+		if growth.Repetitions > 0 {
+			maxRep = growth.Repetitions
+		}
+		unlock()
+		maxRep = growth.clamp(maxRep)
+		minRep = growth.min()
+		defer func() {
+			defer w.lock()()
+			growth.Repetitions = maxRep
+		}()
+	}
+
+	result := make(map[string]TypedValue)
 	lastOid := oid.Copy()
 	for lastOid.Within(oid) {
-		log.Printf("Sending GETBULK(%v, 50)\n", lastOid)
-		results, err := w.GetBulk(lastOid, 50)
+		log.Printf("Sending GETBULK(%v, %d)\n", lastOid, maxRep)
+		varbinds, types, err := w.getBulk(0, maxRep, []Oid{lastOid})
+		if pduErr, ok := err.(*PDUError); ok && pduErr.ErrorStatus == 1 && maxRep > minRep {
+			// tooBig, the response didn't fit in a message.
+			if growth != nil {
+				maxRep = growth.shrink(maxRep)
+			} else {
+				maxRep /= 2
+			}
+			continue
+		}
 		if err != nil {
-			return nil, fmt.Errorf("received GetBulk error => %v\n", err)
+			return nil, fmt.Errorf("received GetBulk error => %w\n", err)
 		}
 		newLastOid := lastOid.Copy()
-		for o, v := range results {
-			oAsOid := MustParseOid(o)
-			if oAsOid.Within(oid) {
-				result[o] = v
+		endOfMib := false
+		for idx, varbind := range varbinds {
+			if varbind.Value == EndOfMibView {
+				// Nothing left after it, and its oid is the one of the previous varbind.
+				endOfMib = true
+				break
+			}
+			o := varbind.Oid.String()
+			// Every oid has to come after the one we asked for, and the result map
+			// doubles as the set of oids already seen.
+			if varbind.Oid.Compare(lastOid) <= 0 {
+				return nil, fmt.Errorf("agent returned non-increasing oid %v after %v", varbind.Oid, lastOid)
+			}
+			if _, seen := result[o]; seen {
+				return nil, fmt.Errorf("agent returned oid %v more than once", varbind.Oid)
+			}
+			if varbind.Oid.Within(oid) {
+				if len(result) == w.maxTableEntries() {
+					return result, tableTooLarge(oid, len(result))
+				}
+				result[o] = TypedValue{Type: types[idx], Value: varbind.Value}
+			}
+			if varbind.Oid.Compare(newLastOid) > 0 {
+				newLastOid = varbind.Oid
 			}
-			newLastOid = oAsOid
 		}
 
-		if reflect.DeepEqual(lastOid, newLastOid) {
-			// Not making any progress ? Assume we reached end of table.
+		if endOfMib || lastOid.Equal(newLastOid) {
+			// The end of the MIB, or not making any progress ? Assume we reached end of table.
 			break
 		}
 		lastOid = newLastOid
+		if growth != nil {
+			if size, err := encodedVarBindsSize(varbinds); err == nil {
+				maxRep = growth.grow(maxRep, size, varbinds, w.varBindsBudget())
+			}
+		}
+	}
+	return result, nil
+}
+
+// maxTableEntries returns MaxTableEntries, or its default.
+func (w SNMP) maxTableEntries() int {
+	if w.MaxTableEntries <= 0 {
+		return defaultMaxTableEntries
+	}
+	return w.MaxTableEntries
+}
+
+// tableTooLarge returns the error for a table or walk under root cut after entries.
+func tableTooLarge(root Oid, entries int) error {
+	return fmt.Errorf("%w: more than %d entries under %v", ErrTableTooLarge, entries, root)
+}
+
+// SnmpWalk walks the subtree under root like net-snmp's snmpwalk does and returns the varbinds in the order
+// the agent walked them.
+//
+// Unlike GetTable it only uses GETNEXT, starting with a GETNEXT on root itself, so it also works with SNMP v1
+// agents, at the cost of a request per varbind. It stops as soon as an oid leaves the subtree, or when the
+// agent reports the end of the MIB (endOfMibView, or noSuchName in v1). Like GetTable, it gives up after
+// MaxTableEntries varbinds.
+func (w SNMP) SnmpWalk(root Oid) ([]VarBind, error) {
+	var result []VarBind
+	lastOid := root.Copy()
+	for {
+		varbind, inSubtree, err := w.GetNextInSubtree(lastOid, root)
+		if err != nil {
+			if pduErr, ok := err.(*PDUError); ok && pduErr.ErrorStatus == 2 {
+				// noSuchName is how v1 agents report the end of the MIB.
+				break
+			}
+			return nil, err
+		}
+		if !inSubtree {
+			break
+		}
+		if varbind.Oid.Compare(lastOid) <= 0 {
+			return nil, fmt.Errorf("agent returned non-increasing oid %v after %v", varbind.Oid, lastOid)
+		}
+		if len(result) == w.maxTableEntries() {
+			return result, tableTooLarge(root, len(result))
+		}
+		result = append(result, varbind)
+		lastOid = varbind.Oid
+	}
+	return result, nil
+}
+
+// GetNextInSubtree issues a GETNEXT request for prev, and tells whether the result is still under root.
+// It's false when the agent returned the first oid after the subtree or reported the end of the MIB, the
+// varbind then isn't part of the walk and must be dropped.
+func (w SNMP) GetNextInSubtree(prev, root Oid) (VarBind, bool, error) {
+	resultOid, val, err := w.GetNext(prev)
+	if err != nil {
+		return VarBind{}, false, err
+	}
+	varbind := VarBind{Oid: *resultOid, Value: val}
+	return varbind, val != EndOfMibView && resultOid.Within(root), nil
+}
+
+// GetColumns gets several columns of a table at once, with GETBULK requests carrying all the columns that
+// haven't reached their end yet. columns are relative to the table entry, e.g. Oid{2} for ifDescr under
+// ifEntry. Columns may end at different indexes, sparse tables simply have missing values.
+//
+// The result is indexed by row index, then column, both as oid strings, e.g. result[".1"][".2"]. The
+// exceptions the agent returned for some cells are values of the result, GetTableRows tells them apart.
+// Like GetTable, it gives up after MaxTableEntries cells, returning those with ErrTableTooLarge.
+func (w SNMP) GetColumns(entry Oid, columns []Oid) (map[string]map[string]interface{}, error) {
+	rows, err := w.GetTableRows(entry, columns)
+	if err != nil && !errors.Is(err, ErrTableTooLarge) {
+		return nil, err
+	}
+	result := rows.Rows
+	for index, exceptions := range rows.Exceptions {
+		if result[index] == nil {
+			result[index] = make(map[string]interface{})
+		}
+		for column, exception := range exceptions {
+			result[index][column] = exception
+		}
+	}
+	return result, err
+}
+
+// TableRows are the columns of a table GetTableRows got.
+type TableRows struct {
+	Columns []string // Requested columns, as oid strings relative to the entry.
+
+	// Rows are the values, indexed by row index, then column, e.g. Rows[".1"][".2"].
+	Rows map[string]map[string]interface{}
+
+	// Exceptions are the cells the agent returned an exception for instead of a value, e.g. noSuchInstance,
+	// indexed as Rows.
+	Exceptions map[string]map[string]Exception
+}
+
+// CellStatus tells why a cell of TableRows has a value or not.
+type CellStatus int
+
+// The statuses of the cells of TableRows.
+const (
+	CellNotRequested CellStatus = iota // The column wasn't requested.
+	CellAbsent                         // The column has no value at this index, e.g. it's shorter than others.
+	CellException                      // The agent returned an exception, which is the value of the cell.
+	CellPresent                        // The cell has a value.
+)
+
+// Cell returns the value of the cell at index in column, both oid strings as the keys of Rows, and its
+// status. The value is nil for absent cells and cells of columns that weren't requested.
+func (t TableRows) Cell(index, column string) (interface{}, CellStatus) {
+	if value, ok := t.Rows[index][column]; ok {
+		return value, CellPresent
+	}
+	if exception, ok := t.Exceptions[index][column]; ok {
+		return exception, CellException
+	}
+	for _, requested := range t.Columns {
+		if requested == column {
+			return nil, CellAbsent
+		}
+	}
+	return nil, CellNotRequested
+}
+
+// GetTableRows gets several columns of a table at once as GetColumns does, keeping the exceptions the
+// agent returned apart from the values so that sparse tables can be told from failing cells, see Cell.
+// After MaxTableEntries cells, values and exceptions alike, it returns those got so far with ErrTableTooLarge.
+func (w SNMP) GetTableRows(entry Oid, columns []Oid) (*TableRows, error) {
+	if err := w.checkBulkVersion(); err != nil {
+		return nil, err
+	}
+	result := &TableRows{
+		Columns:    make([]string, len(columns)),
+		Rows:       make(map[string]map[string]interface{}),
+		Exceptions: make(map[string]map[string]Exception),
+	}
+	columnOids := make([]Oid, len(columns))
+	lastOids := make([]Oid, len(columns))
+	active := make([]int, len(columns))
+	for idx, column := range columns {
+		result.Columns[idx] = column.String()
+		columnOids[idx] = append(entry.Copy(), column...)
+		lastOids[idx] = columnOids[idx]
+		active[idx] = idx
+	}
+
+	cells := 0
+	for len(active) > 0 {
+		request := make([]Oid, len(active))
+		for i, idx := range active {
+			request[i] = lastOids[idx]
+		}
+		maxRepetitions := 50 / len(active)
+		if maxRepetitions < 1 {
+			maxRepetitions = 1
+		}
+		log.Printf("Sending GETBULK(%v, %d)\n", request, maxRepetitions)
+		varbinds, err := w.getBulkVarBinds(0, maxRepetitions, request)
+		if err != nil {
+			return nil, fmt.Errorf("received GetBulk error => %w\n", err)
+		}
+
+		// Varbinds come one repetition at a time, each holding the next value of every requested column.
+		done := make(map[int]bool)
+		for i, varbind := range varbinds {
+			idx := active[i%len(active)]
+			if done[idx] {
+				continue
+			}
+			if varbind.Value == EndOfMibView || !varbind.Oid.Within(columnOids[idx]) {
+				done[idx] = true
+				continue
+			}
+			if varbind.Oid.Compare(lastOids[idx]) <= 0 {
+				return nil, fmt.Errorf("agent returned non-increasing oid %v after %v", varbind.Oid, lastOids[idx])
+			}
+			if cells == w.maxTableEntries() {
+				return result, tableTooLarge(entry, cells)
+			}
+			cells++
+			index := Oid(varbind.Oid[len(columnOids[idx]):]).String()
+			if exception, ok := varbind.Value.(Exception); ok {
+				if result.Exceptions[index] == nil {
+					result.Exceptions[index] = make(map[string]Exception)
+				}
+				result.Exceptions[index][result.Columns[idx]] = exception
+			} else {
+				if result.Rows[index] == nil {
+					result.Rows[index] = make(map[string]interface{})
+				}
+				result.Rows[index][result.Columns[idx]] = varbind.Value
+			}
+			lastOids[idx] = varbind.Oid
+		}
+		if len(varbinds) == 0 {
+			break
+		}
+
+		stillActive := active[:0]
+		for _, idx := range active {
+			if !done[idx] {
+				stillActive = append(stillActive, idx)
+			}
+		}
+		active = stillActive
 	}
 	return result, nil
 }
@@ -656,7 +2190,7 @@ func (w SNMP) GetTable(oid Oid) (map[string]interface{}, error) {
 // Trap object.
 type Trap struct {
 	Version     int
-	TrapType    int  // for V1 traps
+	TrapType    int // for V1 traps
 	OID         Oid
 	Other       interface{}
 	Community   string
@@ -664,13 +2198,129 @@ type Trap struct {
 	Address     string
 	VarBinds    map[string]interface{}
 	VarBindOIDs []string
+	RequestID   int  // for V2 traps and informs
+	Inform      bool // INFORM requests must be acknowledged, see TrapServer.RespondToInform
+
+	// The classification and the sysUpTime of V1 traps. GenericTrap is TrapType, see GenericTrapName.
+	GenericTrap  int
+	SpecificTrap int
+	Timestamp    TimeTicks
+
+	// The context of V3 traps, e.g. the VLAN or VRF instance they're about. Both are empty for the default
+	// context.
+	ContextEngineID string
+	ContextName     string
+}
+
+// The generic-trap numbers of V1 traps, from RFC 1157.
+const (
+	ColdStart             = 0
+	WarmStart             = 1
+	LinkDown              = 2
+	LinkUp                = 3
+	AuthenticationFailure = 4
+	EgpNeighborLoss       = 5
+	EnterpriseSpecific    = 6
+)
+
+var genericTrapNames = []string{"coldStart", "warmStart", "linkDown", "linkUp", "authenticationFailure",
+	"egpNeighborLoss", "enterpriseSpecific"}
+
+// GenericTrapName returns the name of a V1 generic-trap number, e.g. "linkDown" for 2.
+func GenericTrapName(generic int) string {
+	if generic < 0 || generic >= len(genericTrapNames) {
+		return fmt.Sprintf("unknown(%d)", generic)
+	}
+	return genericTrapNames[generic]
+}
+
+// snmpTrapOID is the varbind holding the notification oid of V2 traps, and snmpTraps the prefix of the
+// notification oids of the generic V1 traps, from RFC 3418.
+var (
+	snmpTrapOID = Oid{1, 3, 6, 1, 6, 3, 1, 1, 4, 1, 0}
+	snmpTraps   = Oid{1, 3, 6, 1, 6, 3, 1, 1, 5}
+)
+
+// NotificationOID returns the V2 notification oid of the trap, whatever its version, so all traps can
+// be handled the same way. For V1 traps it's mapped per RFC 3584: generic traps map to the standard
+// oids, e.g. .1.3.6.1.6.3.1.1.5.3 for linkDown, enterprise-specific ones to enterprise.0.specific.
+// It's nil if a V2 trap has no snmpTrapOID.0.
+func (t Trap) NotificationOID() Oid {
+	if t.Version != 1 {
+		oid, _ := t.VarBinds[snmpTrapOID.String()].(Oid)
+		return oid
+	}
+	if t.GenericTrap == EnterpriseSpecific {
+		return append(t.OID.Copy(), 0, t.SpecificTrap)
+	}
+	return append(snmpTraps.Copy(), t.GenericTrap+1)
+}
+
+// agentAddress formats the agent-addr of a V1 trap as a dotted quad. It's an IpAddress, which decodes as a
+// dotted quad, but some agents send it as the 4 raw bytes of an OCTET STRING. It's empty if it's neither.
+func agentAddress(value interface{}) string {
+	var ip net.IP
+	switch value := value.(type) {
+	case string:
+		if ip = net.ParseIP(value); ip == nil && len(value) == net.IPv4len {
+			ip = net.IP(value)
+		}
+	case IpAddress:
+		ip = net.IP(value)
+	case net.IP:
+		ip = value
+	}
+	if ip = ip.To4(); ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// String summarizes the trap on one line for logs: its version, kind, source, notification oid and its
+// varbinds in order, formatted as VarBind.String does, e.g.
+// v2c trap from 192.0.2.1:162 community public .1.3.6.1.6.3.1.1.5.3: .1.3.6.1.2.1.2.2.1.1.2 = INTEGER: 2
+func (t Trap) String() string {
+	version := fmt.Sprintf("v%d", t.Version)
+	if t.Version == 2 {
+		version = "v2c"
+	}
+	kind := "trap"
+	if t.Inform {
+		kind = "inform"
+	}
+	source := t.Address
+	if source == "" {
+		source = "unknown address"
+	}
+	identity := "community " + t.Community
+	if t.Version == 3 {
+		identity = "user " + t.Username
+	}
+
+	varbinds := make([]string, 0, len(t.VarBindOIDs))
+	for _, o := range t.VarBindOIDs {
+		oid, err := ParseOid(o)
+		if err != nil {
+			varbinds = append(varbinds, fmt.Sprintf("%s = %v", o, t.VarBinds[o]))
+			continue
+		}
+		varbinds = append(varbinds, VarBind{Oid: oid, Value: t.VarBinds[o]}.String())
+	}
+	summary := fmt.Sprintf("%s %s from %s %s", version, kind, source, identity)
+	if notification := t.NotificationOID(); notification != nil {
+		summary += " " + notification.String()
+	}
+	return summary + ": " + strings.Join(varbinds, ", ")
 }
 
 // ParseTrap parses a received SNMP trap and returns  a map of oid to objects
+//
+// The packet comes straight from the network, so ParseTrap never trusts its structure: anything malformed
+// is reported as an error rather than a panic.
 func (w SNMP) ParseTrap(response []byte) (Trap, error) {
 	t := Trap{VarBinds: map[string]interface{}{}, VarBindOIDs: []string{}}
 
-	decodedResponse, err := DecodeSequence(response)
+	decodedResponse, err := DecodeSequenceWithLimits(response, w.DecodeLimits)
 	if err != nil {
 		return t, err
 	}
@@ -680,31 +2330,53 @@ func (w SNMP) ParseTrap(response []byte) (Trap, error) {
 	}
 
 	// Fetch the varbinds out of the packet.
-	t.Version = decodedResponse[1].(int)
+	var ok bool
+	if t.Version, ok = decodedResponse[1].(int); !ok {
+		return t, errors.New("Invalid Version")
+	}
 	if t.Version <= 1 {
 		t.Version++
 	}
 
 	if t.Version < 3 {
-		t.Community = decodedResponse[2].(string)
+		if t.Community, ok = decodedResponse[2].(string); !ok {
+			return t, errors.New("Invalid Community")
+		}
 	} else {
 		/*
 			for i, val := range decodedResponse{
 				fmt.Printf("Resp:%v:type=%v\n",i,reflect.TypeOf(val));
 			}
 		*/
-		v3HeaderStr := decodedResponse[3].(string)
-		v3HeaderDecoded, err := DecodeSequence([]byte(v3HeaderStr))
+		if len(decodedResponse) < 5 {
+			return t, errors.New("Invalid Decoded Response Length")
+		}
+		v3HeaderStr, ok1 := decodedResponse[3].(string)
+		encryptedResp, ok2 := decodedResponse[4].(string)
+		if !ok1 || !ok2 {
+			return t, errors.New("Invalid V3 message")
+		}
+		v3HeaderDecoded, err := DecodeSequenceWithLimits([]byte(v3HeaderStr), w.DecodeLimits)
 		if err != nil {
 			return t, err
 		}
+		if len(v3HeaderDecoded) < 7 {
+			return t, errors.New("Invalid V3 security parameters length")
+		}
 
-		w.engineID = v3HeaderDecoded[1].(string)
-		w.engineBoots = int32(v3HeaderDecoded[2].(int))
-		w.engineTime = int32(v3HeaderDecoded[3].(int))
-		w.user = v3HeaderDecoded[4].(string)
-		respAuthParam := v3HeaderDecoded[5].(string)
-		respPrivParam := v3HeaderDecoded[6].(string)
+		engineID, ok1 := v3HeaderDecoded[1].(string)
+		engineBoots, ok2 := v3HeaderDecoded[2].(int)
+		engineTime, ok3 := v3HeaderDecoded[3].(int)
+		user, ok4 := v3HeaderDecoded[4].(string)
+		respAuthParam, ok5 := v3HeaderDecoded[5].(string)
+		respPrivParam, ok6 := v3HeaderDecoded[6].(string)
+		if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || !ok6 {
+			return t, errors.New("Invalid V3 security parameters")
+		}
+		w.engineID = engineID
+		w.engineBoots = int32(engineBoots)
+		w.engineTime = int32(engineTime)
+		w.user = user
 
 		if len(respAuthParam) == 0 || len(respPrivParam) == 0 {
 			return t, errors.New("response is not encrypted")
@@ -731,22 +2403,39 @@ func (w SNMP) ParseTrap(response []byte) (Trap, error) {
 		t.Username = w.user
 
 		//keys
-		w.authKey = passwordToKey(w.authPwd, w.engineID, w.authAlg)
-		privKey := passwordToKey(w.privPwd, w.engineID, w.authAlg)
-		w.privKey = string(([]byte(privKey))[0:16])
+		if w.authKey, err = passwordToKey(w.authPwd, w.engineID, w.authAlg); err != nil {
+			return t, fmt.Errorf("auth key for user %s: %v", w.user, err)
+		}
+		if w.privKey, err = privPasswordToKey(w.privPwd, w.engineID, w.authAlg, w.privAlg); err != nil {
+			return t, fmt.Errorf("priv key for user %s: %v", w.user, err)
+		}
 
-		encryptedResp := decodedResponse[4].(string)
-		plainResp, _ := w.decrypt(encryptedResp, respPrivParam)
+		plainResp, err := w.decrypt(encryptedResp, respPrivParam)
+		if err != nil {
+			return t, fmt.Errorf("decrypting trap for user %s with %s/%s, engine boots %d: %v",
+				w.user, w.authAlg, w.privAlg, w.engineBoots, err)
+		}
 
-		pduDecoded, err := DecodeSequence([]byte(plainResp))
+		pduDecoded, err := DecodeSequenceWithLimits([]byte(plainResp), w.DecodeLimits)
 		if err != nil {
 			return t, err
 		}
+		if len(pduDecoded) < 4 {
+			return t, errors.New("Invalid Scoped PDU Length")
+		}
+		t.ContextEngineID, ok1 = pduDecoded[1].(string)
+		t.ContextName, ok2 = pduDecoded[2].(string)
+		if !ok1 || !ok2 {
+			return t, errors.New("Invalid Scoped PDU context")
+		}
 		decodedResponse = pduDecoded
 	}
 	//fmt.Printf("%#v\n",decodedResponse);
 
-	respPacket := decodedResponse[3].([]interface{})
+	respPacket, ok := decodedResponse[3].([]interface{})
+	if !ok {
+		return t, errors.New("Invalid Response Packet")
+	}
 	var varbinds []interface{}
 	if t.Version == 1 {
 		if len(respPacket) < 7 {
@@ -754,31 +2443,67 @@ func (w SNMP) ParseTrap(response []byte) (Trap, error) {
 			return t, errors.New("Invalid Response Packet Length")
 		}
 		t.OID, _ = respPacket[1].(Oid)
-		t.Address, _ = respPacket[2].(string)
+		t.Address = agentAddress(respPacket[2])
 		t.TrapType, _ = respPacket[3].(int)
 		t.Other = respPacket[4]
-		//fmt.Printf("Generic Trap: %d\n", respPacket[3])
-		varbinds = respPacket[6].([]interface{})
+		t.GenericTrap = t.TrapType
+		t.SpecificTrap, _ = respPacket[4].(int)
+		if timestamp, ok := respPacket[5].(time.Duration); ok {
+			t.Timestamp = TimeTicks(timestamp / (10 * time.Millisecond))
+		}
+		varbinds, ok = respPacket[6].([]interface{})
 	} else {
 		if len(respPacket) < 5 {
 			log.Printf("Error: Invalid Response Packet Length\ndecodedResponse: %v\nrespPacket: %v", decodedResponse, respPacket)
 			return t, errors.New("Invalid Response Packet Length")
 		}
-		varbinds = respPacket[4].([]interface{})
+		varbinds, ok = respPacket[4].([]interface{})
+		t.RequestID, _ = respPacket[1].(int)
+		t.Inform = respPacket[0] == AsnInform
+	}
+	if !ok {
+		return t, errors.New("Invalid Varbinds")
 	}
 
 	for i := 1; i < len(varbinds); i++ {
-		varoid := varbinds[i].([]interface{})[1]
-		result := varbinds[i].([]interface{})[2]
-		oid := varoid.(Oid).String()
-		t.VarBinds[oid] = result
+		varbind, ok := varbinds[i].([]interface{})
+		if !ok || len(varbind) < 3 {
+			return t, fmt.Errorf("Invalid Varbind %d", i)
+		}
+		varoid, ok := varbind[1].(Oid)
+		if !ok {
+			return t, fmt.Errorf("Invalid Varbind %d OID", i)
+		}
+		oid := varoid.String()
+		t.VarBinds[oid] = varbind[2]
 		t.VarBindOIDs = append(t.VarBindOIDs, oid)
 	}
 
 	return t, nil
 }
 
-// Close the net.conn in SNMP.
-func (w SNMP) Close() error {
+// LocalAddr returns the local address requests are sent from, e.g. to find the source port the OS picked.
+// It's nil when the object has no connection.
+func (w SNMP) LocalAddr() net.Addr {
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.LocalAddr()
+}
+
+// RemoteAddr returns the address of the agent requests are sent to. It's nil when the object has no
+// connection.
+func (w SNMP) RemoteAddr() net.Addr {
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.RemoteAddr()
+}
+
+// Close the net.conn in SNMP, after stopping the keepalive.
+func (w *SNMP) Close() error {
+	if w.keepAlive != nil {
+		w.keepAlive.stopAndWait()
+	}
 	return w.conn.Close()
 }
@@ -1,9 +1,17 @@
 package snmplib
 
 import (
+	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"math/rand" // Needed to set Seed, so a consistent request ID will be chosen.
+	"math/rand" // Seeded sources, so consistent request IDs are chosen.
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -101,8 +109,6 @@ func ExampleGet() {
 }
 
 func TestGet(t *testing.T) {
-	rand.Seed(0)
-
 	target := "magic_host"
 	community := "[R0_C@cti!]"
 	version := SNMPv2c
@@ -115,6 +121,7 @@ func TestGet(t *testing.T) {
 	udpStub.Expect("302e020101040b5b52305f4340637469215da01c020478fc2ffa020100020100300e300c06082b060102010103000500").AndRespond([]string{"3032020101040b5b52305f4340637469215da220020421182cd70201000201003012301006082b06010201010300430404926fa4"})
 
 	wsnmp := NewSNMPOnConn(target, community, version, 2*time.Second, 5, udpStub)
+	wsnmp.Rand = rand.NewSource(0)
 	//wsnmp, err := NewWapSNMP(target, community, version, 2*time.Second, 5)
 	defer wsnmp.Close()
 	val, err := wsnmp.Get(oid)
@@ -130,7 +137,6 @@ func TestGet(t *testing.T) {
 }
 
 func TestTrapV2(t *testing.T) {
-	rand.Seed(0)
 	target := "magic_host"
 	community := "public"
 	version := SNMPv2c
@@ -151,3 +157,3116 @@ func TestTrapV2(t *testing.T) {
 		t.Errorf("Error testing parsing v2 trap: %v.", err)
 	}
 }
+
+func TestNewSNMPv3Passwords(t *testing.T) {
+	tests := []struct {
+		authPwd string
+		privPwd string
+	}{
+		{"", "my_pcb_is_4_me"},
+		{"this_is_my_pcb", ""},
+		{"short", "my_pcb_is_4_me"},
+		{"this_is_my_pcb", "short"},
+	}
+
+	for _, test := range tests {
+		wsnmp, err := NewSNMPv3("127.0.0.1", "pcb.snmpv3", SnmpSHA1, test.authPwd, SnmpAES, test.privPwd, 2*time.Second, 5)
+		if err == nil {
+			wsnmp.Close()
+			t.Errorf("NewSNMPv3 accepted auth password '%s' and priv password '%s'", test.authPwd, test.privPwd)
+		}
+	}
+
+	if _, err := passwordToKey("", "engine", SnmpSHA1); err == nil {
+		t.Errorf("passwordToKey accepted an empty password")
+	}
+}
+
+// encodeBulkRequest encodes the GETBULK request wsnmp will send next for oid.
+func encodeBulkRequest(t testing.TB, version SNMPVersion, community string, oid Oid, maxRepetitions int) string {
+	// Work out which request ID GetBulk will pick with a Rand of rand.NewSource(0).
+	requestID := randomRequestID(rand.NewSource(0))
+
+	req, err := EncodeSequence([]interface{}{Sequence, int(version), community,
+		[]interface{}{AsnGetBulkRequest, requestID, 0, maxRepetitions,
+			[]interface{}{Sequence,
+				[]interface{}{Sequence, oid, nil}}}})
+	if err != nil {
+		t.Fatalf("Error encoding request: %v", err)
+	}
+	return hex.EncodeToString(req)
+}
+
+func TestGetTableWithRepetitions(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.2.2.1.2")
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.Expect(encodeBulkRequest(t, SNMPv2c, "public", oid, 10)).AndRespond([]string{encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.1"), "lo"},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.3.1"), 24})})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 5, udpStub)
+	wsnmp.Rand = rand.NewSource(0)
+	defer wsnmp.Close()
+	result, err := wsnmp.GetTableWithRepetitions(oid, 10)
+	if err != nil {
+		t.Fatalf("Error getting table: %v", err)
+	}
+	if len(result) != 1 || result[".1.3.6.1.2.1.2.2.1.2.1"] != "lo" {
+		t.Errorf("GetTableWithRepetitions returned %v", result)
+	}
+}
+
+func TestGetTableTooBig(t *testing.T) {
+	table := MustParseOid("1.3.6.1.2.1.2.2.1.1")
+	tooBig, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnGetResponse, 1, 1, 0, []interface{}{Sequence}}})
+	if err != nil {
+		t.Fatalf("Error encoding tooBig: %v", err)
+	}
+	var rows [][]interface{}
+	for idx := 1; idx <= 5; idx++ {
+		rows = append(rows, []interface{}{append(table.Copy(), idx), idx})
+	}
+
+	// The request is sent again with half as many repetitions.
+	udpStub := NewUdpStub(t)
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(tooBig)})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public", rows...)})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.1"), "lo"})})
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 0, udpStub)
+	var repetitions []int
+	wsnmp.OnSend = func(packet []byte) {
+		if msg, err := DecodeMessage(packet); err == nil {
+			repetitions = append(repetitions, msg.PDU.ErrorIndex)
+		}
+	}
+	result, err := wsnmp.GetTableWithRepetitions(table, 10)
+	if err != nil || len(result) != 5 {
+		t.Errorf("GetTable after a tooBig returned %d entries, %v, expected 5", len(result), err)
+	}
+	if expected := []int{10, 5, 5}; !reflect.DeepEqual(repetitions, expected) {
+		t.Errorf("GetTable sent requests with %v repetitions, expected %v", repetitions, expected)
+	}
+	wsnmp.Close()
+	udpStub.CheckClosed()
+
+	// With a single repetition, there's nothing left to shrink.
+	udpStub = NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(tooBig)})
+	wsnmp = NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 0, udpStub)
+	defer wsnmp.Close()
+	var pduErr *PDUError
+	if _, err := wsnmp.GetTableWithRepetitions(table, 1); !errors.As(err, &pduErr) || pduErr.ErrorStatus != 1 {
+		t.Errorf("GetTable of a single repetition answered tooBig returned %v, expected tooBig", err)
+	}
+}
+
+func TestGetTableNonIncreasingOid(t *testing.T) {
+	target := "magic_host"
+	community := "public"
+	version := SNMPv2c
+
+	oid := MustParseOid("1.3.6.1.2.1.2.2.1.2")
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// The agent answers with the oid we asked for, which would never make progress.
+	udpStub.Expect(encodeBulkRequest(t, version, community, oid, 50)).AndRespond([]string{encodeResponse(t, version, community, []interface{}{oid, 1})})
+
+	wsnmp := NewSNMPOnConn(target, community, version, 2*time.Second, 5, udpStub)
+	wsnmp.Rand = rand.NewSource(0)
+	defer wsnmp.Close()
+
+	if _, err := wsnmp.GetTable(oid); err == nil {
+		t.Errorf("GetTable accepted a non-increasing oid")
+	}
+}
+
+func TestEncryptDecrypt3DES(t *testing.T) {
+	engineID := "\x80\x00\x1f\x88\x80\x5e\x4c\x1c\x5a\x2b\x69\x4d\x59"
+	privKey, err := privPasswordToKey("my_pcb_is_4_me", engineID, SnmpSHA1, SnmpDES3)
+	if err != nil {
+		t.Fatalf("Error localizing 3DES key: %v", err)
+	}
+	if len(privKey) != 32 {
+		t.Fatalf("3DES key is %d bytes long, expected 32", len(privKey))
+	}
+
+	wsnmp := &SNMP{privAlg: SnmpDES3, privKey: privKey, engineBoots: 3, engineTime: 1234}
+	payload := "\x30\x0b\x04\x06public\x02\x01\x00"
+	encrypted, privParam, err := wsnmp.encrypt(payload)
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	if len(encrypted)%8 != 0 || encrypted[:len(payload)] == payload {
+		t.Errorf("Payload was not encrypted: %v", hex.EncodeToString([]byte(encrypted)))
+	}
+
+	decrypted, err := wsnmp.decrypt(encrypted, privParam)
+	if err != nil {
+		t.Fatalf("Error decrypting: %v", err)
+	}
+	if decrypted[:len(payload)] != payload {
+		t.Errorf("Decrypted payload %v, expected %v", hex.EncodeToString([]byte(decrypted)), hex.EncodeToString([]byte(payload)))
+	}
+}
+
+func TestEncrypt3DESKnownAnswer(t *testing.T) {
+	// The key is bytes 1 to 24, the pre-IV bytes 25 to 32. The ciphertext is from
+	// openssl enc -des-ede3-cbc -nopad, with the IV 191a1b1f0c3c2c64: the pre-IV xored with the salt.
+	privKey := string([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+		17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32})
+	wsnmp := &SNMP{privAlg: SnmpDES3, privKey: privKey, engineBoots: 3, engineTime: 1234, desIV: 0x11223343}
+	encrypted, privParam, err := wsnmp.encrypt("0123456789abcdef")
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	if salt := hex.EncodeToString([]byte(privParam)); salt != "0000000311223344" {
+		t.Errorf("Salt is %s, expected the engine boots 3 and the next salt 0x11223344", salt)
+	}
+	if ciphertext := hex.EncodeToString([]byte(encrypted)); ciphertext != "013d27cc29c73b1f9267b02b9f88a1c6" {
+		t.Errorf("Ciphertext is %s, expected 013d27cc29c73b1f9267b02b9f88a1c6", ciphertext)
+	}
+}
+
+func TestDecryptAESTrailingBytes(t *testing.T) {
+	wsnmp := &SNMP{privAlg: SnmpAES, privKey: "0123456789abcdef", engineBoots: 3, engineTime: 1234}
+	payload := "\x30\x0b\x04\x06public\x02\x01\x00"
+
+	// The agent encrypted more bytes than the scoped PDU holds.
+	encrypted, privParam, err := wsnmp.encrypt(payload + "\x00\x00\x00\x00\x00")
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	decrypted, err := wsnmp.decrypt(encrypted, privParam)
+	if err != nil {
+		t.Fatalf("Error decrypting: %v", err)
+	}
+	if decrypted != payload {
+		t.Errorf("Decrypted payload %v, expected %v", hex.EncodeToString([]byte(decrypted)), hex.EncodeToString([]byte(payload)))
+	}
+}
+
+// encodeV3Message encodes an encrypted SNMPv3 message the way agent would send it.
+func encodeV3Message(t testing.TB, agent *SNMP, pdu []interface{}) []byte {
+	return encodeV3MessageInContext(t, agent, "", pdu)
+}
+
+// encodeV3MessageInContext is encodeV3Message for a PDU in the contextName context.
+func encodeV3MessageInContext(t testing.TB, agent *SNMP, contextName string, pdu []interface{}) []byte {
+	scopedPDU, err := EncodeSequence([]interface{}{Sequence, agent.engineID, contextName, pdu})
+	if err != nil {
+		t.Fatalf("Error encoding scoped PDU: %v", err)
+	}
+	encrypted, privParam, err := agent.encrypt(string(scopedPDU))
+	if err != nil {
+		t.Fatalf("Error encrypting scoped PDU: %v", err)
+	}
+	v3Header, err := EncodeSequence([]interface{}{Sequence, agent.engineID,
+		int(agent.engineBoots), int(agent.engineTime), agent.user, strings.Repeat("\x01", 12), privParam})
+	if err != nil {
+		t.Fatalf("Error encoding v3 header: %v", err)
+	}
+	packet, err := EncodeSequence([]interface{}{Sequence, int(SNMPv3),
+		[]interface{}{Sequence, 1, maxMsgSize, string([]byte{3}), 3},
+		string(v3Header),
+		encrypted})
+	if err != nil {
+		t.Fatalf("Error encoding message: %v", err)
+	}
+	return packet
+}
+
+// decodeV3RequestOid decrypts an SNMPv3 request with the keys of agent and returns the oid of its first varbind.
+func decodeV3RequestOid(t testing.TB, agent *SNMP, packet []byte) Oid {
+	varbinds := decodeV3RequestPDU(t, agent, packet)[4].([]interface{})
+	return varbinds[1].([]interface{})[1].(Oid)
+}
+
+// respondV3 returns the responses of agent to SNMPv3 requests for udpStub.AndRespondTo: pdu, encoded
+// with the request ID of the request. The engine of agent is the one it has when respondV3 is called.
+func respondV3(t testing.TB, agent *SNMP, pdu []interface{}) func([]byte) []string {
+	return respondV3InContext(t, agent, "", pdu)
+}
+
+// respondV3InContext is respondV3 for a PDU in the contextName context.
+func respondV3InContext(t testing.TB, agent *SNMP, contextName string, pdu []interface{}) func([]byte) []string {
+	responder := *agent
+	return func(request []byte) []string {
+		response := append([]interface{}{pdu[0], decodeV3RequestPDU(t, &responder, request)[1]}, pdu[2:]...)
+		return []string{hex.EncodeToString(encodeV3MessageInContext(t, &responder, contextName, response))}
+	}
+}
+
+// decodeV3RequestPDU decrypts an SNMPv3 request with the keys of agent and returns its PDU.
+func decodeV3RequestPDU(t testing.TB, agent *SNMP, packet []byte) []interface{} {
+	decoded, err := DecodeSequence(packet)
+	if err != nil {
+		t.Fatalf("Error decoding request: %v", err)
+	}
+	usm, err := DecodeSequence([]byte(decoded[3].(string)))
+	if err != nil {
+		t.Fatalf("Error decoding security parameters: %v", err)
+	}
+	// The IV is built from the engine boots and time of the request.
+	receiver := *agent
+	receiver.engineBoots, receiver.engineTime = int32(usm[2].(int)), int32(usm[3].(int))
+	decrypted, err := receiver.decrypt(decoded[4].(string), usm[6].(string))
+	if err != nil {
+		t.Fatalf("Error decrypting request: %v", err)
+	}
+	scopedPDU, err := DecodeSequence([]byte(decrypted))
+	if err != nil {
+		t.Fatalf("Error decoding scoped PDU: %v", err)
+	}
+	return scopedPDU[3].([]interface{})
+}
+
+// newV3Agent returns an SNMP object holding the keys an agent would localize for these passwords.
+func newV3Agent(t testing.TB, user, authPwd, privPwd string) *SNMP {
+	agent := &SNMP{Version: SNMPv3, user: user, authAlg: SnmpSHA1, authPwd: authPwd, privAlg: SnmpAES, privPwd: privPwd,
+		engineID: "\x80\x00\x1f\x88\x80\x5e\x4c\x1c\x5a\x2b\x69\x4d\x59", engineBoots: 3, engineTime: 1234}
+	var err error
+	if agent.authKey, err = passwordToKey(authPwd, agent.engineID, agent.authAlg); err != nil {
+		t.Fatalf("Error localizing auth key: %v", err)
+	}
+	if agent.privKey, err = privPasswordToKey(privPwd, agent.engineID, agent.authAlg, agent.privAlg); err != nil {
+		t.Fatalf("Error localizing priv key: %v", err)
+	}
+	return agent
+}
+
+func TestGetV3WrongPassword(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	resp := encodeV3Message(t, agent, []interface{}{AsnGetResponse, 1, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, oid, 1}}})
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(resp)})
+
+	// Same user, but the manager was configured with another priv password.
+	wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "not_my_pcb_pwd")
+	wsnmp.conn = udpStub
+	wsnmp.retries = 5
+	defer wsnmp.Close()
+
+	if _, err := wsnmp.GetV3(oid); err == nil {
+		t.Errorf("GetV3 decrypted a response with the wrong password")
+	}
+}
+
+func TestTrapV3WrongPassword(t *testing.T) {
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	packet := encodeV3Message(t, agent, []interface{}{AsnTrap2, 1, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.1.3.0"), 1}}})
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	wsnmp := NewSNMPOnConn("", "", SNMPv3, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	wsnmp.TrapUsers = []V3user{{User: "pcb.snmpv3", AuthAlg: SnmpSHA1, AuthPwd: "this_is_my_pcb", PrivAlg: SnmpAES, PrivPwd: "not_my_pcb_pwd"}}
+
+	if _, err := wsnmp.ParseTrap(packet); err == nil {
+		t.Errorf("ParseTrap decrypted a trap with the wrong password")
+	}
+
+	// The right password decodes the same packet.
+	wsnmp.TrapUsers[0].PrivPwd = "my_pcb_is_4_me"
+	if _, err := wsnmp.ParseTrap(packet); err != nil {
+		t.Errorf("Error parsing v3 trap: %v", err)
+	}
+}
+
+func TestGetRaw(t *testing.T) {
+	target := "magic_host"
+	community := "[R0_C@cti!]"
+	version := SNMPv2c
+
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// Same exchange as TestGet.
+	udpStub.Expect("302e020101040b5b52305f4340637469215da01c020478fc2ffa020100020100300e300c06082b060102010103000500").AndRespond([]string{"3032020101040b5b52305f4340637469215da220020421182cd70201000201003012301006082b06010201010300430404926fa4"})
+
+	wsnmp := NewSNMPOnConn(target, community, version, 2*time.Second, 5, udpStub)
+	wsnmp.Rand = rand.NewSource(0)
+	defer wsnmp.Close()
+	resp, err := wsnmp.GetRaw([]Oid{oid})
+	if err != nil {
+		t.Fatalf("Error testing to get a raw response : %v.", err)
+	}
+
+	// The stub echoes the request ID, as the response to another request would be discarded.
+	if resp.RequestID != 0x78fc2ffa || resp.ErrorStatus != 0 || resp.ErrorIndex != 0 {
+		t.Errorf("Received wrong response header : %+v", resp)
+	}
+	if len(resp.VarBinds) != 1 || !resp.VarBinds[0].Oid.Equal(MustParseOid("1.3.6.1.2.1.1.3.0")) {
+		t.Fatalf("Received wrong varbinds : %v", resp.VarBinds)
+	}
+	if resp.VarBinds[0].Value != time.Duration(76705700)*10*time.Millisecond {
+		t.Errorf("Received wrong value : %v", resp.VarBinds[0].Value)
+	}
+}
+
+func TestSendRaw(t *testing.T) {
+	// Same exchange as TestGet, with the request encoded by hand.
+	request, err := hex.DecodeString("302e020101040b5b52305f4340637469215da01c020478fc2ffa020100020100300e300c06082b060102010103000500")
+	if err != nil {
+		t.Fatalf("Error decoding request: %v", err)
+	}
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.Expect(hex.EncodeToString(request)).AndRespond([]string{"3032020101040b5b52305f4340637469215da220020421182cd70201000201003012301006082b06010201010300430404926fa4"})
+
+	wsnmp := NewSNMPOnConn("magic_host", "[R0_C@cti!]", SNMPv2c, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	response, err := wsnmp.SendRaw(request)
+	if err != nil {
+		t.Fatalf("Error sending raw request: %v", err)
+	}
+	msg, err := DecodeMessage(response)
+	if err != nil {
+		t.Fatalf("Error decoding raw response: %v", err)
+	}
+	if msg.PDUType != AsnGetResponse || len(msg.PDU.VarBinds) != 1 || msg.PDU.VarBinds[0].Value != time.Duration(76705700)*10*time.Millisecond {
+		t.Errorf("Received wrong response: %+v", msg)
+	}
+}
+
+func TestNewSNMPFromAddr(t *testing.T) {
+	wsnmp, err := NewSNMPFromAddr("127.0.0.1", "127.0.0.1", "public", SNMPv2c, 2*time.Second, 5)
+	if err != nil {
+		t.Fatalf("Error creating SNMP from a local address: %v", err)
+	}
+	defer wsnmp.Close()
+
+	if host, _, _ := net.SplitHostPort(wsnmp.conn.LocalAddr().String()); host != "127.0.0.1" {
+		t.Errorf("Connection is bound to %v, expected 127.0.0.1", wsnmp.conn.LocalAddr())
+	}
+
+	if _, err := NewSNMPFromAddr("not an address", "127.0.0.1", "public", SNMPv2c, 2*time.Second, 5); err == nil {
+		t.Errorf("NewSNMPFromAddr accepted an invalid local address")
+	}
+}
+
+func TestStats(t *testing.T) {
+	target := "magic_host"
+	community := "[R0_C@cti!]"
+	version := SNMPv2c
+
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// Same exchange as TestGet, then a request answered with an empty packet.
+	udpStub.Expect("302e020101040b5b52305f4340637469215da01c020478fc2ffa020100020100300e300c06082b060102010103000500").AndRespond([]string{"3032020101040b5b52305f4340637469215da220020421182cd70201000201003012301006082b06010201010300430404926fa4"})
+	udpStub.ExpectAny()
+
+	wsnmp := NewSNMPOnConn(target, community, version, 2*time.Second, 5, udpStub)
+	wsnmp.Rand = rand.NewSource(0)
+	defer wsnmp.Close()
+	if _, err := wsnmp.Get(oid); err != nil {
+		t.Errorf("Error testing to get a value : %v.", err)
+	}
+	if _, err := wsnmp.Get(oid); err == nil {
+		t.Errorf("Get decoded an empty response")
+	}
+
+	expected := StatsSnapshot{Requests: 2, DecodeErrors: 1}
+	if stats := wsnmp.Stats(); stats != expected {
+		t.Errorf("Stats are %+v, expected %+v", stats, expected)
+	}
+}
+
+func TestClone(t *testing.T) {
+	wsnmp, err := NewSNMPv3("127.0.0.1", "pcb.snmpv3", SnmpSHA1, "this_is_my_pcb", SnmpAES, "my_pcb_is_4_me", 2*time.Second, 5)
+	if err != nil {
+		t.Fatalf("Error creating SNMP: %v", err)
+	}
+	defer wsnmp.Close()
+	wsnmp.engineID = "engine"
+	wsnmp.engineBoots = 3
+	wsnmp.DialTimeout = time.Second
+
+	clone, err := wsnmp.Clone()
+	if err != nil {
+		t.Fatalf("Error cloning SNMP: %v", err)
+	}
+	defer clone.Close()
+
+	if clone.conn == wsnmp.conn || clone.conn.LocalAddr().String() == wsnmp.conn.LocalAddr().String() {
+		t.Errorf("Clone shares the connection %v", clone.conn.LocalAddr())
+	}
+	if clone.Target != wsnmp.Target || clone.user != wsnmp.user || clone.privPwd != wsnmp.privPwd || clone.timeout != wsnmp.timeout || clone.retries != wsnmp.retries || clone.DialTimeout != time.Second {
+		t.Errorf("Clone has different settings: %+v", clone)
+	}
+	if clone.engineID != "" || clone.engineBoots != 0 {
+		t.Errorf("Clone copied the v3 session state")
+	}
+}
+
+func TestErrorTypes(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+
+	// The agent doesn't answer.
+	udpStub := NewUdpStub(t)
+	udpStub.timeoutWhenEmpty = true
+	udpStub.ExpectAny()
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 0, udpStub)
+	_, err := wsnmp.Get(oid)
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || !timeoutErr.Timeout() {
+		t.Errorf("Expected a TimeoutError, got %v", err)
+	}
+	if stats := wsnmp.Stats(); stats.Timeouts != 1 {
+		t.Errorf("Expected 1 timeout, got %+v", stats)
+	}
+	if !errors.Is(err, ErrNoResponse) {
+		t.Errorf("Expected ErrNoResponse, got %v", err)
+	}
+
+	// The agent answers noSuchName.
+	resp, err := EncodeSequence([]interface{}{Sequence, int(SNMPv1), "public",
+		[]interface{}{AsnGetResponse, 1, 2, 1,
+			[]interface{}{Sequence,
+				[]interface{}{Sequence, oid, nil}}}})
+	if err != nil {
+		t.Fatalf("Error encoding response: %v", err)
+	}
+	udpStub = NewUdpStub(t)
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(resp)})
+	wsnmp = NewSNMPOnConn("magic_host", "public", SNMPv1, 2*time.Second, 0, udpStub)
+	_, err = wsnmp.Get(oid)
+	var pduErr *PDUError
+	if !errors.As(err, &pduErr) || pduErr.ErrorStatus != 2 || pduErr.ErrorIndex != 1 {
+		t.Errorf("Expected a noSuchName PDUError, got %v", err)
+	}
+
+	// The agent answers garbage.
+	udpStub = NewUdpStub(t)
+	udpStub.ExpectAny().AndRespond([]string{"0401"})
+	wsnmp = NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 0, udpStub)
+	_, err = wsnmp.Get(oid)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Errorf("Expected a DecodeError, got %v", err)
+	}
+}
+
+func TestVersionChecks(t *testing.T) {
+	if _, err := NewSNMP("127.0.0.1", "public", SNMPv3, 2*time.Second, 5); err == nil {
+		t.Errorf("NewSNMP accepted SNMP v3")
+	}
+
+	udpStub := NewUdpStub(t)
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv1, 2*time.Second, 5, udpStub)
+	if _, err := wsnmp.GetBulk(MustParseOid("1.3.6.1.2.1"), 50); err == nil || !strings.Contains(err.Error(), "not v1") {
+		t.Errorf("GetBulk with SNMP v1 returned %v, expected an error about v1", err)
+	}
+	// Nothing is sent, the stub expects no request.
+	if _, err := wsnmp.GetTable(MustParseOid("1.3.6.1.2.1.2.2")); err == nil || strings.Contains(err.Error(), "received") {
+		t.Errorf("GetTable with SNMP v1 returned %v, expected the GetBulk version error", err)
+	}
+	if _, err := wsnmp.GetColumns(MustParseOid("1.3.6.1.2.1.2.2.1"), []Oid{{2}}); err == nil {
+		t.Errorf("GetColumns accepted SNMP v1")
+	}
+}
+
+func FuzzParseTrap(f *testing.F) {
+	for _, packet := range []string{
+		"304302010104067075626c6963a73602047cd94c540201000201003028301006082b0601020101030043043aa3e6303014060a2b06010603010104010006062b0601020100",
+		"3003020103",
+	} {
+		seed, err := hex.DecodeString(packet)
+		if err != nil {
+			f.Fatalf("Error while decoding seed packet : '%v'", err)
+		}
+		f.Add(seed)
+	}
+
+	agent := newV3Agent(f, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	f.Add(encodeV3Message(f, agent, []interface{}{AsnTrap2, 1, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.1.3.0"), 1}}}))
+
+	wsnmp := NewSNMPOnConn("", "", SNMPv3, 2*time.Second, 5, nil)
+	wsnmp.TrapUsers = []V3user{{User: "pcb.snmpv3", AuthAlg: SnmpSHA1, AuthPwd: "this_is_my_pcb", PrivAlg: SnmpAES, PrivPwd: "my_pcb_is_4_me"}}
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		// Only checking ParseTrap doesn't panic.
+		wsnmp.ParseTrap(packet)
+	})
+}
+
+func TestValidateCommunity(t *testing.T) {
+	tests := []struct {
+		community     string
+		strict        bool
+		expectFailure bool
+	}{
+		{"public", false, false},
+		{"[R0_C@cti!]", true, false},
+		{"", false, true},
+		{"pub\x00lic", false, true},
+		{strings.Repeat("a", 256), false, true},
+		{"caf\xc3\xa9", false, false},
+		{"caf\xc3\xa9", true, true},
+		{"tab\tbed", true, true},
+	}
+
+	for _, test := range tests {
+		if err := ValidateCommunity(test.community, test.strict); (err != nil) != test.expectFailure {
+			t.Errorf("ValidateCommunity %q strict=%v got error '%v', expected failure %v", test.community, test.strict, err, test.expectFailure)
+		}
+	}
+
+	if _, err := NewSNMP("127.0.0.1", "pub\x00lic", SNMPv2c, 2*time.Second, 5); err == nil {
+		t.Errorf("NewSNMP accepted a community containing NUL")
+	}
+}
+
+// encodeResponse encodes a GetResponse packet holding varbinds, each an oid and value pair.
+func encodeResponse(t testing.TB, version SNMPVersion, community string, varbinds ...[]interface{}) string {
+	vbs := []interface{}{Sequence}
+	for _, varbind := range varbinds {
+		vbs = append(vbs, append([]interface{}{Sequence}, varbind...))
+	}
+	packet, err := EncodeSequence([]interface{}{Sequence, int(version), community,
+		[]interface{}{AsnGetResponse, 1, 0, 0, vbs}})
+	if err != nil {
+		t.Fatalf("Error encoding response: %v", err)
+	}
+	return hex.EncodeToString(packet)
+}
+
+func TestSnmpWalk(t *testing.T) {
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public", []interface{}{MustParseOid("1.3.6.1.2.1.1.1.0"), "router"})})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public", []interface{}{MustParseOid("1.3.6.1.2.1.1.4.0"), "noc\x00"})})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public", []interface{}{MustParseOid("1.3.6.1.2.1.2.1.0"), 2})})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	result, err := wsnmp.SnmpWalk(MustParseOid("1.3.6.1.2.1.1"))
+	if err != nil {
+		t.Fatalf("Error walking: %v", err)
+	}
+
+	expected := []string{
+		`.1.3.6.1.2.1.1.1.0 = STRING: "router"`,
+		`.1.3.6.1.2.1.1.4.0 = Hex-STRING: 6E 6F 63 00 `,
+	}
+	if len(result) != len(expected) {
+		t.Fatalf("Walk returned %v, expected %v", result, expected)
+	}
+	for idx, varbind := range result {
+		if varbind.String() != expected[idx] {
+			t.Errorf("Walk returned '%v', expected '%v'", varbind, expected[idx])
+		}
+	}
+}
+
+func TestVarBindString(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	tests := map[string]VarBind{
+		".1.3.6.1.2.1.1.3.0 = Timeticks: (76705700) 8 days, 21:04:17.00":          {oid, time.Duration(76705700) * 10 * time.Millisecond},
+		".1.3.6.1.2.1.1.3.0 = Timeticks: (123) 0:00:01.23":                        {oid, time.Duration(123) * 10 * time.Millisecond},
+		".1.3.6.1.2.1.1.3.0 = INTEGER: 42":                                        {oid, 42},
+		".1.3.6.1.2.1.1.3.0 = Counter64: 42":                                      {oid, uint64(42)},
+		".1.3.6.1.2.1.1.3.0 = OID: .1.3.6.1.4.1.9":                                {oid, MustParseOid("1.3.6.1.4.1.9")},
+		".1.3.6.1.2.1.1.3.0 = NULL":                                               {oid, nil},
+		".1.3.6.1.2.1.1.3.0 = No Such Object available on this agent at this OID": {oid, NoSuchObject},
+	}
+
+	for expected, varbind := range tests {
+		if varbind.String() != expected {
+			t.Errorf("VarBind formatted as '%v', expected '%v'", varbind, expected)
+		}
+	}
+}
+
+func TestGetBulkEndOfMibView(t *testing.T) {
+	last := MustParseOid("1.3.6.1.6.3.16.1.5.2.1.6.3")
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// The agent reached the end of the MIB after a single varbind.
+	response := encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{last, 1},
+		[]interface{}{last, EndOfMibView},
+		[]interface{}{last, EndOfMibView})
+	udpStub.ExpectAny().AndRespond([]string{response})
+	udpStub.ExpectAny().AndRespond([]string{response})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	result, err := wsnmp.GetBulk(MustParseOid("1.3.6.1.6.3.16.1.5.2.1.6"), 3)
+	if err != nil {
+		t.Fatalf("Error in GetBulk: %v", err)
+	}
+	expected := map[string]interface{}{last.String(): 1}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("GetBulk returned %v, expected %v", result, expected)
+	}
+
+	// GetTable stops there, without asking for more.
+	table, err := wsnmp.GetTable(MustParseOid("1.3.6.1.6.3.16.1.5.2.1.6"))
+	if err != nil || !reflect.DeepEqual(table, expected) {
+		t.Errorf("GetTable returned %v, %v, expected %v", table, err, expected)
+	}
+}
+
+func TestGetBulkWithin(t *testing.T) {
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.1"), "lo"},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.2"), "eth0"},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.3.1"), 24})})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	result, err := wsnmp.GetBulkWithin(MustParseOid("1.3.6.1.2.1.2.2.1.2"), 3)
+	if err != nil {
+		t.Fatalf("Error in GetBulkWithin: %v", err)
+	}
+
+	expected := map[string]interface{}{".1.3.6.1.2.1.2.2.1.2.1": "lo", ".1.3.6.1.2.1.2.2.1.2.2": "eth0"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("GetBulkWithin returned %v, expected %v", result, expected)
+	}
+}
+
+func TestDecodePacket(t *testing.T) {
+	packet, err := hex.DecodeString("3032020101040b5b52305f4340637469215da220020421182cd70201000201003012301006082b06010201010300430404926fa4")
+	if err != nil {
+		t.Fatalf("Error while decoding packet : '%v'", err)
+	}
+	resp, err := DecodePacket(packet)
+	if err != nil {
+		t.Fatalf("Error decoding packet: %v", err)
+	}
+	if resp.RequestID != 0x21182cd7 || len(resp.VarBinds) != 1 || resp.VarBinds[0].Value != time.Duration(76705700)*10*time.Millisecond {
+		t.Errorf("Packet decoded as %+v", resp)
+	}
+
+	if _, err := DecodePacket(packet[:10]); err == nil {
+		t.Errorf("DecodePacket accepted a truncated packet")
+	}
+
+	trapPacket, err := hex.DecodeString("304302010104067075626c6963a73602047cd94c540201000201003028301006082b0601020101030043043aa3e6303014060a2b06010603010104010006062b0601020100")
+	if err != nil {
+		t.Fatalf("Error while decoding trap packet : '%v'", err)
+	}
+	trap, err := DecodeTrap(trapPacket)
+	if err != nil {
+		t.Fatalf("Error decoding trap: %v", err)
+	}
+	if trap.Community != "public" || len(trap.VarBindOIDs) != 2 {
+		t.Errorf("Trap decoded as %+v", trap)
+	}
+}
+
+func TestGetColumns(t *testing.T) {
+	ifEntry := MustParseOid("1.3.6.1.2.1.2.2.1")
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// ifType stops after index 2, ifDescr goes on to index 3.
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.1"), "lo"},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.3.1"), 24},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.2"), "eth0"},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.3.2"), 6},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.3"), "eth1"},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.4.1"), 65536})})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.3.1"), 24})})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	result, err := wsnmp.GetColumns(ifEntry, []Oid{{2}, {3}})
+	if err != nil {
+		t.Fatalf("Error in GetColumns: %v", err)
+	}
+
+	expected := map[string]map[string]interface{}{
+		".1": {".2": "lo", ".3": 24},
+		".2": {".2": "eth0", ".3": 6},
+		".3": {".2": "eth1"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("GetColumns returned %v, expected %v", result, expected)
+	}
+}
+
+func TestGetTableRows(t *testing.T) {
+	ifEntry := MustParseOid("1.3.6.1.2.1.2.2.1")
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// ifType is shorter than ifDescr, and has no instance at index 2.
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.1"), "lo"},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.3.1"), 24},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.2"), "eth0"},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.3.2"), NoSuchInstance},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.3"), "eth1"},
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.4.1"), 65536})})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.3.1"), 24})})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	rows, err := wsnmp.GetTableRows(ifEntry, []Oid{{2}, {3}})
+	if err != nil {
+		t.Fatalf("Error in GetTableRows: %v", err)
+	}
+
+	tests := []struct {
+		index, column string
+		value         interface{}
+		status        CellStatus
+	}{
+		{".1", ".3", 24, CellPresent},
+		{".2", ".3", NoSuchInstance, CellException},
+		{".3", ".2", "eth1", CellPresent},
+		{".3", ".3", nil, CellAbsent},
+		{".1", ".4", nil, CellNotRequested},
+	}
+	for _, test := range tests {
+		if value, status := rows.Cell(test.index, test.column); value != test.value || status != test.status {
+			t.Errorf("Cell(%s, %s) is %v, %v, expected %v, %v", test.index, test.column, value, status, test.value, test.status)
+		}
+	}
+}
+
+// encodeV3Report encodes the unencrypted report an agent sends when a request is outside its time window.
+func encodeV3Report(t testing.TB, agent *SNMP) []byte {
+	return encodeV3ReportOf(t, agent, MustParseOid("1.3.6.1.6.3.15.1.1.2.0"))
+}
+
+// encodeV3ReportOf encodes the unencrypted report of the usmStats counter an agent sends.
+func encodeV3ReportOf(t testing.TB, agent *SNMP, counter Oid) []byte {
+	v3Header, err := EncodeSequence([]interface{}{Sequence, agent.engineID,
+		int(agent.engineBoots), int(agent.engineTime), agent.user, strings.Repeat("\x01", 12), ""})
+	if err != nil {
+		t.Fatalf("Error encoding v3 header: %v", err)
+	}
+	packet, err := EncodeSequence([]interface{}{Sequence, int(SNMPv3),
+		[]interface{}{Sequence, 1, maxMsgSize, string([]byte{1}), 3},
+		string(v3Header),
+		[]interface{}{Sequence, agent.engineID, "",
+			[]interface{}{AsnReport, 1, 0, 0,
+				[]interface{}{Sequence, []interface{}{Sequence, counter, 1}}}}})
+	if err != nil {
+		t.Fatalf("Error encoding report: %v", err)
+	}
+	return packet
+}
+
+func TestGetV3ReportRetry(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	agent.engineTime = 5678
+	report := encodeV3Report(t, agent)
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(report)})
+	udpStub.ExpectAny().AndRespondTo(respondV3(t, agent, []interface{}{AsnGetResponse, 0, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, oid, 42}}}))
+
+	wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	wsnmp.conn = udpStub
+	wsnmp.ReportRetries = 1
+	defer wsnmp.Close()
+
+	val, err := wsnmp.GetV3(oid)
+	if err != nil {
+		t.Fatalf("Error getting value after a report: %v", err)
+	}
+	if val != 42 || wsnmp.engineTime != 5678 {
+		t.Errorf("Received value %v with engine time %d, expected 42 and 5678", val, wsnmp.engineTime)
+	}
+
+	// Without retries the report is returned.
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(report)})
+	wsnmp.ReportRetries = 0
+	_, err = wsnmp.GetV3(oid)
+	if reportErr, ok := err.(*ReportError); !ok || reportErr.Oid.String() != ".1.3.6.1.6.3.15.1.1.2.0" {
+		t.Errorf("Expected a notInTimeWindows ReportError, got %v", err)
+	}
+}
+
+func TestGetV3RequestIDMismatch(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	// The msgID is echoed, but the PDU answers another request.
+	resp := encodeV3Message(t, agent, []interface{}{AsnGetResponse, 1, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, oid, 42}}})
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(resp)})
+
+	wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	wsnmp.conn = udpStub
+	defer wsnmp.Close()
+	if val, err := wsnmp.GetV3(oid); err == nil || !strings.Contains(err.Error(), "response to request 1") {
+		t.Errorf("GetV3 of a response to another request returned %v, %v, expected an error", val, err)
+	}
+}
+
+func TestEmptyVarBinds(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public")})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public")})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+
+	val, err := wsnmp.Get(oid)
+	if err != nil || val != nil {
+		t.Errorf("Get returned (%v, %v), expected no value", val, err)
+	}
+	resultOid, val, err := wsnmp.GetNext(oid)
+	if err != nil || val != EndOfMibView || !resultOid.Equal(oid) {
+		t.Errorf("GetNext returned (%v, %v, %v), expected endOfMibView", resultOid, val, err)
+	}
+}
+
+func TestGetNextV3EndOfMibView(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.9.1.4.9")
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespondTo(respondV3(t, agent, []interface{}{AsnGetResponse, 0, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, oid, EndOfMibView}}}))
+	udpStub.ExpectAny().AndRespondTo(respondV3(t, agent, []interface{}{AsnGetResponse, 0, 0, 0, []interface{}{Sequence}}))
+
+	wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	wsnmp.conn = udpStub
+	defer wsnmp.Close()
+
+	for i := 0; i < 2; i++ {
+		resultOid, val, err := wsnmp.GetNextV3(oid)
+		if err != nil || val != EndOfMibView || !resultOid.Equal(oid) {
+			t.Errorf("GetNextV3 returned (%v, %v, %v), expected endOfMibView", resultOid, val, err)
+		}
+	}
+}
+
+func TestWalkV3(t *testing.T) {
+	root := MustParseOid("1.3.6.1.2.1.1.9.1.3")
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	responses := []interface{}{
+		[]interface{}{Sequence, MustParseOid("1.3.6.1.2.1.1.9.1.3.1"), "first"},
+		[]interface{}{Sequence, MustParseOid("1.3.6.1.2.1.1.9.1.3.2"), "second"},
+		[]interface{}{Sequence, MustParseOid("1.3.6.1.2.1.1.9.1.4.1"), 42},
+	}
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// The agent moves its engine time in the middle of the walk.
+	udpStub.ExpectAny().AndRespondTo(respondV3(t, agent,
+		[]interface{}{AsnGetResponse, 0, 0, 0, []interface{}{Sequence, responses[0]}}))
+	agent.engineTime = 5678
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3Report(t, agent))})
+	for _, varbind := range responses[1:] {
+		udpStub.ExpectAny().AndRespondTo(respondV3(t, agent,
+			[]interface{}{AsnGetResponse, 0, 0, 0, []interface{}{Sequence, varbind}}))
+	}
+
+	wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	wsnmp.conn = udpStub
+	wsnmp.ReportRetries = 1
+	defer wsnmp.Close()
+
+	result, err := wsnmp.WalkV3(root)
+	if err != nil {
+		t.Fatalf("Error walking: %v", err)
+	}
+	if len(result) != 2 || result[0].Value != "first" || result[1].Value != "second" {
+		t.Errorf("WalkV3 returned %v", result)
+	}
+
+	// A walk ends on endOfMibView too.
+	udpStub.ExpectAny().AndRespondTo(respondV3(t, agent,
+		[]interface{}{AsnGetResponse, 0, 0, 0, []interface{}{Sequence, []interface{}{Sequence, root, EndOfMibView}}}))
+	result, err = wsnmp.WalkV3(root)
+	if err != nil || len(result) != 0 {
+		t.Errorf("WalkV3 at the end of the MIB returned %v, %v", result, err)
+	}
+
+	// Without report retries, the walk resumes after the report from the last oid received.
+	agent.engineTime = 1234
+	wsnmp.ReportRetries = 0
+	var requested []Oid
+	wsnmp.OnSend = func(packet []byte) {
+		requested = append(requested, decodeV3RequestOid(t, agent, packet))
+	}
+	udpStub.ExpectAny().AndRespondTo(respondV3(t, agent,
+		[]interface{}{AsnGetResponse, 0, 0, 0, []interface{}{Sequence, responses[0]}}))
+	agent.engineTime = 9012
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3Report(t, agent))})
+	for _, varbind := range responses[1:] {
+		udpStub.ExpectAny().AndRespondTo(respondV3(t, agent,
+			[]interface{}{AsnGetResponse, 0, 0, 0, []interface{}{Sequence, varbind}}))
+	}
+	result, err = wsnmp.WalkV3(root)
+	if err != nil || len(result) != 2 || result[0].Value != "first" || result[1].Value != "second" || wsnmp.engineTime != 9012 {
+		t.Errorf("WalkV3 with a report returned %v, %v with engine time %d", result, err, wsnmp.engineTime)
+	}
+	first := responses[0].([]interface{})[1].(Oid)
+	expected := []Oid{root, first, first, result[1].Oid}
+	if !reflect.DeepEqual(requested, expected) {
+		t.Errorf("WalkV3 with a report requested %v, expected %v", requested, expected)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	gets := make(chan Oid, 10)
+	agent := &Agent{HandleGet: func(oid Oid) (interface{}, error) {
+		gets <- oid
+		return time.Second, nil
+	}}
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer server.Close()
+	go agent.Serve(server)
+
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to agent: %v", err)
+	}
+	wsnmp := NewSNMPOnConn(server.LocalAddr().String(), "public", SNMPv2c, time.Second, 1, conn)
+	if err := wsnmp.StartKeepAlive(); err == nil {
+		t.Errorf("Started a keepalive without an interval")
+	}
+	wsnmp.KeepAlive = 10 * time.Millisecond
+	if err := wsnmp.StartKeepAlive(); err != nil {
+		t.Fatalf("Error starting keepalive: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case oid := <-gets:
+			if !oid.Equal(sysUpTime) {
+				t.Errorf("Keepalive got %v, expected sysUpTime.0", oid)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No keepalive request received")
+		}
+	}
+	// User requests interleave with the keepalive ones.
+	if _, err := wsnmp.Get(sysUpTime); err != nil {
+		t.Errorf("Error getting while the keepalive runs: %v", err)
+	}
+
+	wsnmp.Close()
+	select {
+	case <-wsnmp.keepAlive.done:
+	default:
+		t.Errorf("Keepalive goroutine still running after Close")
+	}
+}
+
+func TestKeepAliveV3(t *testing.T) {
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	respond := respondV3(t, agent, []interface{}{AsnGetResponse, 0, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, sysUpTime, time.Second}}})
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer server.Close()
+	requests := make(chan []byte, 10)
+	go func() {
+		udpStub := NewUdpStub(t)
+		buf := make([]byte, bufSize)
+		for {
+			numRead, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			request := append([]byte(nil), buf[:numRead]...)
+			select {
+			case requests <- request:
+			default:
+			}
+			packet, _ := hex.DecodeString(udpStub.echoID(request, respond(request)[0]))
+			server.WriteTo(packet, addr)
+		}
+	}()
+
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	wsnmp.conn = conn
+	wsnmp.mu = &sync.Mutex{}
+	wsnmp.KeepAlive = 10 * time.Millisecond
+	if err := wsnmp.StartKeepAlive(); err != nil {
+		t.Fatalf("Error starting keepalive: %v", err)
+	}
+
+	// The discovered agent gets authenticated requests, rather than discovery probes every time.
+	for i := 0; i < 2; i++ {
+		select {
+		case request := <-requests:
+			decoded, err := DecodeSequence(request)
+			if err != nil {
+				t.Fatalf("Error decoding keepalive request: %v", err)
+			}
+			if flags, err := msgFlagsOf(decoded); err != nil || !flags.atLeast(v3SecurityLevel) {
+				t.Errorf("Keepalive request is %v, %v, expected %v", flags, err, v3SecurityLevel)
+			}
+			if oid := decodeV3RequestOid(t, agent, request); !oid.Equal(sysUpTime) {
+				t.Errorf("Keepalive got %v, expected sysUpTime.0", oid)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No keepalive request received")
+		}
+	}
+
+	wsnmp.Close()
+}
+
+func TestGenerateEngineID(t *testing.T) {
+	engineID := GenerateEngineID(8072)
+	if err := ValidateEngineID(engineID); err != nil {
+		t.Errorf("Generated an invalid engine ID: %v", err)
+	}
+	if !strings.HasPrefix(engineID, "\x80\x00\x1f\x88\x05") || len(engineID) != 13 {
+		t.Errorf("Generated engine ID %x, expected 80001f8805 and 8 octets", engineID)
+	}
+	if other := GenerateEngineID(8072); other == engineID {
+		t.Errorf("Generated the same engine ID %x twice", engineID)
+	}
+
+	for _, engineID := range []string{"", "\x80\x00\x1f\x88", strings.Repeat("\x01", 33)} {
+		if err := ValidateEngineID(engineID); err == nil {
+			t.Errorf("Engine ID %x of %d octets is valid", engineID, len(engineID))
+		}
+	}
+}
+
+func TestParseEngineID(t *testing.T) {
+	raw := "\x80\x00\x1f\x88\x80\x5e\x4c\x1c\x5a\x2b\x69\x4d\x59"
+	for _, s := range []string{
+		"80:00:1f:88:80:5e:4c:1c:5a:2b:69:4d:59",
+		"80 00 1F 88 80 5E 4C 1C 5A 2B 69 4D 59",
+		"80001f88805e4c1c5a2b694d59",
+		"0x80001f88805e4c1c5a2b694d59",
+		" 80:0:1f:88:80:5e:4c:1c:5a:2b:69:4d:59\n",
+	} {
+		engineID, err := ParseEngineID(s)
+		if err != nil || engineID != raw {
+			t.Errorf("ParseEngineID(%q) returned %x, %v", s, engineID, err)
+		}
+	}
+	for _, s := range []string{"", "80:00:1f", "80001f88805e4c1c5a2b694d5", "80:00:1f:88:zz", "80:000:1f:88:80"} {
+		if engineID, err := ParseEngineID(s); err == nil {
+			t.Errorf("ParseEngineID(%q) returned %x, expected an error", s, engineID)
+		}
+	}
+
+	if formatted := FormatEngineID(raw); formatted != "80:00:1f:88:80:5e:4c:1c:5a:2b:69:4d:59" {
+		t.Errorf("FormatEngineID returned %q", formatted)
+	}
+}
+
+func TestSetEngineID(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3Report(t, agent))})
+	udpStub.ExpectAny().AndRespondTo(respondV3(t, agent, []interface{}{AsnGetResponse, 0, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, oid, 42}}}))
+
+	wsnmp := &SNMP{Version: SNMPv3, user: "pcb.snmpv3", authAlg: SnmpSHA1, authPwd: "this_is_my_pcb",
+		privAlg: SnmpAES, privPwd: "my_pcb_is_4_me", conn: udpStub, ReportRetries: 1}
+	defer wsnmp.Close()
+	if err := wsnmp.SetEngineID(FormatEngineID(agent.engineID)); err != nil {
+		t.Fatalf("Error setting engine ID: %v", err)
+	}
+	if wsnmp.authKey != agent.authKey || wsnmp.privKey != agent.privKey {
+		t.Errorf("SetEngineID localized different keys than the agent")
+	}
+
+	val, err := wsnmp.GetV3(oid)
+	if err != nil || val != 42 {
+		t.Errorf("GetV3 without Discover returned %v, %v", val, err)
+	}
+}
+
+func TestNoResponse(t *testing.T) {
+	// Nothing listens on the port of a closed socket.
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	addr := closed.LocalAddr().String()
+	closed.Close()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing %v: %v", addr, err)
+	}
+	wsnmp := NewSNMPOnConn(addr, "public", SNMPv2c, time.Second, 1, conn)
+	defer wsnmp.Close()
+
+	// The host refuses the request, sending it again wouldn't help.
+	_, err = wsnmp.Get(MustParseOid("1.3.6.1.2.1.1.3.0"))
+	if !errors.Is(err, ErrNoResponse) {
+		t.Fatalf("Expected ErrNoResponse, got %v", err)
+	}
+	var noResponseErr *NoResponseError
+	if !errors.As(err, &noResponseErr) || noResponseErr.Target != addr || noResponseErr.Attempts != 1 {
+		t.Errorf("Expected a NoResponseError for 1 attempt to %v, got %#v", addr, err)
+	}
+	if errors.Unwrap(err) == nil {
+		t.Errorf("NoResponseError doesn't wrap the connection error")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	client := newMibClient(t, []VarBind{
+		{MustParseOid("1.3.6.1.2.1.1.5.0"), "router"},
+		{MustParseOid("1.3.6.1.2.1.1.9.1.2.1"), MustParseOid("1.3.6.1.6.3.1")},
+		{MustParseOid("1.3.6.1.2.1.1.9.1.2.2"), MustParseOid("1.3.6.1.2.1.49")},
+		// The sysORID of the third entry isn't an oid, it's skipped.
+		{MustParseOid("1.3.6.1.2.1.1.9.1.2.3"), "1.3.6.1.2.1.50"},
+		{MustParseOid("1.3.6.1.2.1.1.9.1.3.1"), "The MIB module for SNMP entities"},
+		{MustParseOid("1.3.6.1.2.1.1.9.1.3.2"), "The MIB module for managing TCP implementations"},
+		{MustParseOid("1.3.6.1.2.1.1.9.1.3.3"), "The MIB module for managing UDP implementations"},
+		{MustParseOid("1.3.6.1.2.1.1.9.1.4.1"), 12 * time.Second},
+		{MustParseOid("1.3.6.1.2.1.1.9.1.4.2"), 34 * time.Second},
+		{MustParseOid("1.3.6.1.2.1.1.9.1.4.3"), 56 * time.Second},
+		{MustParseOid("1.3.6.1.2.1.2.1.0"), 2},
+	})
+
+	entries, err := client.Capabilities()
+	if err != nil {
+		t.Fatalf("Error getting capabilities: %v", err)
+	}
+	expected := []SysOREntry{
+		{MustParseOid("1"), MustParseOid("1.3.6.1.6.3.1"), "The MIB module for SNMP entities", 1200},
+		{MustParseOid("2"), MustParseOid("1.3.6.1.2.1.49"), "The MIB module for managing TCP implementations", 3400},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Capabilities returned %v, expected %v", entries, expected)
+	}
+}
+
+func TestGetNextInSubtree(t *testing.T) {
+	root := MustParseOid("1.3.6.1.2.1.1.9.1.2")
+	client := newMibClient(t, []VarBind{
+		{MustParseOid("1.3.6.1.2.1.1.9.1.2.1"), MustParseOid("1.3.6.1.6.3.1")},
+		{MustParseOid("1.3.6.1.2.1.1.9.1.3.1"), "The MIB module for SNMP entities"},
+	})
+
+	varbind, inSubtree, err := client.GetNextInSubtree(root, root)
+	if err != nil || !inSubtree || varbind.Oid.String() != ".1.3.6.1.2.1.1.9.1.2.1" {
+		t.Errorf("GetNextInSubtree at the start returned %v, %v, %v", varbind, inSubtree, err)
+	}
+	// The next oid is in the next column.
+	varbind, inSubtree, err = client.GetNextInSubtree(varbind.Oid, root)
+	if err != nil || inSubtree || varbind.Oid.String() != ".1.3.6.1.2.1.1.9.1.3.1" {
+		t.Errorf("GetNextInSubtree at the boundary returned %v, %v, %v", varbind, inSubtree, err)
+	}
+	// And nothing is left after it.
+	varbind, inSubtree, err = client.GetNextInSubtree(varbind.Oid, MustParseOid("1.3.6.1.2.1.1.9.1"))
+	if err != nil || inSubtree || varbind.Value != EndOfMibView {
+		t.Errorf("GetNextInSubtree at the end of the MIB returned %v, %v, %v", varbind, inSubtree, err)
+	}
+}
+
+func TestGetMultipleOrdered(t *testing.T) {
+	sysDescr := MustParseOid("1.3.6.1.2.1.1.1.0")
+	sysUpTime := MustParseOid("1.3.6.1.2.1.1.3.0")
+	sysName := MustParseOid("1.3.6.1.2.1.1.5.0")
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// The agent answers out of order and leaves sysDescr out.
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{sysName, "router"},
+		[]interface{}{sysUpTime, time.Second})})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+
+	result, err := wsnmp.GetMultipleOrdered([]Oid{sysUpTime, sysDescr, sysName})
+	if err != nil {
+		t.Fatalf("Error getting values: %v", err)
+	}
+	expected := []VarBind{{sysUpTime, time.Second}, {sysDescr, nil}, {sysName, "router"}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("GetMultipleOrdered returned %v, expected %v", result, expected)
+	}
+}
+
+func TestTrapV3Context(t *testing.T) {
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	packet := encodeV3MessageInContext(t, agent, "vlan-42", []interface{}{AsnTrap2, 1, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.1.3.0"), 1}}})
+
+	wsnmp := &SNMP{Version: SNMPv3}
+	wsnmp.TrapUsers = []V3user{{User: "pcb.snmpv3", AuthAlg: SnmpSHA1, AuthPwd: "this_is_my_pcb", PrivAlg: SnmpAES, PrivPwd: "my_pcb_is_4_me"}}
+
+	trap, err := wsnmp.ParseTrap(packet)
+	if err != nil {
+		t.Fatalf("Error parsing v3 trap: %v", err)
+	}
+	if trap.ContextName != "vlan-42" || trap.ContextEngineID != agent.engineID {
+		t.Errorf("Trap context is %q in engine %x, expected vlan-42 in %x", trap.ContextName, trap.ContextEngineID, agent.engineID)
+	}
+}
+
+func TestConnAddrs(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer server.Close()
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	wsnmp := NewSNMPOnConn(server.LocalAddr().String(), "public", SNMPv2c, time.Second, 1, conn)
+	defer wsnmp.Close()
+
+	if wsnmp.RemoteAddr().String() != server.LocalAddr().String() {
+		t.Errorf("RemoteAddr is %v, expected %v", wsnmp.RemoteAddr(), server.LocalAddr())
+	}
+	if local, ok := wsnmp.LocalAddr().(*net.UDPAddr); !ok || local.Port == 0 || !local.IP.IsLoopback() {
+		t.Errorf("LocalAddr is %v, expected an ephemeral port on 127.0.0.1", wsnmp.LocalAddr())
+	}
+
+	var unconnected SNMP
+	if unconnected.LocalAddr() != nil || unconnected.RemoteAddr() != nil {
+		t.Errorf("An object without connection has addresses")
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+	packet, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "private",
+		[]interface{}{AsnSetRequest, 1234, 0, 0,
+			[]interface{}{Sequence, []interface{}{Sequence, oid, "router"}}}})
+	if err != nil {
+		t.Fatalf("Error encoding message: %v", err)
+	}
+	msg, err := DecodeMessage(packet)
+	if err != nil {
+		t.Fatalf("Error decoding message: %v", err)
+	}
+	expected := &Message{Version: SNMPv2c, Community: "private", PDUType: AsnSetRequest,
+		PDU: Response{RequestID: 1234, VarBinds: []VarBind{{oid, "router"}}}}
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Decoded %+v, expected %+v", msg, expected)
+	}
+
+	// A community that isn't a string.
+	packet, err = EncodeSequence([]interface{}{Sequence, int(SNMPv2c), 42,
+		[]interface{}{AsnGetRequest, 1234, 0, 0, []interface{}{Sequence}}})
+	if err != nil {
+		t.Fatalf("Error encoding message: %v", err)
+	}
+	var decodeErr *DecodeError
+	if _, err := DecodeMessage(packet); !errors.As(err, &decodeErr) {
+		t.Errorf("Expected a DecodeError, got %v", err)
+	}
+}
+
+func TestGetTableCounter64(t *testing.T) {
+	ifHCInOctets := MustParseOid("1.3.6.1.2.1.31.1.1.1.6")
+	client := newMibClient(t, []VarBind{
+		{MustParseOid("1.3.6.1.2.1.31.1.1.1.6.1"), uint64(1234)},
+		{MustParseOid("1.3.6.1.2.1.31.1.1.1.6.2"), uint64(0x123456789abcdef0)},
+		{MustParseOid("1.3.6.1.2.1.31.1.1.1.6.3"), uint64(0xffffffffffffffff)},
+		{MustParseOid("1.3.6.1.2.1.31.1.1.1.7.1"), uint64(1)},
+	})
+
+	table, err := client.GetTable(ifHCInOctets)
+	if err != nil {
+		t.Fatalf("Error getting table: %v", err)
+	}
+	expected := map[string]interface{}{
+		".1.3.6.1.2.1.31.1.1.1.6.1": uint64(1234),
+		".1.3.6.1.2.1.31.1.1.1.6.2": uint64(0x123456789abcdef0),
+		".1.3.6.1.2.1.31.1.1.1.6.3": uint64(0xffffffffffffffff),
+	}
+	if !reflect.DeepEqual(table, expected) {
+		t.Errorf("GetTable returned %v, expected %v", table, expected)
+	}
+}
+
+func TestGetTyped(t *testing.T) {
+	ifEntry := MustParseOid("1.3.6.1.2.1.2.2.1")
+	client := newMibClient(t, []VarBind{
+		{MustParseOid("1.3.6.1.2.1.2.2.1.2.1"), "eth0"},
+		{MustParseOid("1.3.6.1.2.1.2.2.1.5.1"), Unsigned32(1000000000)},
+		{MustParseOid("1.3.6.1.2.1.2.2.1.7.1"), 1},
+		{MustParseOid("1.3.6.1.2.1.2.2.1.10.1"), uint64(1234)},
+	})
+
+	for oid, expected := range map[string]BERType{
+		"1.3.6.1.2.1.2.2.1.2.1":  AsnOctetStr,
+		"1.3.6.1.2.1.2.2.1.5.1":  Gauge32,
+		"1.3.6.1.2.1.2.2.1.7.1":  Integer,
+		"1.3.6.1.2.1.2.2.1.10.1": Counter64,
+	} {
+		berType, val, err := client.GetTyped(MustParseOid(oid))
+		if err != nil || berType != expected {
+			t.Errorf("GetTyped(%s) returned type %v, %v, %v, expected type %v", oid, berType, val, err, expected)
+		}
+	}
+
+	table, err := client.GetTableTyped(ifEntry)
+	if err != nil {
+		t.Fatalf("Error getting table: %v", err)
+	}
+	expected := map[string]TypedValue{
+		".1.3.6.1.2.1.2.2.1.2.1":  {AsnOctetStr, "eth0"},
+		".1.3.6.1.2.1.2.2.1.5.1":  {Gauge32, 1000000000},
+		".1.3.6.1.2.1.2.2.1.7.1":  {Integer, 1},
+		".1.3.6.1.2.1.2.2.1.10.1": {Counter64, uint64(1234)},
+	}
+	if !reflect.DeepEqual(table, expected) {
+		t.Errorf("GetTableTyped returned %v, expected %v", table, expected)
+	}
+}
+
+func TestDiscoverZeroEngineTime(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	agent.engineBoots, agent.engineTime = 0, 0
+	discovery := encodeV3Report(t, agent)
+	agent.engineBoots, agent.engineTime = 3, 5678
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(discovery)})
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3Report(t, agent))})
+	udpStub.ExpectAny().AndRespondTo(respondV3(t, agent, []interface{}{AsnGetResponse, 0, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, oid, 42}}}))
+
+	// Without report retries, the first request only works if Discover synchronized the engine time.
+	wsnmp := &SNMP{Version: SNMPv3, user: "pcb.snmpv3", authAlg: SnmpSHA1, authPwd: "this_is_my_pcb",
+		privAlg: SnmpAES, privPwd: "my_pcb_is_4_me", conn: udpStub}
+	defer wsnmp.Close()
+	if err := wsnmp.Discover(); err != nil {
+		t.Fatalf("Error discovering: %v", err)
+	}
+	if wsnmp.engineBoots != 3 || wsnmp.engineTime != 5678 {
+		t.Errorf("Discovered engine boots %d and time %d, expected 3 and 5678", wsnmp.engineBoots, wsnmp.engineTime)
+	}
+	val, err := wsnmp.GetV3(oid)
+	if err != nil || val != 42 {
+		t.Errorf("GetV3 after Discover returned %v, %v", val, err)
+	}
+}
+
+func TestDiscoverIdempotent(t *testing.T) {
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3Report(t, agent))})
+
+	wsnmp := &SNMP{Version: SNMPv3, user: "pcb.snmpv3", authAlg: SnmpSHA1, authPwd: "this_is_my_pcb",
+		privAlg: SnmpAES, privPwd: "my_pcb_is_4_me", conn: udpStub}
+	defer wsnmp.Close()
+	if err := wsnmp.Discover(); err != nil {
+		t.Fatalf("Error discovering: %v", err)
+	}
+
+	// The second Discover sends nothing, the stub has no more responses, and keeps the salts.
+	wsnmp.aesIV, wsnmp.desIV = 1234, 5678
+	if err := wsnmp.Discover(); err != nil {
+		t.Fatalf("Error discovering again: %v", err)
+	}
+	if wsnmp.aesIV != 1234 || wsnmp.desIV != 5678 {
+		t.Errorf("Second Discover reset the salts to %d and %d", wsnmp.aesIV, wsnmp.desIV)
+	}
+
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3Report(t, agent))})
+	if err := wsnmp.ForceDiscover(); err != nil {
+		t.Fatalf("Error forcing discovery: %v", err)
+	}
+	if wsnmp.aesIV == 1234 && wsnmp.desIV == 5678 {
+		t.Errorf("ForceDiscover didn't seed the salts again")
+	}
+}
+
+func TestDiscoverMalformedReport(t *testing.T) {
+	shortHeader, err := EncodeSequence([]interface{}{Sequence, "\x80\x00\x1f\x88\x04engine", 3, 1234})
+	if err != nil {
+		t.Fatalf("Error encoding v3 header: %v", err)
+	}
+	// Engine boots as a string.
+	badHeader, err := EncodeSequence([]interface{}{Sequence, "\x80\x00\x1f\x88\x04engine", "3", 1234, "", "", ""})
+	if err != nil {
+		t.Fatalf("Error encoding v3 header: %v", err)
+	}
+	globalData := []interface{}{Sequence, 1, maxMsgSize, string([]byte{0}), 3}
+	tests := map[string][]interface{}{
+		"truncated message":         {Sequence, int(SNMPv3), globalData},
+		"header not a string":       {Sequence, int(SNMPv3), globalData, 5, ""},
+		"short header":              {Sequence, int(SNMPv3), globalData, string(shortHeader), ""},
+		"engine boots not a number": {Sequence, int(SNMPv3), globalData, string(badHeader), ""},
+	}
+	for name, message := range tests {
+		report, err := EncodeSequence(message)
+		if err != nil {
+			t.Fatalf("%s: error encoding report: %v", name, err)
+		}
+		udpStub := NewUdpStub(t)
+		udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(report)})
+		wsnmp := &SNMP{Version: SNMPv3, user: "pcb.snmpv3", authAlg: SnmpSHA1, authPwd: "this_is_my_pcb",
+			privAlg: SnmpAES, privPwd: "my_pcb_is_4_me", conn: udpStub}
+		var decodeErr *DecodeError
+		if err := wsnmp.Discover(); !errors.As(err, &decodeErr) {
+			t.Errorf("%s: Discover returned %v, expected a DecodeError", name, err)
+		}
+		wsnmp.Close()
+		udpStub.CheckClosed()
+	}
+}
+
+func TestGetV3NestedDiscoveryReport(t *testing.T) {
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(nest(Sequence, 1000, []byte{byte(AsnNull), 0}))})
+	wsnmp := &SNMP{Version: SNMPv3, user: "pcb.snmpv3", authAlg: SnmpSHA1, authPwd: "this_is_my_pcb",
+		privAlg: SnmpAES, privPwd: "my_pcb_is_4_me", conn: udpStub}
+	defer wsnmp.Close()
+
+	var decodeErr *DecodeError
+	_, err := wsnmp.GetV3(MustParseOid("1.3.6.1.2.1.1.3.0"))
+	if !errors.As(err, &decodeErr) || !strings.Contains(err.Error(), "nesting too deep") {
+		t.Errorf("GetV3 with a nested discovery report returned %v, expected nesting too deep", err)
+	}
+}
+
+func TestGetV3EncodeError(t *testing.T) {
+	// Without localized keys, the request can't be encoded, and isn't sent.
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	wsnmp := &SNMP{Version: SNMPv3, user: "pcb.snmpv3", engineID: "\x80\x00\x1f\x88\x04engine", conn: udpStub}
+	defer wsnmp.Close()
+	if _, _, err := wsnmp.doGetV3Once(MustParseOid("1.3.6.1.2.1.1.3.0"), AsnGetRequest); err == nil {
+		t.Errorf("doGetV3Once without keys returned no error")
+	}
+}
+
+func TestGetV3MalformedResponse(t *testing.T) {
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	header := func(boots interface{}, privParam string) string {
+		encoded, err := EncodeSequence([]interface{}{Sequence, agent.engineID, boots, 1234, agent.user,
+			strings.Repeat("\x01", 12), privParam})
+		if err != nil {
+			t.Fatalf("Error encoding v3 header: %v", err)
+		}
+		return string(encoded)
+	}
+	// A scoped PDU whose PDU is an integer.
+	scopedPDU, err := EncodeSequence([]interface{}{Sequence, agent.engineID, "", 5})
+	if err != nil {
+		t.Fatalf("Error encoding scoped PDU: %v", err)
+	}
+	encrypted, privParam, err := agent.encrypt(string(scopedPDU))
+	if err != nil {
+		t.Fatalf("Error encrypting scoped PDU: %v", err)
+	}
+
+	globalData := []interface{}{Sequence, 1, maxMsgSize, string([]byte{3}), 3}
+	tests := map[string][]interface{}{
+		"engine boots not a number": {Sequence, int(SNMPv3), globalData, header("3", privParam), encrypted},
+		"scoped PDU not a string":   {Sequence, int(SNMPv3), globalData, header(3, privParam), 5},
+		"PDU not a sequence":        {Sequence, int(SNMPv3), globalData, header(3, privParam), encrypted},
+	}
+	for name, message := range tests {
+		response, err := EncodeSequence(message)
+		if err != nil {
+			t.Fatalf("%s: error encoding response: %v", name, err)
+		}
+		udpStub := NewUdpStub(t)
+		udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(response)})
+		wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+		wsnmp.conn = udpStub
+		var decodeErr *DecodeError
+		if _, err := wsnmp.GetV3(MustParseOid("1.3.6.1.2.1.1.3.0")); !errors.As(err, &decodeErr) {
+			t.Errorf("%s: GetV3 returned %v, expected a DecodeError", name, err)
+		}
+		wsnmp.Close()
+		udpStub.CheckClosed()
+	}
+}
+
+// privParamOf returns the privacy parameters of an SNMPv3 message.
+func privParamOf(t testing.TB, packet []byte) string {
+	decoded, err := DecodeSequence(packet)
+	if err != nil {
+		t.Fatalf("Error decoding message: %v", err)
+	}
+	securityParams, err := DecodeSequence([]byte(decoded[3].(string)))
+	if err != nil {
+		t.Fatalf("Error decoding security parameters: %v", err)
+	}
+	return securityParams[6].(string)
+}
+
+func TestEncodeV3MessageAdvancesSalt(t *testing.T) {
+	pdu := []interface{}{AsnGetRequest, 1, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.1.3.0"), nil}}}
+	for _, privAlg := range []string{SnmpAES, SnmpDES, SnmpDES3} {
+		wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+		wsnmp.privAlg = privAlg
+		var err error
+		if wsnmp.privKey, err = privPasswordToKey(wsnmp.privPwd, wsnmp.engineID, wsnmp.authAlg, privAlg); err != nil {
+			t.Fatalf("Error localizing %s key: %v", privAlg, err)
+		}
+
+		first, err := wsnmp.encodeV3Message(pdu)
+		if err != nil {
+			t.Fatalf("Error encoding %s message: %v", privAlg, err)
+		}
+		second, err := wsnmp.encodeV3Message(pdu)
+		if err != nil {
+			t.Fatalf("Error encoding %s message: %v", privAlg, err)
+		}
+		if firstParam, secondParam := privParamOf(t, first), privParamOf(t, second); firstParam == secondParam {
+			t.Errorf("%s messages reused the privacy parameters %x", privAlg, firstParam)
+		}
+	}
+}
+
+func TestCommunityToContext(t *testing.T) {
+	tests := map[string]string{
+		"public":        "",
+		"":              "",
+		"public@10":     "10",
+		"private@vrf-a": "vrf-a",
+		"a@b@c":         "c",
+		"trailing@":     "",
+	}
+	for community, expected := range tests {
+		if context := CommunityToContext(community); context != expected {
+			t.Errorf("CommunityToContext(%q) is %q, expected %q", community, context, expected)
+		}
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	// The request timeout is too short for anything but a UDP round trip on loopback, resolving the
+	// target name mustn't be bounded by it.
+	wsnmp, err := NewSNMP("localhost", "public", SNMPv2c, time.Nanosecond, 0)
+	if err != nil {
+		t.Fatalf("Error creating an object with a short request timeout: %v", err)
+	}
+	wsnmp.Close()
+
+	// A resolver that never answers is given up on after the dial timeout.
+	blackhole := &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}
+	start := time.Now()
+	if _, err := dial(net.Dialer{Timeout: 100 * time.Millisecond, Resolver: blackhole}, "", "agent.example", 0); err == nil {
+		t.Errorf("Dialed a target whose name can't be resolved")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Dialing with a blackholed resolver took %v, expected about 100ms", elapsed)
+	}
+	if timeout := (SNMP{}).dialTimeout(); timeout != defaultDialTimeout {
+		t.Errorf("Default dial timeout is %v, expected %v", timeout, defaultDialTimeout)
+	}
+}
+
+func TestDialIPv6(t *testing.T) {
+	if listener, err := net.ListenPacket("udp6", "[::1]:0"); err != nil {
+		t.Skipf("No IPv6 loopback: %v", err)
+	} else {
+		listener.Close()
+	}
+	conn, err := dial(net.Dialer{Timeout: defaultDialTimeout}, "", "::1", 0)
+	if err != nil {
+		t.Fatalf("Error dialing an IPv6 literal: %v", err)
+	}
+	defer conn.Close()
+	if remote := conn.RemoteAddr().String(); remote != "[::1]:161" {
+		t.Errorf("Dialed %s, expected [::1]:161", remote)
+	}
+}
+
+func TestTrapV1Fields(t *testing.T) {
+	// net-snmp sent the linkDown 1234.56s after it started.
+	packet, _ := hex.DecodeString(v1LinkDownTrap)
+	wsnmp := &SNMP{}
+	trap, err := wsnmp.ParseTrap(packet)
+	if err != nil {
+		t.Fatalf("Error parsing v1 trap: %v", err)
+	}
+	if !trap.OID.Equal(MustParseOid("1.3.6.1.4.1.8072.3.2.10")) || trap.Address != "192.168.1.1" {
+		t.Errorf("Trap is from %v at %s, expected .1.3.6.1.4.1.8072.3.2.10 at 192.168.1.1", trap.OID, trap.Address)
+	}
+	if trap.GenericTrap != LinkDown || trap.SpecificTrap != 0 || trap.Timestamp != 123456 {
+		t.Errorf("Trap is generic %d specific %d at %d, expected %d 0 at 123456", trap.GenericTrap, trap.SpecificTrap, trap.Timestamp, LinkDown)
+	}
+	if name := GenericTrapName(trap.GenericTrap); name != "linkDown" {
+		t.Errorf("Generic trap name is %s, expected linkDown", name)
+	}
+	if name := GenericTrapName(9); name != "unknown(9)" {
+		t.Errorf("Generic trap name of 9 is %s, expected unknown(9)", name)
+	}
+}
+
+func TestTrapNotificationOID(t *testing.T) {
+	packet, _ := hex.DecodeString(v1LinkDownTrap)
+	wsnmp := &SNMP{}
+	linkDown, err := wsnmp.ParseTrap(packet)
+	if err != nil {
+		t.Fatalf("Error parsing v1 trap: %v", err)
+	}
+	enterprise := Trap{Version: 1, OID: MustParseOid("1.3.6.1.4.1.8072.3.2.10"), GenericTrap: EnterpriseSpecific, SpecificTrap: 17}
+	v2 := Trap{Version: 2, VarBinds: map[string]interface{}{".1.3.6.1.6.3.1.1.4.1.0": MustParseOid("1.3.6.1.4.1.8072.2.3.0.1")}}
+
+	tests := []struct {
+		trap     Trap
+		expected Oid
+	}{
+		{linkDown, MustParseOid("1.3.6.1.6.3.1.1.5.3")},
+		{enterprise, MustParseOid("1.3.6.1.4.1.8072.3.2.10.0.17")},
+		{v2, MustParseOid("1.3.6.1.4.1.8072.2.3.0.1")},
+		{Trap{Version: 2}, nil},
+	}
+	for _, test := range tests {
+		if oid := test.trap.NotificationOID(); !oid.Equal(test.expected) {
+			t.Errorf("Notification oid is %v, expected %v", oid, test.expected)
+		}
+	}
+	if !enterprise.OID.Equal(MustParseOid("1.3.6.1.4.1.8072.3.2.10")) {
+		t.Errorf("NotificationOID modified the enterprise to %v", enterprise.OID)
+	}
+}
+
+func TestGetV3WithoutDiscover(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3Report(t, agent))})
+	udpStub.ExpectAny().AndRespondTo(respondV3(t, agent,
+		[]interface{}{AsnGetResponse, 0, 0, 0, []interface{}{Sequence, []interface{}{Sequence, oid, "pcb"}}}))
+
+	wsnmp := &SNMP{Version: SNMPv3, user: "pcb.snmpv3", authAlg: SnmpSHA1, authPwd: "this_is_my_pcb",
+		privAlg: SnmpAES, privPwd: "my_pcb_is_4_me", conn: udpStub}
+	defer wsnmp.Close()
+	val, err := wsnmp.GetV3(oid)
+	if err != nil || val != "pcb" {
+		t.Errorf("GetV3 returned (%v, %v), expected pcb", val, err)
+	}
+}
+
+func TestAESIV(t *testing.T) {
+	salt := "\x01\x02\x03\x04\x05\x06\x07\x08"
+	expected, _ := hex.DecodeString("0000000500001e610102030405060708")
+	if iv := buildAESIV(5, 7777, salt); !bytes.Equal(iv, expected) {
+		t.Fatalf("AES IV is %x, expected %x", iv, expected)
+	}
+
+	// AES-128 and AES-256 only differ by the length of the localized key.
+	for _, keyLen := range []int{16, 32} {
+		wsnmp := SNMP{privAlg: SnmpAES, privKey: strings.Repeat("k", keyLen), engineBoots: 5, engineTime: 7777}
+		scopedPDU, _ := EncodeSequence([]interface{}{Sequence, "engine", ""})
+		encrypted, privParam, err := wsnmp.encrypt(string(scopedPDU))
+		if err != nil {
+			t.Fatalf("Error encrypting with a %d bytes key: %v", keyLen, err)
+		}
+		reference := make([]byte, len(scopedPDU))
+		if err := encryptAESCFB(reference, scopedPDU, []byte(wsnmp.privKey), buildAESIV(5, 7777, privParam)); err != nil {
+			t.Fatalf("Error encrypting the reference with a %d bytes key: %v", keyLen, err)
+		}
+		if encrypted != string(reference) {
+			t.Errorf("Encryption with a %d bytes key doesn't use the RFC 3826 IV", keyLen)
+		}
+		decrypted, err := wsnmp.decrypt(encrypted, privParam)
+		if err != nil || decrypted != string(scopedPDU) {
+			t.Errorf("Decrypting with a %d bytes key returned (%x, %v), expected %x", keyLen, decrypted, err, scopedPDU)
+		}
+	}
+}
+
+func TestSetMultipleTypes(t *testing.T) {
+	ifAlias := MustParseOid("1.3.6.1.2.1.31.1.1.1.18.2")
+	ifAdminStatus := MustParseOid("1.3.6.1.2.1.2.2.1.7.2")
+	varbinds := []VarBind{{ifAlias, "down"}, {ifAdminStatus, 2}}
+
+	requestID := randomRequestID(rand.NewSource(0))
+	req, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "private",
+		[]interface{}{AsnSetRequest, requestID, 0, 0, []interface{}{Sequence,
+			[]interface{}{Sequence, ifAlias, "down"},
+			[]interface{}{Sequence, ifAdminStatus, 2}}}})
+	if err != nil {
+		t.Fatalf("Error encoding request: %v", err)
+	}
+	// ifAlias.2 as an OCTET STRING (04), then ifAdminStatus.2 as an INTEGER (02).
+	varbindList := "3026" +
+		"3013060b2b060102011f0101011202" + "0404646f776e" +
+		"300f060a2b060102010202010702" + "020102"
+	if !strings.HasSuffix(hex.EncodeToString(req), varbindList) {
+		t.Fatalf("SET request %x doesn't end with the varbinds %s", req, varbindList)
+	}
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.Expect(hex.EncodeToString(req)).AndRespond([]string{encodeResponse(t, SNMPv2c, "private",
+		[]interface{}{ifAlias, "down"}, []interface{}{ifAdminStatus, 2})})
+
+	wsnmp := NewSNMPOnConn("magic_host", "private", SNMPv2c, 2*time.Second, 0, udpStub)
+	wsnmp.Rand = rand.NewSource(0)
+	defer wsnmp.Close()
+	if err := wsnmp.SetMultiple(varbinds); err != nil {
+		t.Errorf("Error setting: %v", err)
+	}
+}
+
+func TestPacketHooks(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+	response := encodeResponse(t, SNMPv2c, "public", []interface{}{oid, "pcb"})
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{response})
+
+	var sent, received [][]byte
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 0, udpStub)
+	defer wsnmp.Close()
+	wsnmp.OnSend = func(packet []byte) { sent = append(sent, packet) }
+	wsnmp.OnRecv = func(packet []byte) { received = append(received, packet) }
+	if _, err := wsnmp.Get(oid); err != nil {
+		t.Fatalf("Error getting: %v", err)
+	}
+
+	request, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnGetRequest, 0, 0, 0, []interface{}{Sequence, []interface{}{Sequence, oid, nil}}}})
+	if err != nil {
+		t.Fatalf("Error encoding request: %v", err)
+	}
+	// The request ID is random, but always encoded on 4 bytes or less.
+	if len(sent) != 1 || len(sent[0]) < len(request) || len(sent[0]) > len(request)+3 {
+		t.Errorf("OnSend got %d packets, expected 1 of about %d bytes", len(sent), len(request))
+	}
+	if len(sent) == 1 {
+		// The response echoes the request ID.
+		response = udpStub.echoID(sent[0], response)
+	}
+	if len(received) != 1 || hex.EncodeToString(received[0]) != response {
+		t.Errorf("OnRecv got %x, expected %s", received, response)
+	}
+}
+
+func TestTableTooLarge(t *testing.T) {
+	table := MustParseOid("1.3.6.1.4.1.99999.1")
+	// Every row of the first column leads to another one.
+	client := newAgentClient(t, &Agent{
+		HandleGetNext: func(oid Oid) (Oid, interface{}, error) {
+			if !oid.Within(table) || len(oid) < len(table)+2 {
+				return append(table.Copy(), 1, 1), 1, nil
+			}
+			next := oid.Copy()
+			next[len(next)-1]++
+			return next, next[len(next)-1], nil
+		},
+	})
+	client.MaxTableEntries = 7
+
+	result, err := client.GetTable(table)
+	if !errors.Is(err, ErrTableTooLarge) || len(result) != 7 {
+		t.Errorf("GetTable returned %d entries and %v, expected 7 and table too large", len(result), err)
+	}
+	walked, err := client.SnmpWalk(table)
+	if !errors.Is(err, ErrTableTooLarge) || len(walked) != 7 {
+		t.Errorf("SnmpWalk returned %d entries and %v, expected 7 and table too large", len(walked), err)
+	}
+	rows, err := client.GetTableRows(table, []Oid{{1}})
+	if !errors.Is(err, ErrTableTooLarge) || rows == nil || len(rows.Rows) != 7 {
+		t.Errorf("GetTableRows returned %v and %v, expected 7 rows and table too large", rows, err)
+	}
+	columns, err := client.GetColumns(table, []Oid{{1}})
+	if !errors.Is(err, ErrTableTooLarge) || len(columns) != 7 {
+		t.Errorf("GetColumns returned %d rows and %v, expected 7 and table too large", len(columns), err)
+	}
+}
+
+func TestDESKeyParity(t *testing.T) {
+	// The classic DES test vector, from "The DES Algorithm Illustrated".
+	key, _ := hex.DecodeString("133457799bbcdff1")
+	plain, _ := hex.DecodeString("0123456789abcdef")
+	expected, _ := hex.DecodeString("85e813540f0ab405")
+	iv := make([]byte, 8)
+
+	encrypted := make([]byte, 8)
+	if err := encryptDESCBC(encrypted, plain, key, iv); err != nil || !bytes.Equal(encrypted, expected) {
+		t.Fatalf("DES encrypted to %x, %v, expected %x", encrypted, err, expected)
+	}
+	// Flipping every parity bit encrypts the same, so agents fixing the parity of their keys interoperate.
+	flipped := make([]byte, len(key))
+	for idx, b := range key {
+		flipped[idx] = b ^ 0x01
+	}
+	if err := encryptDESCBC(encrypted, plain, flipped, iv); err != nil || !bytes.Equal(encrypted, expected) {
+		t.Errorf("DES with flipped parity bits encrypted to %x, %v, expected %x", encrypted, err, expected)
+	}
+
+	// Decrypting with another key gives a hint about the key.
+	wsnmp := SNMP{privAlg: SnmpDES, privKey: string(key) + "preivpre"}
+	scopedPDU, _ := EncodeSequence([]interface{}{Sequence, "engine", ""})
+	ciphertext, privParam, err := wsnmp.encrypt(string(scopedPDU))
+	if err != nil {
+		t.Fatalf("Error encrypting: %v", err)
+	}
+	wsnmp.privKey = "otherkeypreivpre"
+	if _, err := wsnmp.decrypt(ciphertext, privParam); err == nil || !strings.Contains(err.Error(), "key derivation") {
+		t.Errorf("Decrypting with the wrong key returned %v, expected a key derivation hint", err)
+	}
+}
+
+func TestDiscoverAgents(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.10.0/23")
+	if broadcast, err := broadcastAddr(*subnet); err != nil || !broadcast.Equal(net.ParseIP("192.168.11.255")) {
+		t.Errorf("Broadcast address of %v is %v, %v, expected 192.168.11.255", subnet, broadcast, err)
+	}
+	_, subnet6, _ := net.ParseCIDR("2001:db8::/64")
+	if _, err := DiscoverAgents(*subnet6, "public", MustParseOid("1.3.6.1.2.1.1.2.0"), time.Millisecond); err == nil {
+		t.Errorf("DiscoverAgents accepted an IPv6 subnet")
+	}
+
+	sysObjectID := MustParseOid("1.3.6.1.2.1.1.2.0")
+	vendor := MustParseOid("1.3.6.1.4.1.8072.3.2.10")
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer server.Close()
+	go (&Agent{HandleGet: func(oid Oid) (interface{}, error) { return vendor, nil }}).Serve(server)
+
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer conn.Close()
+	results, err := discoverAgents(conn, server.LocalAddr(), "public", sysObjectID, 200*time.Millisecond, rand.NewSource(0))
+	if err != nil {
+		t.Fatalf("Error discovering: %v", err)
+	}
+	if len(results) != 1 || results[0].Addr.String() != server.LocalAddr().String() || !vendor.Equal(results[0].Value.(Oid)) {
+		t.Errorf("Discovered %v, expected %v at %v", results, vendor, server.LocalAddr())
+	}
+}
+
+func TestMsgFlags(t *testing.T) {
+	tests := []struct {
+		flags                  byte
+		auth, priv, reportable bool
+		name                   string
+		invalid                bool
+	}{
+		{0, false, false, false, "noAuthNoPriv", false},
+		{1, true, false, false, "authNoPriv", false},
+		{2, false, true, false, "noAuthPriv", true},
+		{3, true, true, false, "authPriv", false},
+		{4, false, false, true, "noAuthNoPriv,reportable", false},
+		{5, true, false, true, "authNoPriv,reportable", false},
+		{6, false, true, true, "noAuthPriv,reportable", true},
+		{7, true, true, true, "authPriv,reportable", false},
+	}
+	for _, test := range tests {
+		flags, err := ParseMsgFlags(string([]byte{test.flags}))
+		if (err != nil) != test.invalid {
+			t.Errorf("Parsing flags %d returned error %v, expected invalid %v", test.flags, err, test.invalid)
+		}
+		if flags.Auth() != test.auth || flags.Priv() != test.priv || flags.Reportable() != test.reportable || flags.String() != test.name {
+			t.Errorf("Flags %d are %v (auth %v, priv %v, reportable %v)", test.flags, flags, flags.Auth(), flags.Priv(), flags.Reportable())
+		}
+	}
+	if _, err := ParseMsgFlags(""); err == nil {
+		t.Errorf("Empty flags parsed")
+	}
+	levels := []struct {
+		flags, required MsgFlags
+		atLeast         bool
+	}{
+		{FlagAuth | FlagPriv, FlagAuth | FlagPriv, true},
+		{FlagAuth | FlagPriv | FlagReportable, FlagAuth | FlagPriv, true},
+		{FlagAuth, FlagAuth | FlagPriv, false},
+		{0, FlagAuth | FlagPriv, false},
+		{0, FlagAuth, false},
+		{FlagAuth | FlagPriv, FlagAuth, true},
+		{0, 0, true},
+	}
+	for _, level := range levels {
+		if atLeast := level.flags.atLeast(level.required); atLeast != level.atLeast {
+			t.Errorf("%v at least %v is %v, expected %v", level.flags, level.required, atLeast, level.atLeast)
+		}
+	}
+
+	// A response sent without privacy, to a request with privacy.
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	v3Header, _ := EncodeSequence([]interface{}{Sequence, agent.engineID,
+		int(agent.engineBoots), int(agent.engineTime), agent.user, strings.Repeat("\x01", 12), ""})
+	plain, err := EncodeSequence([]interface{}{Sequence, int(SNMPv3),
+		[]interface{}{Sequence, 1, maxMsgSize, string([]byte{1}), 3},
+		string(v3Header),
+		[]interface{}{Sequence, agent.engineID, "",
+			[]interface{}{AsnGetResponse, 1, 0, 0,
+				[]interface{}{Sequence, []interface{}{Sequence, sysUpTime, 1}}}}})
+	if err != nil {
+		t.Fatalf("Error encoding response: %v", err)
+	}
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(plain)})
+	wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	wsnmp.conn = udpStub
+	defer wsnmp.Close()
+	if _, err := wsnmp.GetV3(sysUpTime); err == nil || !strings.Contains(err.Error(), "response is authNoPriv") {
+		t.Errorf("GetV3 of an unencrypted response returned %v, expected an authNoPriv error", err)
+	}
+
+	// Nor authentication.
+	plain, err = EncodeSequence([]interface{}{Sequence, int(SNMPv3),
+		[]interface{}{Sequence, 1, maxMsgSize, string([]byte{0}), 3},
+		string(v3Header),
+		[]interface{}{Sequence, agent.engineID, "",
+			[]interface{}{AsnGetResponse, 1, 0, 0,
+				[]interface{}{Sequence, []interface{}{Sequence, sysUpTime, 1}}}}})
+	if err != nil {
+		t.Fatalf("Error encoding response: %v", err)
+	}
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(plain)})
+	if _, err := wsnmp.GetV3(sysUpTime); err == nil || !strings.Contains(err.Error(), "response is noAuthNoPriv") {
+		t.Errorf("GetV3 of an unauthenticated response returned %v, expected a noAuthNoPriv error", err)
+	}
+}
+
+func TestReportableFlag(t *testing.T) {
+	wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	varbinds := []interface{}{Sequence, []interface{}{Sequence, sysUpTime, nil}}
+	tests := []struct {
+		pduType    BERType
+		reportable bool
+	}{
+		{AsnGetRequest, true},
+		{AsnGetNextRequest, true},
+		{AsnInform, true},
+		{AsnTrap2, false},
+		{AsnGetResponse, false},
+	}
+	for _, test := range tests {
+		packet, err := wsnmp.encodeV3Message([]interface{}{test.pduType, 1, 0, 0, varbinds})
+		if err != nil {
+			t.Fatalf("Error encoding %v: %v", test.pduType, err)
+		}
+		decoded, err := DecodeSequence(packet)
+		if err != nil {
+			t.Fatalf("Error decoding %v: %v", test.pduType, err)
+		}
+		flags, err := msgFlagsOf(decoded)
+		if err != nil || flags.Reportable() != test.reportable || !flags.Auth() || !flags.Priv() {
+			t.Errorf("%v flags are %v, %v, expected reportable %v", test.pduType, flags, err, test.reportable)
+		}
+	}
+}
+
+func TestGetTableAdaptive(t *testing.T) {
+	table := MustParseOid("1.3.6.1.2.1.2.2.1.1")
+	var mib []VarBind
+	for idx := 1; idx <= 500; idx++ {
+		mib = append(mib, VarBind{append(table.Copy(), idx), idx})
+	}
+	client := newMibClient(t, mib)
+	var repetitions []int
+	client.OnSend = func(packet []byte) {
+		if msg, err := DecodeMessage(packet); err == nil {
+			// GETBULK has max-repetitions where other PDUs have the error-index.
+			repetitions = append(repetitions, msg.PDU.ErrorIndex)
+		}
+	}
+
+	result, err := client.GetTableAdaptive(table)
+	if err != nil || len(result) != len(mib) {
+		t.Fatalf("GetTableAdaptive returned %d entries, %v, expected %d", len(result), err, len(mib))
+	}
+	if len(repetitions) < 4 || repetitions[0] != adaptiveStartRepetitions {
+		t.Fatalf("GetTableAdaptive sent requests with %v repetitions", repetitions)
+	}
+	// The varbinds are small, the repetitions double until the responses fill a message.
+	for idx := 1; idx < 3; idx++ {
+		if repetitions[idx] != 2*repetitions[idx-1] {
+			t.Errorf("Repetitions went from %d to %d, expected them doubled", repetitions[idx-1], repetitions[idx])
+		}
+	}
+	last := repetitions[len(repetitions)-1]
+	if last <= 4*adaptiveStartRepetitions || last*16 > defaultMaxMessageSize {
+		t.Errorf("Repetitions settled to %d, expected about %d varbinds of 19 bytes", last, defaultMaxMessageSize/19)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+	for _, test := range []struct{ retries, attempts int }{{0, 1}, {2, 3}} {
+		udpStub := NewUdpStub(t)
+		udpStub.timeoutWhenEmpty = true
+		for i := 0; i < test.attempts; i++ {
+			udpStub.ExpectAny()
+		}
+		wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, test.retries, udpStub)
+		sent := 0
+		wsnmp.OnSend = func([]byte) { sent++ }
+		_, err := wsnmp.Get(oid)
+		var noResponse *NoResponseError
+		if !errors.As(err, &noResponse) || noResponse.Attempts != test.attempts || sent != test.attempts {
+			t.Errorf("With %d retries, sent %d requests and got %v, expected %d attempts", test.retries, sent, err, test.attempts)
+		}
+		wsnmp.Close()
+	}
+
+	// Errors other than timeouts aren't retried.
+	udpStub := NewUdpStub(t)
+	udpStub.readError = errors.New("connection refused")
+	udpStub.ExpectAny()
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 2, udpStub)
+	sent := 0
+	wsnmp.OnSend = func([]byte) { sent++ }
+	_, err := wsnmp.Get(oid)
+	var noResponse *NoResponseError
+	if !errors.As(err, &noResponse) || noResponse.Attempts != 1 || sent != 1 || !errors.Is(err, udpStub.readError) {
+		t.Errorf("With a read error, sent %d requests and got %v, expected 1 attempt", sent, err)
+	}
+	if stats := wsnmp.Stats(); stats.Retries != 0 || stats.Timeouts != 0 {
+		t.Errorf("With a read error, counted %+v, expected no retry nor timeout", stats)
+	}
+	wsnmp.Close()
+
+	// Negative retries go on until the context is cancelled, here by the fifth attempt.
+	udpStub = NewUdpStub(t)
+	udpStub.timeoutWhenEmpty = true
+	for i := 0; i < 10; i++ {
+		udpStub.ExpectAny()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	wsnmp = NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, -1, udpStub).WithContext(ctx)
+	defer wsnmp.Close()
+	sent = 0
+	wsnmp.OnSend = func([]byte) {
+		if sent++; sent == 5 {
+			cancel()
+		}
+	}
+	if _, err := wsnmp.Get(oid); !errors.Is(err, context.Canceled) || sent != 5 {
+		t.Errorf("With negative retries, sent %d requests and got %v, expected 5 and context canceled", sent, err)
+	}
+
+	// Without a context to cancel them, negative retries would never end, the request is sent once.
+	udpStub = NewUdpStub(t)
+	udpStub.timeoutWhenEmpty = true
+	udpStub.ExpectAny()
+	wsnmp = NewSNMPOnConn("magic_host", "public", SNMPv2c, 10*time.Millisecond, -1, udpStub)
+	defer wsnmp.Close()
+	if _, err := wsnmp.Get(oid); !errors.As(err, &noResponse) || noResponse.Attempts != 1 {
+		t.Errorf("With negative retries and no context, got %v, expected 1 attempt", err)
+	}
+}
+
+func TestStaleResponses(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer server.Close()
+	conn, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	wsnmp := NewSNMPOnConn(server.LocalAddr().String(), "public", SNMPv2c, time.Second, 0, conn)
+	defer wsnmp.Close()
+
+	// Late responses to an earlier request are queued before the Get, and arrive before its response.
+	stale, _ := hex.DecodeString(encodeResponse(t, SNMPv2c, "public", []interface{}{oid, "stale"}))
+	for i := 0; i < 2; i++ {
+		if _, err := server.WriteTo(stale, conn.LocalAddr()); err != nil {
+			t.Fatalf("Error sending stale response: %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	go func() {
+		request := make([]byte, bufSize)
+		numRead, addr, err := server.ReadFrom(request)
+		if err != nil {
+			return
+		}
+		requestID, err := messageID(request[:numRead])
+		if err != nil {
+			return
+		}
+		fresh, _ := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+			[]interface{}{AsnGetResponse, requestID, 0, 0,
+				[]interface{}{Sequence, []interface{}{Sequence, oid, "fresh"}}}})
+		server.WriteTo(stale, addr)
+		server.WriteTo(fresh, addr)
+	}()
+
+	if val, err := wsnmp.Get(oid); err != nil || val != "fresh" {
+		t.Errorf("Get returned %v, %v, expected fresh", val, err)
+	}
+
+	if _, err := server.WriteTo(stale, conn.LocalAddr()); err != nil {
+		t.Fatalf("Error sending stale response: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := wsnmp.Drain(); err != nil {
+		t.Errorf("Error draining: %v", err)
+	}
+	if discarded, err := drainSocket(conn); err != nil || discarded != 0 {
+		t.Errorf("%d packets, %v left after Drain", discarded, err)
+	}
+}
+
+func TestSendTrapLeadingVarBinds(t *testing.T) {
+	linkDown := MustParseOid("1.3.6.1.6.3.1.1.5.3")
+	ifIndex := MustParseOid("1.3.6.1.2.1.2.2.1.1.2")
+	tests := []struct {
+		varbinds []VarBind
+		upTime   time.Duration
+	}{
+		// Missing, computed from StartTime.
+		{[]VarBind{{ifIndex, 2}}, 42 * time.Second},
+		// Out of order, moved first.
+		{[]VarBind{{ifIndex, 2}, {snmpTrapOID, linkDown}, {sysUpTime, TimeTicks(1234)}}, 12340 * time.Millisecond},
+	}
+	for _, test := range tests {
+		udpStub := NewUdpStub(t)
+		udpStub.ExpectAny()
+		wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 0, udpStub)
+		wsnmp.StartTime = time.Now().Add(-42 * time.Second)
+		var packet []byte
+		wsnmp.OnSend = func(sent []byte) { packet = sent }
+		if err := wsnmp.SendTrap(linkDown, test.varbinds); err != nil {
+			t.Fatalf("Error sending trap: %v", err)
+		}
+		wsnmp.Close()
+
+		trap, err := wsnmp.ParseTrap(packet)
+		if err != nil {
+			t.Fatalf("Error parsing sent trap: %v", err)
+		}
+		types, err := DecodeVarBindTypes(packet)
+		if err != nil {
+			t.Fatalf("Error decoding varbind types: %v", err)
+		}
+		expectedOids := []string{sysUpTime.String(), snmpTrapOID.String(), ifIndex.String()}
+		if !reflect.DeepEqual(trap.VarBindOIDs, expectedOids) || !reflect.DeepEqual(types, []BERType{Timeticks, AsnObjectID, AsnInteger}) {
+			t.Errorf("Trap varbinds are %v of types %v, expected %v of types TimeTicks, OID, INTEGER", trap.VarBindOIDs, types, expectedOids)
+		}
+		if upTime := trap.VarBinds[sysUpTime.String()].(time.Duration); upTime < test.upTime || upTime > test.upTime+time.Second {
+			t.Errorf("Trap sysUpTime is %v, expected %v", upTime, test.upTime)
+		}
+		if !trap.NotificationOID().Equal(linkDown) {
+			t.Errorf("Trap is %v, expected linkDown", trap.NotificationOID())
+		}
+	}
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 0, NewUdpStub(t))
+	if err := wsnmp.SendTrap(linkDown, []VarBind{{snmpTrapOID, MustParseOid("1.3.6.1.6.3.1.1.5.4")}}); err == nil {
+		t.Errorf("SendTrap accepted a different snmpTrapOID.0")
+	}
+	if err := wsnmp.SendTrap(linkDown, []VarBind{{sysUpTime, "now"}}); err == nil {
+		t.Errorf("SendTrap accepted a sysUpTime.0 string")
+	}
+}
+
+func TestUptime(t *testing.T) {
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 0, NewUdpStub(t))
+	first := wsnmp.Uptime()
+	time.Sleep(50 * time.Millisecond)
+	second := wsnmp.Uptime()
+	if second < first+5 || second > first+50 {
+		t.Errorf("Uptime went from %d to %d in 50ms, expected 5 more hundredths of a second", first, second)
+	}
+
+	wsnmp.StartTime = time.Now().Add(-90 * time.Second)
+	if upTime := wsnmp.Uptime(); upTime < 9000 || upTime > 9100 {
+		t.Errorf("Uptime is %d 90s after StartTime, expected 9000", upTime)
+	}
+}
+
+func TestTCPResponseFraming(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer listener.Close()
+	sysDescr := MustParseOid("1.3.6.1.2.1.1.1.0")
+	descr := strings.Repeat("a long sysDescr ", 20)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request := make([]byte, bufSize)
+		numRead, err := conn.Read(request)
+		if err != nil {
+			return
+		}
+		msg, err := DecodeMessage(request[:numRead])
+		if err != nil {
+			return
+		}
+		response, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+			[]interface{}{AsnGetResponse, msg.PDU.RequestID, 0, 0,
+				[]interface{}{Sequence,
+					[]interface{}{Sequence, sysDescr, descr}}}})
+		if err != nil {
+			return
+		}
+		// Split the response within its long form length, so that neither read has the whole message.
+		conn.Write(response[:2])
+		time.Sleep(20 * time.Millisecond)
+		conn.Write(response[2:])
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	client := NewSNMPOnConn(listener.Addr().String(), "public", SNMPv2c, time.Second, 0, conn)
+	defer client.Close()
+	val, err := client.Get(sysDescr)
+	if err != nil || val != descr {
+		t.Errorf("Get over TCP returned %v, %v, expected %q", val, err, descr)
+	}
+}
+
+func TestSendTrapV3(t *testing.T) {
+	linkDown := MustParseOid("1.3.6.1.6.3.1.1.5.3")
+	ifIndex := MustParseOid("1.3.6.1.2.1.2.2.1.1.2")
+	engineID := "\x80\x00\x1f\x88\x04local-engine"
+	sender, err := NewTrapSenderV3("127.0.0.1", "pcb.snmpv3", SnmpSHA1, "this_is_my_pcb", SnmpAES, "my_pcb_is_4_me", engineID, 7)
+	if err != nil {
+		t.Fatalf("Error creating trap sender: %v", err)
+	}
+	sender.conn.Close()
+	udpStub := NewUdpStub(t)
+	udpStub.ExpectAny()
+	udpStub.ExpectAny()
+	sender.conn = udpStub
+	sender.StartTime = time.Now().Add(-90 * time.Second)
+	var packets [][]byte
+	sender.OnSend = func(sent []byte) { packets = append(packets, sent) }
+	for i := 0; i < 2; i++ {
+		if err := sender.SendTrap(linkDown, []VarBind{{ifIndex, 2}}); err != nil {
+			t.Fatalf("Error sending v3 trap: %v", err)
+		}
+	}
+	sender.Close()
+	packet := packets[0]
+	if first, second := privParamOf(t, packets[0]), privParamOf(t, packets[1]); first == second {
+		t.Errorf("Traps reused the privacy parameters %x", first)
+	}
+
+	decoded, err := DecodeSequence(packet)
+	if err != nil {
+		t.Fatalf("Error decoding sent trap: %v", err)
+	}
+	if flags, err := msgFlagsOf(decoded); err != nil || flags != FlagAuth|FlagPriv {
+		t.Errorf("Trap flags are %v, %v, expected authPriv", flags, err)
+	}
+	usm, err := DecodeSequence([]byte(decoded[3].(string)))
+	if err != nil {
+		t.Fatalf("Error decoding security parameters: %v", err)
+	}
+	if usm[1] != engineID || usm[2] != 7 || usm[3].(int) < 90 || usm[3].(int) > 91 {
+		t.Errorf("Trap engine is %q, boots %v, time %v, expected the local engine, 7 boots, 90s", usm[1], usm[2], usm[3])
+	}
+
+	receiver := NewSNMPOnConn("", "", SNMPv3, time.Second, 0, NewUdpStub(t))
+	defer receiver.Close()
+	receiver.TrapUsers = []V3user{{User: "pcb.snmpv3", AuthAlg: SnmpSHA1, AuthPwd: "this_is_my_pcb", PrivAlg: SnmpAES, PrivPwd: "my_pcb_is_4_me"}}
+	trap, err := receiver.ParseTrap(packet)
+	if err != nil {
+		t.Fatalf("Error parsing v3 trap: %v", err)
+	}
+	if trap.Username != "pcb.snmpv3" || trap.ContextEngineID != engineID || !trap.NotificationOID().Equal(linkDown) || trap.VarBinds[ifIndex.String()] != 2 {
+		t.Errorf("Parsed trap %+v, expected linkDown of ifIndex 2 from pcb.snmpv3", trap)
+	}
+
+	receiver.TrapUsers[0].PrivPwd = "not_my_pcb_pwd"
+	if _, err := receiver.ParseTrap(packet); err == nil {
+		t.Errorf("ParseTrap decrypted a v3 trap with the wrong password")
+	}
+}
+
+func TestV3AuthParamPlacement(t *testing.T) {
+	// An engine ID with a run of 12 zeros, which a placeholder for the authentication parameters could be
+	// mistaken for.
+	w := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	w.engineID = "\x80\x00\x1f\x88\x04" + strings.Repeat("\x00", 12) + "\x01"
+	if err := w.localizeKeys(); err != nil {
+		t.Fatalf("Error localizing keys: %v", err)
+	}
+	packet, err := w.encodeV3Message([]interface{}{AsnGetRequest, 1, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.1.3.0"), nil}}})
+	if err != nil {
+		t.Fatalf("Error encoding v3 message: %v", err)
+	}
+
+	decoded, err := DecodeSequence(packet)
+	if err != nil {
+		t.Fatalf("Error decoding v3 message: %v", err)
+	}
+	usm, err := DecodeSequence([]byte(decoded[3].(string)))
+	if err != nil {
+		t.Fatalf("Error decoding security parameters: %v", err)
+	}
+	if usm[1] != w.engineID {
+		t.Errorf("Engine ID is %x, expected %x", usm[1], w.engineID)
+	}
+	authParam := usm[5].(string)
+	offset := bytes.LastIndex(packet, []byte(authParam))
+	unauthenticated := append([]byte(nil), packet...)
+	copy(unauthenticated[offset:], strings.Repeat("\x00", 12))
+	if expected := w.auth(string(unauthenticated)); authParam != expected {
+		t.Errorf("Authentication parameters are %x, expected %x", authParam, expected)
+	}
+}
+
+func TestBuildV3Message(t *testing.T) {
+	w := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	pdu := []interface{}{AsnGetRequest, 1, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, MustParseOid("1.3.6.1.2.1.1.3.0"), nil}}}
+	scopedPDU, err := EncodeSequence([]interface{}{Sequence, "context-engine", "vlan-42", pdu})
+	if err != nil {
+		t.Fatalf("Error encoding scoped PDU: %v", err)
+	}
+
+	for _, flags := range []MsgFlags{0, FlagAuth, FlagAuth | FlagPriv} {
+		packet, offset, err := w.buildV3Message(flags, "context-engine", "vlan-42", pdu)
+		if err != nil {
+			t.Errorf("Error building %v message: %v", flags, err)
+			continue
+		}
+		decoded, err := DecodeSequence(packet)
+		if err != nil {
+			t.Errorf("Error decoding %v message: %v", flags, err)
+			continue
+		}
+		if got, err := msgFlagsOf(decoded); err != nil || got != flags|FlagReportable {
+			t.Errorf("%v message has flags %v, %v", flags, got, err)
+		}
+		usm, err := DecodeSequence([]byte(decoded[3].(string)))
+		if err != nil {
+			t.Errorf("Error decoding %v security parameters: %v", flags, err)
+			continue
+		}
+		if usm[1] != w.engineID || usm[2] != int(w.engineBoots) || usm[3] != int(w.engineTime) || usm[4] != w.user {
+			t.Errorf("%v security parameters are %v", flags, usm)
+		}
+
+		authParam := usm[5].(string)
+		if !flags.Auth() {
+			if offset != -1 || authParam != "" {
+				t.Errorf("%v message has authentication parameters %x at %d", flags, authParam, offset)
+			}
+		} else {
+			unauthenticated := append([]byte(nil), packet...)
+			copy(unauthenticated[offset:offset+12], strings.Repeat("\x00", 12))
+			if string(packet[offset:offset+12]) != authParam || w.auth(string(unauthenticated)) != authParam {
+				t.Errorf("%v message has authentication parameters %x at %d, not authenticating it", flags, authParam, offset)
+			}
+		}
+
+		var plain string
+		if flags.Priv() {
+			if plain, err = w.decrypt(decoded[4].(string), usm[6].(string)); err != nil {
+				t.Errorf("Error decrypting %v scoped PDU: %v", flags, err)
+			}
+			plain, _ = trimScopedPDU([]byte(plain))
+		} else {
+			encoded, _ := EncodeSequence(decoded[4].([]interface{}))
+			plain = string(encoded)
+		}
+		if plain != string(scopedPDU) {
+			t.Errorf("%v scoped PDU is %x, expected %x", flags, plain, scopedPDU)
+		}
+	}
+
+	if _, _, err := w.buildV3Message(FlagPriv, "", "", pdu); err == nil {
+		t.Errorf("Built a message with privacy but no authentication")
+	}
+	var noKeys SNMP
+	if _, _, err := noKeys.buildV3Message(FlagAuth, "", "", pdu); err == nil {
+		t.Errorf("Built an authenticated message without keys")
+	}
+}
+
+func TestGetV3ContextMismatch(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	respond := respondV3InContext(t, agent, "vlan-43", []interface{}{AsnGetResponse, 0, 0, 0,
+		[]interface{}{Sequence, []interface{}{Sequence, oid, 42}}})
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespondTo(respond)
+	udpStub.ExpectAny().AndRespondTo(respond)
+
+	wsnmp := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	wsnmp.conn = udpStub
+	wsnmp.ContextName = "vlan-42"
+	defer wsnmp.Close()
+
+	if val, err := wsnmp.GetV3(oid); err == nil || !strings.Contains(err.Error(), "vlan-43") {
+		t.Errorf("Response for another context returned %v, %v, expected an error", val, err)
+	}
+	wsnmp.IgnoreContextMismatch = true
+	if val, err := wsnmp.GetV3(oid); err != nil || val != 42 {
+		t.Errorf("Ignoring the context mismatch, got %v, %v, expected 42", val, err)
+	}
+}
+
+func TestSupportedAlgorithms(t *testing.T) {
+	if auth := SupportedAuthAlgorithms(); !reflect.DeepEqual(auth, []string{SnmpMD5, SnmpSHA1}) {
+		t.Errorf("Supported auth algorithms are %v", auth)
+	}
+	if priv := SupportedPrivAlgorithms(); !reflect.DeepEqual(priv, []string{SnmpDES3, SnmpAES, SnmpDES}) {
+		t.Errorf("Supported priv algorithms are %v", priv)
+	}
+
+	// Every supported combination localizes its keys, authenticates and round trips a scoped PDU.
+	scopedPDU, err := EncodeSequence([]interface{}{Sequence, "engine", "", []interface{}{AsnGetRequest, 1, 0, 0, []interface{}{Sequence}}})
+	if err != nil {
+		t.Fatalf("Error encoding scoped PDU: %v", err)
+	}
+	authParams := map[string]bool{}
+	for _, authAlg := range SupportedAuthAlgorithms() {
+		for _, privAlg := range SupportedPrivAlgorithms() {
+			w := SNMP{authAlg: authAlg, authPwd: "this_is_my_pcb", privAlg: privAlg, privPwd: "my_pcb_is_4_me", engineID: "engine"}
+			if err := w.localizeKeys(); err != nil {
+				t.Errorf("Error localizing %s/%s keys: %v", authAlg, privAlg, err)
+				continue
+			}
+			authParam := w.auth(string(scopedPDU))
+			if len(authParam) != 12 {
+				t.Errorf("%s authentication parameters are %d bytes long, expected 12", authAlg, len(authParam))
+			}
+			authParams[authParam] = true
+			encrypted, privParam, err := w.encrypt(string(scopedPDU))
+			if err != nil {
+				t.Errorf("Error encrypting with %s: %v", privAlg, err)
+				continue
+			}
+			if decrypted, err := w.decrypt(encrypted, privParam); err != nil || decrypted != string(scopedPDU) {
+				t.Errorf("%s decrypted %x, %v, expected %x", privAlg, decrypted, err, scopedPDU)
+			}
+		}
+	}
+	if len(authParams) != len(SupportedAuthAlgorithms()) {
+		t.Errorf("The auth algorithms gave %d different authentication parameters, expected one each", len(authParams))
+	}
+
+	if _, err := NewSNMPv3("127.0.0.1", "user", "SHA256", "this_is_my_pcb", SnmpAES, "my_pcb_is_4_me", time.Second, 0); err == nil {
+		t.Errorf("NewSNMPv3 accepted an unsupported auth algorithm")
+	}
+	if _, err := NewSNMPv3("127.0.0.1", "user", SnmpSHA1, "this_is_my_pcb", "AES256", "my_pcb_is_4_me", time.Second, 0); err == nil {
+		t.Errorf("NewSNMPv3 accepted an unsupported priv algorithm")
+	}
+	if _, err := passwordToKey("this_is_my_pcb", "engine", "SHA256"); err == nil {
+		t.Errorf("passwordToKey localized a key with an unsupported algorithm")
+	}
+}
+
+func TestPingProbeOid(t *testing.T) {
+	vendorOid := MustParseOid("1.3.6.1.4.1.9999.1.1.0")
+	gets := make(chan Oid, 2)
+	agent := &Agent{HandleGet: func(oid Oid) (interface{}, error) {
+		gets <- oid
+		time.Sleep(5 * time.Millisecond)
+		return 42, nil
+	}}
+	wsnmp := newAgentClient(t, agent)
+
+	for _, probe := range []Oid{nil, vendorOid} {
+		wsnmp.ProbeOid = probe
+		latency, err := wsnmp.Ping()
+		if err != nil {
+			t.Fatalf("Error pinging with probe %v: %v", probe, err)
+		}
+		if latency < 5*time.Millisecond || latency > time.Second {
+			t.Errorf("Ping took %v, expected the 5ms the agent took", latency)
+		}
+		expected := probe
+		if probe == nil {
+			expected = sysUpTime
+		}
+		if oid := <-gets; !oid.Equal(expected) {
+			t.Errorf("Ping got %v, expected %v", oid, expected)
+		}
+	}
+}
+
+func TestSessionExportImport(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	respond := respondV3(t, agent,
+		[]interface{}{AsnGetResponse, 0, 0, 0, []interface{}{Sequence, []interface{}{Sequence, oid, "pcb"}}})
+	newManager := func(conn net.Conn) *SNMP {
+		return &SNMP{Version: SNMPv3, user: "pcb.snmpv3", authAlg: SnmpSHA1, authPwd: "this_is_my_pcb",
+			privAlg: SnmpAES, privPwd: "my_pcb_is_4_me", conn: conn, ReportRetries: 1}
+	}
+
+	udpStub := NewUdpStub(t)
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3Report(t, agent))})
+	udpStub.ExpectAny().AndRespondTo(respond)
+	first := newManager(udpStub)
+	if _, err := first.GetV3(oid); err != nil {
+		t.Fatalf("Error getting before the export: %v", err)
+	}
+	first.Close()
+	udpStub.CheckClosed()
+	state := first.ExportSession()
+	if state.EngineID != agent.engineID || state.EngineBoots != 3 || state.EngineTime != 1234 || time.Since(state.CapturedAt) > time.Second {
+		t.Errorf("Exported %+v, expected the agent's engine, 3 boots, 1234s", state)
+	}
+
+	// Restored 10s later, the first request goes out without any discovery.
+	state.CapturedAt = state.CapturedAt.Add(-10 * time.Second)
+	udpStub = NewUdpStub(t)
+	udpStub.ExpectAny().AndRespondTo(respond)
+	second := newManager(udpStub)
+	if err := second.ImportSession(state); err != nil {
+		t.Fatalf("Error importing session: %v", err)
+	}
+	if second.engineTime != 1244 || second.aesIV != state.AESSalt {
+		t.Errorf("Imported engine time %d, salt %d, expected 1244, %d", second.engineTime, second.aesIV, state.AESSalt)
+	}
+	if val, err := second.GetV3(oid); err != nil || val != "pcb" {
+		t.Errorf("GetV3 after the import returned (%v, %v), expected pcb", val, err)
+	}
+	// The imported salt goes on advancing, and the next export carries it on.
+	if salt := second.ExportSession().AESSalt; salt != state.AESSalt+1 {
+		t.Errorf("Salt after a request is %d, expected %d", salt, state.AESSalt+1)
+	}
+	second.Close()
+	udpStub.CheckClosed()
+
+	// A stale engine ID is rejected by the agent, and discovered again.
+	state.EngineID = "\x80\x00\x1f\x88\x04stale"
+	udpStub = NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3ReportOf(t, agent, usmStatsUnknownEngineIDs))})
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3Report(t, agent))})
+	udpStub.ExpectAny().AndRespondTo(respond)
+	third := newManager(udpStub)
+	defer third.Close()
+	if err := third.ImportSession(state); err != nil {
+		t.Fatalf("Error importing session: %v", err)
+	}
+	if val, err := third.GetV3(oid); err != nil || val != "pcb" || third.engineID != agent.engineID {
+		t.Errorf("GetV3 with a stale engine ID returned (%v, %v) for engine %q, expected pcb", val, err, third.engineID)
+	}
+
+	if err := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 0, NewUdpStub(t)).ImportSession(state); err == nil {
+		t.Errorf("ImportSession accepted a v2c object")
+	}
+}
+
+func TestRequestIDsMatch(t *testing.T) {
+	// The 4 bytes encoding of 2^31, as agents treating request IDs as unsigned send it, decodes as -2^31.
+	signExtended, err := DecodeInteger([]byte{0x80, 0x00, 0x00, 0x00})
+	if err != nil {
+		t.Fatalf("Error decoding request ID: %v", err)
+	}
+	// Where int is 32 bits long, 2^31 itself wraps around to -2^31.
+	highBit := uint32(1) << 31
+	tests := []struct {
+		sent, received int
+		match          bool
+	}{
+		{int(highBit), signExtended, true},
+		{int(highBit + 5), signExtended + 5, true},
+		{int(highBit - 1), int(highBit - 1), true},
+		{int(highBit - 1), signExtended, false},
+		{1, 2, false},
+	}
+	for _, test := range tests {
+		if match := requestIDsMatch(test.sent, test.received); match != test.match {
+			t.Errorf("requestIDsMatch(%d, %d) = %v, expected %v", test.sent, test.received, match, test.match)
+		}
+	}
+}
+
+func TestRepetitionGrowth(t *testing.T) {
+	table := MustParseOid("1.3.6.1.2.1.2.2.1.1")
+	rows := func(first, last int) string {
+		var varbinds [][]interface{}
+		for idx := first; idx <= last; idx++ {
+			varbinds = append(varbinds, []interface{}{append(table.Copy(), idx), idx})
+		}
+		return encodeResponse(t, SNMPv2c, "public", varbinds...)
+	}
+	tooBig, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnGetResponse, 1, 1, 0, []interface{}{Sequence}}})
+	if err != nil {
+		t.Fatalf("Error encoding tooBig: %v", err)
+	}
+
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{rows(1, 5)})
+	udpStub.ExpectAny().AndRespond([]string{rows(6, 15)})
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(tooBig)})
+	udpStub.ExpectAny().AndRespond([]string{rows(16, 25)})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public",
+		[]interface{}{MustParseOid("1.3.6.1.2.1.2.2.1.2.1"), "lo"})})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 0, udpStub)
+	defer wsnmp.Close()
+	wsnmp.RepetitionGrowth = &RepetitionGrowth{Min: 5, Max: 40}
+	var repetitions []int
+	wsnmp.OnSend = func(packet []byte) {
+		if msg, err := DecodeMessage(packet); err == nil {
+			repetitions = append(repetitions, msg.PDU.ErrorIndex)
+		}
+	}
+	result, err := wsnmp.GetTableWithRepetitions(table, 5)
+	if err != nil || len(result) != 25 {
+		t.Fatalf("GetTable returned %d entries, %v, expected 25", len(result), err)
+	}
+	// Doubled after full responses, halved after the tooBig.
+	if expected := []int{5, 10, 20, 10, 20}; !reflect.DeepEqual(repetitions, expected) {
+		t.Errorf("GetTable sent requests with %v repetitions, expected %v", repetitions, expected)
+	}
+	if wsnmp.RepetitionGrowth.Repetitions != 20 {
+		t.Errorf("Repetitions settled on %d, expected 20", wsnmp.RepetitionGrowth.Repetitions)
+	}
+
+	// The bounds hold.
+	growth := &RepetitionGrowth{Min: 5, Max: 40, Factor: 4}
+	if grown := growth.grow(20, 200, make([]VarBind, 20), 1400); grown != 40 {
+		t.Errorf("Repetitions grew from 20 to %d, expected the maximum 40", grown)
+	}
+	if shrunk := growth.shrink(8); shrunk != 5 {
+		t.Errorf("Repetitions shrank from 8 to %d, expected the minimum 5", shrunk)
+	}
+	if grown := growth.grow(20, 1000, make([]VarBind, 20), 1400); grown != 28 {
+		t.Errorf("Repetitions grew from 20 to %d, expected 28 as no more varbinds would fit", grown)
+	}
+	if grown := growth.grow(20, 2000, make([]VarBind, 20), 1400); grown != 14 {
+		t.Errorf("Repetitions grew from 20 to %d, expected 14 as the response didn't fit", grown)
+	}
+}
+
+func TestPoller(t *testing.T) {
+	sysDescr := MustParseOid("1.3.6.1.2.1.1.1.0")
+	client := newMibClient(t, []VarBind{{sysDescr, "router"}, {sysUpTime, time.Second}})
+	poller := NewPoller(client, []Oid{sysDescr, sysUpTime}, 20*time.Millisecond)
+	ticks := make(chan time.Time)
+	poller.ticks = ticks
+	polls := make(chan struct{}, 100)
+	if err := poller.Start(func(values map[string]interface{}, err error) {
+		if err != nil || values[sysDescr.String()] != "router" {
+			t.Errorf("Poll returned %v, %v", values, err)
+		}
+		polls <- struct{}{}
+	}); err != nil {
+		t.Fatalf("Error starting poller: %v", err)
+	}
+	if err := poller.Start(func(map[string]interface{}, error) {}); err == nil {
+		t.Errorf("Started a poller twice")
+	}
+
+	// Every tick polls once.
+	for i := 0; i < 3; i++ {
+		ticks <- time.Now()
+		select {
+		case <-polls:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("No poll after tick %d", i)
+		}
+	}
+	poller.Stop()
+	select {
+	case ticks <- time.Now():
+		t.Errorf("Poller still ticking after Stop")
+	default:
+	}
+	if len(polls) != 0 {
+		t.Errorf("Polled %d more times than ticked", len(polls))
+	}
+}
+
+func TestPollerSkipsOverlappingPolls(t *testing.T) {
+	var gets int
+	var mu sync.Mutex
+	release := make(chan struct{})
+	agent := &Agent{HandleGet: func(oid Oid) (interface{}, error) {
+		mu.Lock()
+		gets++
+		mu.Unlock()
+		<-release
+		return 1, nil
+	}}
+	client := newAgentClient(t, agent)
+	poller := NewPoller(client, []Oid{sysUpTime}, 5*time.Millisecond)
+	ticks := make(chan time.Time)
+	poller.ticks = ticks
+	polls := make(chan struct{}, 10)
+	if err := poller.Start(func(map[string]interface{}, error) { polls <- struct{}{} }); err != nil {
+		t.Fatalf("Error starting poller: %v", err)
+	}
+	defer poller.Stop()
+
+	// The ticks while the first poll waits for the agent are skipped. Each tick is taken once the
+	// previous one was handled.
+	for i := 0; i < 5; i++ {
+		ticks <- time.Now()
+	}
+	close(release)
+	<-polls
+	ticks <- time.Now()
+	<-polls
+	mu.Lock()
+	defer mu.Unlock()
+	if gets != 2 {
+		t.Errorf("The agent got %d requests for 6 ticks, 4 of them during the first poll, expected 2", gets)
+	}
+}
+
+func TestResponseTruncated(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.1.0")
+	response := encodeResponse(t, SNMPv2c, "public", []interface{}{oid, strings.Repeat("x", 100)})
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{response})
+	udpStub.ExpectAny().AndRespond([]string{response})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 2, udpStub)
+	defer wsnmp.Close()
+	wsnmp.ResponseBufferSize = 64
+	sent := 0
+	wsnmp.OnSend = func([]byte) { sent++ }
+	if _, err := wsnmp.Get(oid); !errors.Is(err, ErrResponseTruncated) || sent != 1 {
+		t.Errorf("Get of a response longer than the buffer returned %v after %d requests, expected ErrResponseTruncated after 1", err, sent)
+	}
+
+	wsnmp.ResponseBufferSize = 0
+	if val, err := wsnmp.Get(oid); err != nil || val != strings.Repeat("x", 100) {
+		t.Errorf("Get with the default buffer returned %v, %v", val, err)
+	}
+}
+
+func TestTrapString(t *testing.T) {
+	packet, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnTrap2, 1, 0, 0, []interface{}{Sequence,
+			[]interface{}{Sequence, sysUpTime, TimeTicks(4200)},
+			[]interface{}{Sequence, snmpTrapOID, MustParseOid("1.3.6.1.6.3.1.1.5.3")},
+			[]interface{}{Sequence, MustParseOid("1.3.6.1.2.1.2.2.1.2.2"), "eth0"},
+			[]interface{}{Sequence, MustParseOid("1.3.6.1.2.1.2.2.1.6.2"), "\x00\x1b\x21\x3c"}}}})
+	if err != nil {
+		t.Fatalf("Error encoding trap: %v", err)
+	}
+	wsnmp := &SNMP{}
+	trap, err := wsnmp.ParseTrap(packet)
+	if err != nil {
+		t.Fatalf("Error parsing trap: %v", err)
+	}
+	trap.Address = "192.0.2.1:162"
+
+	expected := `v2c trap from 192.0.2.1:162 community public .1.3.6.1.6.3.1.1.5.3: ` +
+		`.1.3.6.1.2.1.1.3.0 = Timeticks: (4200) 0:00:42.00, ` +
+		`.1.3.6.1.6.3.1.1.4.1.0 = OID: .1.3.6.1.6.3.1.1.5.3, ` +
+		`.1.3.6.1.2.1.2.2.1.2.2 = STRING: "eth0", ` +
+		`.1.3.6.1.2.1.2.2.1.6.2 = Hex-STRING: 00 1B 21 3C `
+	if s := trap.String(); s != expected {
+		t.Errorf("Trap is\n%s\nexpected\n%s", s, expected)
+	}
+
+	v3 := Trap{Version: 3, Inform: true, Username: "pcb.snmpv3"}
+	if s := v3.String(); s != "v3 inform from unknown address user pcb.snmpv3: " {
+		t.Errorf("V3 inform is %q", s)
+	}
+}
+
+func TestTrapV1AgentAddress(t *testing.T) {
+	for _, test := range []struct {
+		agentAddr interface{}
+		expected  string
+	}{
+		{IpAddress(net.ParseIP("192.0.2.1")), "192.0.2.1"},
+		// Sent as an OCTET STRING by some agents.
+		{"\xc0\x00\x02\x01", "192.0.2.1"},
+		{"not an address", ""},
+	} {
+		packet, err := EncodeSequence([]interface{}{Sequence, int(SNMPv1), "public",
+			[]interface{}{AsnTrap, MustParseOid("1.3.6.1.4.1.8072.3.2.10"), test.agentAddr, LinkDown, 0, TimeTicks(100),
+				[]interface{}{Sequence}}})
+		if err != nil {
+			t.Fatalf("Error encoding trap: %v", err)
+		}
+		wsnmp := &SNMP{}
+		trap, err := wsnmp.ParseTrap(packet)
+		if err != nil {
+			t.Fatalf("Error parsing trap: %v", err)
+		}
+		if trap.Address != test.expected {
+			t.Errorf("Agent address %q parsed as %q, expected %q", test.agentAddr, trap.Address, test.expected)
+		}
+	}
+}
+
+func TestV3FallbackCommunity(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.timeoutWhenEmpty = true
+	udpStub.ExpectAny()
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public", []interface{}{oid, "router"})})
+	udpStub.ExpectAny()
+
+	wsnmp := &SNMP{Version: SNMPv3, user: "pcb.snmpv3", authAlg: SnmpSHA1, authPwd: "this_is_my_pcb",
+		privAlg: SnmpAES, privPwd: "my_pcb_is_4_me", conn: udpStub, FallbackCommunity: "public"}
+	defer wsnmp.Close()
+	var sent []*Message
+	wsnmp.OnSend = func(packet []byte) {
+		msg, _ := DecodeMessage(packet)
+		sent = append(sent, msg)
+	}
+	val, err := wsnmp.GetV3(oid)
+	if err != nil || val != "router" {
+		t.Fatalf("GetV3 with a fallback returned (%v, %v), expected router", val, err)
+	}
+	// The discovery isn't a v1/v2c message, the fallback is.
+	if len(sent) != 2 || sent[0] != nil || sent[1] == nil || sent[1].Version != SNMPv2c || sent[1].Community != "public" {
+		t.Errorf("Sent %v, expected a discovery then a v2c request", sent)
+	}
+
+	// Without a fallback, the discovery timeout is returned.
+	wsnmp.FallbackCommunity = ""
+	if _, err := wsnmp.GetV3(oid); !errors.Is(err, ErrNoResponse) {
+		t.Errorf("GetV3 without a fallback returned %v, expected no response", err)
+	}
+
+	// The agent answers the discovery, but not the v3 request.
+	agent := newV3Agent(t, "pcb.snmpv3", "this_is_my_pcb", "my_pcb_is_4_me")
+	udpStub = NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.timeoutWhenEmpty = true
+	udpStub.ExpectAny().AndRespond([]string{hex.EncodeToString(encodeV3Report(t, agent))})
+	udpStub.ExpectAny()
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public", []interface{}{oid, "router"})})
+	wsnmp = &SNMP{Version: SNMPv3, user: "pcb.snmpv3", authAlg: SnmpSHA1, authPwd: "this_is_my_pcb",
+		privAlg: SnmpAES, privPwd: "my_pcb_is_4_me", conn: udpStub, FallbackCommunity: "public"}
+	defer wsnmp.Close()
+	sent = nil
+	wsnmp.OnSend = func(packet []byte) {
+		msg, _ := DecodeMessage(packet)
+		sent = append(sent, msg)
+	}
+	val, err = wsnmp.GetV3(oid)
+	if err != nil || val != "router" {
+		t.Fatalf("GetV3 with a fallback after a v3 timeout returned (%v, %v), expected router", val, err)
+	}
+	if len(sent) != 3 || sent[1] != nil || sent[2] == nil || sent[2].Version != SNMPv2c {
+		t.Errorf("Sent %v, expected a discovery, a v3 request then a v2c request", sent)
+	}
+}
+
+func TestResponseTrailingBytes(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.5.0")
+	response := encodeResponse(t, SNMPv2c, "public", []interface{}{oid, "router"})
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	// Padded with zeros by the agent.
+	udpStub.ExpectAny().AndRespond([]string{response + "000000"})
+	udpStub.ExpectAny().AndRespond([]string{response + "0000ff"})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 0, udpStub)
+	defer wsnmp.Close()
+	if val, err := wsnmp.Get(oid); err != nil || val != "router" {
+		t.Errorf("Get of a zero padded response returned (%v, %v), expected router", val, err)
+	}
+	var decodeErr *DecodeError
+	if _, err := wsnmp.Get(oid); !errors.As(err, &decodeErr) {
+		t.Errorf("Get of a response followed by garbage returned %v, expected a DecodeError", err)
+	}
+}
+
+func TestGetSubtree(t *testing.T) {
+	udpStub := NewUdpStub(t)
+	defer udpStub.CheckClosed()
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public", []interface{}{MustParseOid("1.3.6.1.2.1.1.1.0"), "router"})})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public", []interface{}{MustParseOid("1.3.6.1.2.1.1.9.1.2.1"), MustParseOid("1.3.6.1.6.3.1")})})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public", []interface{}{MustParseOid("1.3.6.1.2.1.1.9.1.2.2"), MustParseOid("1.3.6.1.6.3.16")})})
+	udpStub.ExpectAny().AndRespond([]string{encodeResponse(t, SNMPv2c, "public", []interface{}{MustParseOid("1.3.6.1.2.1.2.1.0"), 2})})
+
+	wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, 2*time.Second, 5, udpStub)
+	defer wsnmp.Close()
+	tree, err := wsnmp.GetSubtree(MustParseOid("1.3.6.1.2.1.1"))
+	if err != nil {
+		t.Fatalf("Error getting subtree: %v", err)
+	}
+
+	// Formats the tree as SubID=Value(children...), children in sub-identifier order.
+	var format func(node *OidNode) string
+	format = func(node *OidNode) string {
+		result := fmt.Sprintf("%d", node.SubID)
+		if node.Value != nil {
+			result += fmt.Sprintf("=%v", node.Value)
+		}
+		if len(node.Children) > 0 {
+			var subIDs []int
+			for subID := range node.Children {
+				subIDs = append(subIDs, subID)
+			}
+			sort.Ints(subIDs)
+			var children []string
+			for _, subID := range subIDs {
+				children = append(children, format(node.Children[subID]))
+			}
+			result += "(" + strings.Join(children, " ") + ")"
+		}
+		return result
+	}
+	expected := "1(1(0=router) 9(1(2(1=.1.3.6.1.6.3.1 2=.1.3.6.1.6.3.16))))"
+	if got := format(tree); got != expected {
+		t.Errorf("Subtree is %s, expected %s", got, expected)
+	}
+}
+
+func TestSharedConn(t *testing.T) {
+	sysName := MustParseOid("1.3.6.1.2.1.1.5.0")
+	var targets []string
+	for _, name := range []string{"first", "second"} {
+		name := name
+		agent := &Agent{HandleGet: func(oid Oid) (interface{}, error) { return name, nil }}
+		server, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error listening: %v", err)
+		}
+		defer server.Close()
+		go agent.Serve(server)
+		targets = append(targets, server.LocalAddr().String())
+	}
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	shared := NewSharedConn(packetConn)
+	var clients []*SNMP
+	for _, target := range targets {
+		conn, err := shared.Dial(target)
+		if err != nil {
+			t.Fatalf("Error dialing %v: %v", target, err)
+		}
+		clients = append(clients, NewSNMPOnConn(target, "public", SNMPv2c, time.Second, 1, conn))
+	}
+
+	// Both agents are polled at the same time, each client gets the answers of its own.
+	var wg sync.WaitGroup
+	for idx, client := range clients {
+		expected := []string{"first", "second"}[idx]
+		wg.Add(1)
+		go func(client *SNMP) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if val, err := client.Get(sysName); err != nil || val != expected {
+					t.Errorf("Get from %v returned %v, %v, expected %v", client.Target, val, err, expected)
+					return
+				}
+			}
+		}(client)
+	}
+	wg.Wait()
+
+	// Closing a client leaves the socket to the others.
+	clients[0].Close()
+	if _, err := clients[0].Get(sysName); err == nil {
+		t.Errorf("Get on a closed client succeeded")
+	}
+	if val, err := clients[1].Get(sysName); err != nil || val != "second" {
+		t.Errorf("Get after closing another client returned %v, %v", val, err)
+	}
+
+	shared.Close()
+	if _, err := clients[1].Get(sysName); err == nil {
+		t.Errorf("Get after closing the shared socket succeeded")
+	}
+}
+
+func TestRandSource(t *testing.T) {
+	oid := MustParseOid("1.3.6.1.2.1.1.3.0")
+	// requestIDs returns the request IDs of two GETs sent with r as the Rand.
+	requestIDs := func(r RandSource) []int {
+		udpStub := NewUdpStub(t)
+		udpStub.timeoutWhenEmpty = true
+		udpStub.ExpectAny()
+		udpStub.ExpectAny()
+		wsnmp := NewSNMPOnConn("magic_host", "public", SNMPv2c, time.Second, 0, udpStub)
+		defer wsnmp.Close()
+		wsnmp.Rand = r
+		var ids []int
+		wsnmp.OnSend = func(packet []byte) {
+			msg, err := DecodeMessage(packet)
+			if err != nil {
+				t.Fatalf("Error decoding request: %v", err)
+			}
+			ids = append(ids, msg.PDU.RequestID)
+		}
+		wsnmp.Get(oid)
+		wsnmp.Get(oid)
+		return ids
+	}
+
+	first, second := requestIDs(rand.NewSource(42)), requestIDs(rand.NewSource(42))
+	if !reflect.DeepEqual(first, second) || first[0] == first[1] {
+		t.Errorf("Sources seeded alike gave request IDs %v and %v, expected the same two", first, second)
+	}
+	source := rand.NewSource(42)
+	if expected := []int{randomRequestID(source), randomRequestID(source)}; !reflect.DeepEqual(first, expected) {
+		t.Errorf("Request IDs are %v, expected %v", first, expected)
+	}
+	for _, id := range append(first, requestIDs(nil)...) {
+		if id < 0 {
+			t.Errorf("Request ID %d is negative", id)
+		}
+	}
+
+	// A math/rand source, which isn't safe for concurrent use, is shared by copies used concurrently.
+	wsnmp := &SNMP{Rand: rand.NewSource(42)}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(w SNMP) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.requestID()
+			}
+		}(*wsnmp)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,65 @@
+package snmplib
+
+import (
+	"sync/atomic"
+)
+
+// Stats counts what an SNMP object does on the wire. The counters are updated atomically, so they
+// can be read while requests are in flight.
+//
+// Requests counts every request sent with poll, whatever the operation (Get, GetNext, GetBulk, ...),
+// Retries counts the extra attempts poll made for them, Timeouts the attempts that got no answer in
+// time, and DecodeErrors the responses that couldn't be decoded.
+type Stats struct {
+	requests     int64
+	retries      int64
+	timeouts     int64
+	decodeErrors int64
+}
+
+// StatsSnapshot is a copy of the Stats counters at a point in time.
+type StatsSnapshot struct {
+	Requests     int64
+	Retries      int64
+	Timeouts     int64
+	DecodeErrors int64
+}
+
+// The count methods are safe to call on a nil Stats, so an SNMP object built without one still works.
+
+func (s *Stats) countRequest() {
+	if s != nil {
+		atomic.AddInt64(&s.requests, 1)
+	}
+}
+
+func (s *Stats) countRetry() {
+	if s != nil {
+		atomic.AddInt64(&s.retries, 1)
+	}
+}
+
+func (s *Stats) countTimeout() {
+	if s != nil {
+		atomic.AddInt64(&s.timeouts, 1)
+	}
+}
+
+func (s *Stats) countDecodeError() {
+	if s != nil {
+		atomic.AddInt64(&s.decodeErrors, 1)
+	}
+}
+
+// Snapshot returns the current value of the counters.
+func (s *Stats) Snapshot() StatsSnapshot {
+	if s == nil {
+		return StatsSnapshot{}
+	}
+	return StatsSnapshot{
+		Requests:     atomic.LoadInt64(&s.requests),
+		Retries:      atomic.LoadInt64(&s.retries),
+		Timeouts:     atomic.LoadInt64(&s.timeouts),
+		DecodeErrors: atomic.LoadInt64(&s.decodeErrors),
+	}
+}
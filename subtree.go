@@ -0,0 +1,44 @@
+package snmplib
+
+// OidNode is a node of the tree of oids GetSubtree returns, e.g. for MIB browsers.
+type OidNode struct {
+	SubID    int              // Last sub-identifier of the node's oid.
+	Children map[int]*OidNode // Nodes under this one, by sub-identifier.
+	Value    interface{}      // Value the agent returned for the node's oid, nil for inner nodes.
+}
+
+// GetSubtree walks the subtree under root, as SnmpWalk does or WalkV3 for SNMP v3, and returns it as a tree
+// whose root is the node of root. The nodes between the leaves and root are created without a value.
+func (w *SNMP) GetSubtree(root Oid) (*OidNode, error) {
+	var varbinds []VarBind
+	var err error
+	if w.Version == SNMPv3 {
+		varbinds, err = w.WalkV3(root)
+	} else {
+		varbinds, err = w.SnmpWalk(root)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tree := &OidNode{}
+	if len(root) > 0 {
+		tree.SubID = root[len(root)-1]
+	}
+	for _, varbind := range varbinds {
+		node := tree
+		for _, subID := range varbind.Oid[len(root):] {
+			child, ok := node.Children[subID]
+			if !ok {
+				child = &OidNode{SubID: subID}
+				if node.Children == nil {
+					node.Children = make(map[int]*OidNode)
+				}
+				node.Children[subID] = child
+			}
+			node = child
+		}
+		node.Value = varbind.Value
+	}
+	return tree, nil
+}
@@ -0,0 +1,70 @@
+package snmplib
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// sysOREntry is the entry of the sysORTable, from SNMPv2-MIB.
+var sysOREntry = Oid{1, 3, 6, 1, 2, 1, 1, 9, 1}
+
+// SysOREntry is a row of the agent's sysORTable, a MIB module or capability the agent supports.
+type SysOREntry struct {
+	Index  Oid
+	ID     Oid       // sysORID, e.g. the MODULE-IDENTITY of the MIB.
+	Descr  string    // sysORDescr.
+	UpTime TimeTicks // sysORUpTime, the sysUpTime when the entry was last instantiated.
+}
+
+// Capabilities walks the agent's sysORTable to list the MIB modules and capabilities it supports, in index
+// order. Agents don't always fill every column, missing values and exceptions are left empty, but entries
+// with a value of the wrong type are skipped.
+func (w SNMP) Capabilities() ([]SysOREntry, error) {
+	rows, err := w.GetTableRows(sysOREntry, []Oid{{2}, {3}, {4}})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []SysOREntry
+	for index, columns := range rows.Rows {
+		indexOid, err := ParseOid(index)
+		if err != nil {
+			return nil, err
+		}
+		entry, err := sysOREntryOf(indexOid, columns)
+		if err != nil {
+			log.Printf("Skipping sysORTable entry %v: %v\n", index, err)
+			continue
+		}
+		result = append(result, entry)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Index.Compare(result[j].Index) < 0
+	})
+	return result, nil
+}
+
+// sysOREntryOf returns the entry at index of the sysORTable columns got by Capabilities.
+func sysOREntryOf(index Oid, columns map[string]interface{}) (SysOREntry, error) {
+	entry := SysOREntry{Index: index}
+	if value, ok := columns[".2"]; ok {
+		if entry.ID, ok = value.(Oid); !ok {
+			return entry, fmt.Errorf("sysORID %v isn't an oid", value)
+		}
+	}
+	if value, ok := columns[".3"]; ok {
+		if entry.Descr, ok = value.(string); !ok {
+			return entry, fmt.Errorf("sysORDescr %v isn't a string", value)
+		}
+	}
+	if value, ok := columns[".4"]; ok {
+		upTime, ok := value.(time.Duration)
+		if !ok {
+			return entry, fmt.Errorf("sysORUpTime %v isn't TimeTicks", value)
+		}
+		entry.UpTime = TimeTicks(upTime / (10 * time.Millisecond))
+	}
+	return entry, nil
+}
@@ -0,0 +1,157 @@
+package snmplib
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// processStart is the start of the uptime of objects built without a constructor.
+var processStart = time.Now()
+
+// NewTrapSender creates a new SNMP object sending SNMPv2c traps to the manager at target, on the trap
+// port 162. Use NewSNMPOnConn for managers listening on another port.
+func NewTrapSender(target, community string) (*SNMP, error) {
+	if err := ValidateCommunity(community, false); err != nil {
+		return nil, err
+	}
+	conn, err := dial(net.Dialer{Timeout: defaultDialTimeout}, "", target, 162)
+	if err != nil {
+		return nil, err
+	}
+	return &SNMP{
+		Target:    target,
+		Community: community,
+		Version:   SNMPv2c,
+		port:      162,
+		conn:      conn,
+		stats:     &Stats{},
+		mu:        &sync.Mutex{},
+		created:   time.Now(),
+
+		ReportRetries: 1,
+	}, nil
+}
+
+// NewTrapSenderV3 creates a new SNMP object sending authPriv SNMPv3 traps as user to the manager at
+// target, on the trap port 162.
+//
+// The sender of traps is their authoritative engine: engineID is the snmpEngineID of the local engine,
+// e.g. from GenerateEngineID, which the keys of user are localized to, and engineBoots its
+// snmpEngineBoots. The engine time of the traps is the seconds since StartTime, or since the object was
+// created. The manager must know user with the same passwords, localized to engineID.
+func NewTrapSenderV3(target, user, authAlg, authPwd, privAlg, privPwd, engineID string, engineBoots int) (*SNMP, error) {
+	if err := validateV3Credentials(authAlg, authPwd, privAlg, privPwd); err != nil {
+		return nil, err
+	}
+	if err := ValidateEngineID(engineID); err != nil {
+		return nil, err
+	}
+	conn, err := dial(net.Dialer{Timeout: defaultDialTimeout}, "", target, 162)
+	if err != nil {
+		return nil, err
+	}
+	w := &SNMP{
+		Target:      target,
+		Version:     SNMPv3,
+		port:        162,
+		conn:        conn,
+		stats:       &Stats{},
+		mu:          &sync.Mutex{},
+		created:     time.Now(),
+		user:        user,
+		authAlg:     authAlg,
+		authPwd:     authPwd,
+		privAlg:     privAlg,
+		privPwd:     privPwd,
+		engineID:    engineID,
+		engineBoots: int32(engineBoots),
+
+		ReportRetries: 1,
+	}
+	if err := w.localizeKeys(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// SendTrap sends an SNMPv2c trap whose notification oid is trapOID, with varbinds. Objects created by
+// NewTrapSenderV3 send authPriv SNMPv3 traps instead.
+//
+// RFC 3416 requires sysUpTime.0 and snmpTrapOID.0 as the first two varbinds of traps, many managers drop
+// traps without them. SendTrap puts them first: the sysUpTime.0 of varbinds if there's one, otherwise
+// Uptime, and trapOID. varbinds may carry snmpTrapOID.0 as well, if it's trapOID.
+func (w *SNMP) SendTrap(trapOID Oid, varbinds []VarBind) error {
+	varbindList, err := w.trapVarBinds(trapOID, varbinds)
+	if err != nil {
+		return err
+	}
+	v3 := w.Version == SNMPv3 && w.discovered()
+
+	// The engine time and the privacy salt of v3 traps advance on w, from one trap to the next.
+	defer w.lock()()
+	pdu := []interface{}{AsnTrap2, w.requestID(), 0, 0, varbindList}
+	var packet []byte
+	switch {
+	case w.Version == SNMPv2c:
+		packet, err = EncodeSequence([]interface{}{Sequence, int(w.Version), w.Community, pdu})
+	case v3:
+		w.engineTime = int32(w.Uptime() / 100)
+		packet, err = w.encodeV3Message(pdu)
+	default:
+		return fmt.Errorf("can't send v%d traps, only v2c and v3 from NewTrapSenderV3 are supported", w.Version)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.conn.Write(packet); err != nil {
+		return fmt.Errorf("error sending trap: %v", err)
+	}
+	if w.OnSend != nil {
+		w.OnSend(append([]byte(nil), packet...))
+	}
+	return nil
+}
+
+// trapVarBinds returns the varbind list of a trap, with the mandatory sysUpTime.0 and snmpTrapOID.0 first.
+func (w SNMP) trapVarBinds(trapOID Oid, varbinds []VarBind) ([]interface{}, error) {
+	var upTime interface{} = w.Uptime()
+	var others []interface{}
+	for _, varbind := range varbinds {
+		switch {
+		case varbind.Oid.Equal(sysUpTime):
+			switch varbind.Value.(type) {
+			case TimeTicks, time.Duration:
+				upTime = varbind.Value
+			default:
+				return nil, fmt.Errorf("sysUpTime.0 is %T, expected TimeTicks", varbind.Value)
+			}
+		case varbind.Oid.Equal(snmpTrapOID):
+			if oid, ok := varbind.Value.(Oid); !ok || !oid.Equal(trapOID) {
+				return nil, fmt.Errorf("snmpTrapOID.0 is %v, but the trap is %v", varbind.Value, trapOID)
+			}
+		default:
+			others = append(others, []interface{}{Sequence, varbind.Oid, varbind.Value})
+		}
+	}
+	varbindList := []interface{}{Sequence,
+		[]interface{}{Sequence, sysUpTime, upTime},
+		[]interface{}{Sequence, snmpTrapOID, trapOID}}
+	return append(varbindList, others...), nil
+}
+
+// Uptime returns the time since StartTime, or since the object was created, in hundredths of a second as
+// sysUpTime.0 is. It's measured with the monotonic clock, so changes of the wall clock don't affect it.
+func (w SNMP) Uptime() TimeTicks {
+	start := w.StartTime
+	if start.IsZero() {
+		start = w.created
+	}
+	if start.IsZero() {
+		start = processStart
+	}
+	return TimeTicks(time.Since(start) / (10 * time.Millisecond))
+}
@@ -1,8 +1,11 @@
 package snmplib
 
 import (
-	"math/rand"
+	"context"
+	"fmt"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -12,6 +15,69 @@ type TrapHandler interface {
 	OnTrap(addr net.Addr, trap Trap)
 }
 
+// TrapMux is a TrapHandler dispatching each trap to the handler registered for the longest prefix of its
+// notification oid, see Trap.NotificationOID, like http.ServeMux does with paths. V1 traps match the
+// prefixes of their enterprise. Traps no prefix matches and errors go to the default handler, if any.
+type TrapMux struct {
+	mu             sync.RWMutex
+	routes         []trapRoute
+	defaultHandler TrapHandler
+}
+
+type trapRoute struct {
+	prefix  Oid
+	handler TrapHandler
+}
+
+// NewTrapMux creates a TrapMux sending what no prefix matches to defaultHandler, which can be nil to drop it.
+func NewTrapMux(defaultHandler TrapHandler) *TrapMux {
+	return &TrapMux{defaultHandler: defaultHandler}
+}
+
+// Handle registers handler for the traps under prefix, replacing the one registered for it before.
+func (m *TrapMux) Handle(prefix Oid, handler TrapHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for idx, route := range m.routes {
+		if route.prefix.Equal(prefix) {
+			m.routes[idx].handler = handler
+			return
+		}
+	}
+	m.routes = append(m.routes, trapRoute{prefix.Copy(), handler})
+}
+
+// Handler returns the handler trap is dispatched to, nil if it's dropped.
+func (m *TrapMux) Handler(trap Trap) TrapHandler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	oid := trap.NotificationOID()
+	var best *trapRoute
+	for idx, route := range m.routes {
+		if oid.Within(route.prefix) && (best == nil || len(route.prefix) > len(best.prefix)) {
+			best = &m.routes[idx]
+		}
+	}
+	if best == nil {
+		return m.defaultHandler
+	}
+	return best.handler
+}
+
+// OnTrap dispatches trap to its handler.
+func (m *TrapMux) OnTrap(addr net.Addr, trap Trap) {
+	if handler := m.Handler(trap); handler != nil {
+		handler.OnTrap(addr, trap)
+	}
+}
+
+// OnError passes err to the default handler, the trap it's about is unknown.
+func (m *TrapMux) OnError(addr net.Addr, err error) {
+	if m.defaultHandler != nil {
+		m.defaultHandler.OnError(addr, err)
+	}
+}
+
 // TrapServer object.
 type TrapServer struct {
 	PacketSize int
@@ -19,20 +85,38 @@ type TrapServer struct {
 	Port       int
 	Conn       *net.UDPConn
 	Users      []V3user
+
+	// DecodeLimits bounds the traps the server decodes, the zero value uses the defaults.
+	DecodeLimits DecodeLimits
+}
+
+// TrapServerConfig configures the socket a TrapServer listens on.
+//
+// The standard trap port 162 is privileged, binding it needs root or CAP_NET_BIND_SERVICE on Linux.
+type TrapServerConfig struct {
+	Address   string // IP to bind, empty binds all interfaces.
+	Port      int
+	ReuseAddr bool // Set SO_REUSEADDR, so a restarting server can bind while the old one is still around.
 }
 
 // NewTrapServer creates a new TrapServer object.
 func NewTrapServer(ip string, port int) (TrapServer, error) {
-	rand.Seed(0)
-	addr := net.UDPAddr{
-		Port: port,
-		IP:   net.ParseIP(ip),
+	return NewTrapServerWithConfig(TrapServerConfig{Address: ip, Port: port})
+}
+
+// NewTrapServerWithConfig creates a new TrapServer object listening as described by config.
+func NewTrapServerWithConfig(config TrapServerConfig) (TrapServer, error) {
+	listenConfig := net.ListenConfig{}
+	if config.ReuseAddr {
+		listenConfig.Control = setReuseAddr
 	}
-	conn, err := net.ListenUDP("udp", &addr)
+	packetConn, err := listenConfig.ListenPacket(context.Background(), "udp", net.JoinHostPort(config.Address, strconv.Itoa(config.Port)))
 	if err != nil {
 		return TrapServer{}, err
 	}
-	return TrapServer{PacketSize: 3000, IPAddress: addr, Port: port, Conn: conn}, nil
+	conn := packetConn.(*net.UDPConn)
+	addr := *conn.LocalAddr().(*net.UDPAddr)
+	return TrapServer{PacketSize: 3000, IPAddress: addr, Port: addr.Port, Conn: conn}, nil
 }
 
 // ListenAndServe starts the listen loop and will pause execution until server is shut down.
@@ -41,6 +125,7 @@ func (s *TrapServer) ListenAndServe(handler TrapHandler) {
 	defer server.Close()
 
 	server.TrapUsers = s.Users
+	server.DecodeLimits = s.DecodeLimits
 
 	packet := make([]byte, s.PacketSize)
 	for {
@@ -58,7 +143,35 @@ func (s *TrapServer) ListenAndServe(handler TrapHandler) {
 		if trap.Address == "" {
 			trap.Address = addr.String()
 		}
+		if trap.Inform {
+			if err := s.RespondToInform(addr, trap); err != nil {
+				handler.OnError(addr, err)
+			}
+		}
 
 		handler.OnTrap(addr, trap)
 	}
 }
+
+// RespondToInform acknowledges an INFORM request received from addr, otherwise the sender keeps sending it
+// again. ListenAndServe does this automatically. Only v2c informs are supported.
+func (s *TrapServer) RespondToInform(addr net.Addr, trap Trap) error {
+	if trap.Version != 2 {
+		return fmt.Errorf("can't respond to v%d inform, only v2c is supported", trap.Version)
+	}
+	varbinds := []interface{}{Sequence}
+	for _, oid := range trap.VarBindOIDs {
+		parsedOid, err := ParseOid(oid)
+		if err != nil {
+			return err
+		}
+		varbinds = append(varbinds, []interface{}{Sequence, parsedOid, trap.VarBinds[oid]})
+	}
+	resp, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), trap.Community,
+		[]interface{}{AsnGetResponse, trap.RequestID, 0, 0, varbinds}})
+	if err != nil {
+		return err
+	}
+	_, err = s.Conn.WriteTo(resp, addr)
+	return err
+}
@@ -0,0 +1,129 @@
+package snmplib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNewTrapServerReuseAddr(t *testing.T) {
+	server, err := NewTrapServerWithConfig(TrapServerConfig{Address: "127.0.0.1", ReuseAddr: true})
+	if err != nil {
+		t.Fatalf("Error creating trap server: %v", err)
+	}
+	defer server.Conn.Close()
+
+	if server.Port == 0 || !server.IPAddress.IP.IsLoopback() {
+		t.Errorf("Trap server bound to %v, expected an ephemeral port on 127.0.0.1", server.IPAddress.String())
+	}
+
+	// A second server with address reuse can bind the same port.
+	other, err := NewTrapServerWithConfig(TrapServerConfig{Address: "127.0.0.1", Port: server.Port, ReuseAddr: true})
+	if err != nil {
+		t.Fatalf("Error binding port %d again with address reuse: %v", server.Port, err)
+	}
+	other.Conn.Close()
+}
+
+type informHandler struct {
+	traps chan Trap
+}
+
+func (h informHandler) OnError(addr net.Addr, err error) {}
+
+func (h informHandler) OnTrap(addr net.Addr, trap Trap) {
+	h.traps <- trap
+}
+
+func TestInformResponse(t *testing.T) {
+	server, err := NewTrapServerWithConfig(TrapServerConfig{Address: "127.0.0.1"})
+	if err != nil {
+		t.Fatalf("Error creating trap server: %v", err)
+	}
+	defer server.Conn.Close()
+	handler := informHandler{make(chan Trap, 1)}
+	go server.ListenAndServe(handler)
+
+	client, err := net.Dial("udp", server.Conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting to trap server: %v", err)
+	}
+	defer client.Close()
+
+	sysUpTime := time.Duration(1234) * 10 * time.Millisecond
+	inform, err := EncodeSequence([]interface{}{Sequence, int(SNMPv2c), "public",
+		[]interface{}{AsnInform, 4242, 0, 0,
+			[]interface{}{Sequence,
+				[]interface{}{Sequence, MustParseOid("1.3.6.1.2.1.1.3.0"), sysUpTime},
+				[]interface{}{Sequence, MustParseOid("1.3.6.1.6.3.1.1.4.1.0"), MustParseOid("1.3.6.1.6.3.1.1.5.1")}}}})
+	if err != nil {
+		t.Fatalf("Error encoding inform: %v", err)
+	}
+	if _, err := client.Write(inform); err != nil {
+		t.Fatalf("Error sending inform: %v", err)
+	}
+
+	trap := <-handler.traps
+	if !trap.Inform || trap.RequestID != 4242 {
+		t.Errorf("Inform parsed as %+v", trap)
+	}
+
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response := make([]byte, bufSize)
+	numRead, err := client.Read(response)
+	if err != nil {
+		t.Fatalf("Error reading inform response: %v", err)
+	}
+	resp, err := DecodePacket(response[:numRead])
+	if err != nil {
+		t.Fatalf("Error decoding inform response: %v", err)
+	}
+	if resp.RequestID != 4242 || resp.ErrorStatus != 0 || len(resp.VarBinds) != 2 || resp.VarBinds[0].Value != sysUpTime {
+		t.Errorf("Inform response is %+v", resp)
+	}
+}
+
+func TestTrapMux(t *testing.T) {
+	linkTraps := informHandler{make(chan Trap, 1)}
+	netSnmp := informHandler{make(chan Trap, 1)}
+	others := informHandler{make(chan Trap, 1)}
+	mux := NewTrapMux(others)
+	mux.Handle(MustParseOid("1.3.6.1.6.3.1.1.5"), linkTraps)
+	mux.Handle(MustParseOid("1.3.6.1.4.1.8072"), netSnmp)
+
+	notification := func(oid string) Trap {
+		return Trap{Version: 2, VarBinds: map[string]interface{}{".1.3.6.1.6.3.1.1.4.1.0": MustParseOid(oid)}}
+	}
+	tests := []struct {
+		trap     Trap
+		expected informHandler
+	}{
+		{notification("1.3.6.1.6.3.1.1.5.3"), linkTraps},
+		{notification("1.3.6.1.4.1.8072.4.0.2"), netSnmp},
+		{Trap{Version: 1, OID: MustParseOid("1.3.6.1.4.1.8072.3.2.10"), GenericTrap: EnterpriseSpecific, SpecificTrap: 1}, netSnmp},
+		{Trap{Version: 1, GenericTrap: LinkUp}, linkTraps},
+		{notification("1.3.6.1.4.1.9.9.41.2.0.1"), others},
+		{Trap{Version: 2}, others},
+	}
+	for idx, test := range tests {
+		mux.OnTrap(nil, test.trap)
+		select {
+		case <-test.expected.traps:
+		default:
+			t.Errorf("Trap %d wasn't dispatched to the expected handler", idx)
+			for _, handler := range []informHandler{linkTraps, netSnmp, others} {
+				select {
+				case <-handler.traps:
+				default:
+				}
+			}
+		}
+	}
+
+	// The longest prefix wins.
+	trapsOfOne := informHandler{make(chan Trap, 1)}
+	mux.Handle(MustParseOid("1.3.6.1.4.1.8072.4"), trapsOfOne)
+	if mux.Handler(notification("1.3.6.1.4.1.8072.4.0.2")) != trapsOfOne {
+		t.Errorf("Trap wasn't dispatched to the handler of the longest prefix")
+	}
+}
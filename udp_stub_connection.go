@@ -3,14 +3,17 @@ package snmplib
 import (
 	"encoding/hex"
 	"net"
+	"os"
 	"testing"
 	"time"
 )
 
 // Internal structure to take care of responses.
 type expectAndRespond struct {
-	expect  string
-	respond []string
+	expect    string
+	any       bool
+	respond   []string
+	respondTo func(request []byte) []string
 }
 
 /* A udpStub is a UDP stubbing tool.
@@ -25,6 +28,8 @@ type expectAndRespond struct {
 */
 type udpStub struct {
 	ignoreUnknownPackets bool
+	timeoutWhenEmpty     bool  // Read times out instead of reading nothing when no response is queued.
+	readError            error // Read returns it instead of reading nothing when no response is queued.
 	expectResponses      []*expectAndRespond
 	queuedPackets        []string
 
@@ -39,7 +44,15 @@ func NewUdpStub(t *testing.T) *udpStub {
 
 // Expect declares that you expect this connection to be sent a hex-encoded string.
 func (u *udpStub) Expect(packet string) *expectAndRespond {
-	e := &expectAndRespond{packet, []string{}}
+	e := &expectAndRespond{expect: packet, respond: []string{}}
+	u.expectResponses = append(u.expectResponses, e)
+	return e
+}
+
+// ExpectAny declares that you expect this connection to be sent a packet, whatever its contents.
+// Useful for packets with random or encrypted parts, like SNMPv3 requests.
+func (u *udpStub) ExpectAny() *expectAndRespond {
+	e := &expectAndRespond{any: true, respond: []string{}}
 	u.expectResponses = append(u.expectResponses, e)
 	return e
 }
@@ -52,6 +65,13 @@ func (e *expectAndRespond) AndRespond(packets []string) *expectAndRespond {
 	return e
 }
 
+// AndRespondTo registers a function building the responses from the packet received, for responses
+// depending on its contents, e.g. encrypted SNMPv3 responses echoing the request ID.
+func (e *expectAndRespond) AndRespondTo(respond func(request []byte) []string) *expectAndRespond {
+	e.respondTo = respond
+	return e
+}
+
 /* Read reads bytes from the connection.
 
    Only returns stuff you put in the object with the AndRespond method.
@@ -63,18 +83,22 @@ func (u *udpStub) Read(b []byte) (n int, err error) {
 			u.t.Fatalf("Error while decoding expected packet : '%v'", err)
 		}
 
-		for idx, vb := range val {
-			b[idx] = vb
-		}
-		return len(val), nil
+		// Like a UDP socket, the part of the datagram that doesn't fit is lost.
 		u.queuedPackets = u.queuedPackets[1:]
+		return copy(b, val), nil
+	}
+	if u.timeoutWhenEmpty {
+		return 0, os.ErrDeadlineExceeded
+	}
+	if u.readError != nil {
+		return 0, u.readError
 	}
 	return 0, nil
 }
 
 /* Write writes bytes to the connection.
 
-   If the bytes were expected, it can trigger responses.
+   If the bytes were expected, it can trigger responses, which echo the request ID.
    If an unexpected packet is written it will trigger an error.
 */
 func (u *udpStub) Write(b []byte) (n int, err error) {
@@ -82,9 +106,13 @@ func (u *udpStub) Write(b []byte) (n int, err error) {
 	realPacket := hex.EncodeToString(b)
 	expectedPacket := u.expectResponses[0].expect
 
-	if realPacket == expectedPacket {
-		for _, response := range u.expectResponses[0].respond {
-			u.queuedPackets = append(u.queuedPackets, response)
+	if realPacket == expectedPacket || u.expectResponses[0].any {
+		responses := u.expectResponses[0].respond
+		if u.expectResponses[0].respondTo != nil {
+			responses = append(responses, u.expectResponses[0].respondTo(b)...)
+		}
+		for _, response := range responses {
+			u.queuedPackets = append(u.queuedPackets, u.echoID(b, response))
 		}
 		u.expectResponses = u.expectResponses[1:]
 	} else {
@@ -96,6 +124,46 @@ func (u *udpStub) Write(b []byte) (n int, err error) {
 	return len(b), nil
 }
 
+// echoID gives a hex-encoded response the request ID of request, or its msgID for SNMP v3, as an agent
+// would. Responses can't know the random ID of the request beforehand, and recorded ones have the ID of
+// another request. Those which aren't SNMP messages are left as they are, bytes trailing the message too.
+func (u *udpStub) echoID(request []byte, response string) string {
+	id, err := messageID(request)
+	if err != nil {
+		return response
+	}
+	packet, err := hex.DecodeString(response)
+	if err != nil {
+		return response
+	}
+	if respID, err := messageID(packet); err != nil || requestIDsMatch(id, respID) {
+		return response
+	}
+	length, lengthLen, err := DecodeLength(packet[1:])
+	if err != nil || 1+lengthLen+length > len(packet) {
+		return response
+	}
+	trailing := packet[1+lengthLen+length:]
+	decoded, err := DecodeSequence(packet)
+	if err != nil {
+		return response
+	}
+	header := decoded[3]
+	if decoded[1] == int(SNMPv3) {
+		header = decoded[2]
+	}
+	fields, ok := header.([]interface{})
+	if !ok || len(fields) < 2 {
+		return response
+	}
+	fields[1] = id
+	encoded, err := EncodeSequence(decoded)
+	if err != nil {
+		u.t.Fatalf("Error while encoding response with request ID %d : '%v'", id, err)
+	}
+	return hex.EncodeToString(append(encoded, trailing...))
+}
+
 /* Close closes the udpStub.
 
    This sets a boolean flag so you can check the connection was really closed.